@@ -0,0 +1,124 @@
+package vega
+
+import (
+	"errors"
+	"sync"
+)
+
+// How a Balancer picks the queue for each message
+type BalanceStrategy int
+
+const (
+	// Take the queues in turn, each getting its share by weight
+	RoundRobin BalanceStrategy = iota
+
+	// Pick a queue at random, weighted by weight
+	Random
+)
+
+// A queue for a Balancer to push to. A queue with twice the Weight of
+// another gets twice as many messages. Queues with a Weight of 0 or
+// less get none.
+type BalancedQueue struct {
+	Name   string
+	Weight int
+}
+
+var ENoQueues = errors.New("no queues to balance across")
+
+// Spreads messages across several queues, such as one per worker pool,
+// so the producer doesn't have to track which got the last one. It's
+// safe to use from many goroutines.
+type Balancer struct {
+	pusher   Pusher
+	strategy BalanceStrategy
+	queues   []BalancedQueue
+	total    int
+
+	lock sync.Mutex
+
+	// running scores for smooth weighted round robin
+	current []int
+}
+
+// Create a Balancer pushing to queues through p, weighted equally
+func NewBalancer(p Pusher, strategy BalanceStrategy, queues ...string) *Balancer {
+	weighted := make([]BalancedQueue, len(queues))
+
+	for i, name := range queues {
+		weighted[i] = BalancedQueue{Name: name, Weight: 1}
+	}
+
+	return NewWeightedBalancer(p, strategy, weighted...)
+}
+
+// Create a Balancer pushing to queues through p by their weights
+func NewWeightedBalancer(p Pusher, strategy BalanceStrategy, queues ...BalancedQueue) *Balancer {
+	b := &Balancer{
+		pusher:   p,
+		strategy: strategy,
+	}
+
+	for _, q := range queues {
+		if q.Weight <= 0 {
+			continue
+		}
+
+		b.queues = append(b.queues, q)
+		b.total += q.Weight
+	}
+
+	b.current = make([]int, len(b.queues))
+
+	return b
+}
+
+// Return the name of the queue the next message goes to
+func (b *Balancer) Next() (string, error) {
+	if len(b.queues) == 0 {
+		return "", ENoQueues
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.strategy == Random {
+		randLock.Lock()
+		n := randGen.Intn(b.total)
+		randLock.Unlock()
+
+		for _, q := range b.queues {
+			if n < q.Weight {
+				return q.Name, nil
+			}
+
+			n -= q.Weight
+		}
+	}
+
+	// Smooth weighted round robin, which interleaves the queues rather
+	// than sending each its whole share in a row
+	best := 0
+
+	for i, q := range b.queues {
+		b.current[i] += q.Weight
+
+		if b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+
+	b.current[best] -= b.total
+
+	return b.queues[best].Name, nil
+}
+
+// Push msg to the next queue
+func (b *Balancer) Push(msg *Message) error {
+	name, err := b.Next()
+	if err != nil {
+		return err
+	}
+
+	return b.pusher.Push(name, msg)
+}
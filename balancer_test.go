@@ -0,0 +1,96 @@
+package vega
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func drainCount(r *Registry, name string) int {
+	n := 0
+
+	for {
+		del, _ := r.Poll(name)
+		if del == nil {
+			return n
+		}
+
+		del.Ack()
+		n++
+	}
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	r := NewMemRegistry()
+
+	r.Declare("a")
+	r.Declare("b")
+	r.Declare("c")
+
+	b := NewBalancer(r, RoundRobin, "a", "b", "c")
+
+	var order []string
+
+	for i := 0; i < 6; i++ {
+		name, err := b.Next()
+		require.NoError(t, err)
+
+		order = append(order, name)
+	}
+
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, order)
+
+	for i := 0; i < 9; i++ {
+		err := b.Push(Msg("hello"))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 3, drainCount(r, "a"))
+	assert.Equal(t, 3, drainCount(r, "b"))
+	assert.Equal(t, 3, drainCount(r, "c"))
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	r := NewMemRegistry()
+
+	r.Declare("a")
+	r.Declare("b")
+	r.Declare("c")
+
+	b := NewWeightedBalancer(r, RoundRobin,
+		BalancedQueue{"a", 3}, BalancedQueue{"b", 1}, BalancedQueue{"c", 0})
+
+	var order []string
+
+	for i := 0; i < 4; i++ {
+		name, err := b.Next()
+		require.NoError(t, err)
+
+		order = append(order, name)
+	}
+
+	// interleaved rather than three a's in a row
+	assert.Equal(t, []string{"a", "a", "b", "a"}, order)
+
+	b = NewWeightedBalancer(r, Random,
+		BalancedQueue{"a", 3}, BalancedQueue{"b", 1}, BalancedQueue{"c", 0})
+
+	for i := 0; i < 4000; i++ {
+		err := b.Push(Msg("hello"))
+		require.NoError(t, err)
+	}
+
+	a := drainCount(r, "a")
+
+	assert.True(t, a > 2700 && a < 3300, "a got %d of 4000", a)
+	assert.Equal(t, 4000-a, drainCount(r, "b"))
+	assert.Equal(t, 0, drainCount(r, "c"))
+}
+
+func TestBalancerNoQueues(t *testing.T) {
+	b := NewWeightedBalancer(NewMemRegistry(), RoundRobin, BalancedQueue{"a", 0})
+
+	err := b.Push(Msg("hello"))
+	assert.Equal(t, ENoQueues, err)
+}
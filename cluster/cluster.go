@@ -91,12 +91,21 @@ func (cn *clusterNode) publishLocally(msg *vega.Message) error {
 	cn.lock.Lock()
 	defer cn.lock.Unlock()
 
+	live := cn.subscriptions[:0]
+
 	for _, sub := range cn.subscriptions {
 		if sub.Match(msg.CorrelationId) {
-			cn.router.Push(sub.Mailbox, msg)
+			err := cn.router.Push(sub.Mailbox, msg)
+			if errors.Equal(err, vega.ENoMailbox) {
+				continue
+			}
 		}
+
+		live = append(live, sub)
 	}
 
+	cn.subscriptions = live
+
 	return nil
 }
 
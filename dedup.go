@@ -0,0 +1,90 @@
+package vega
+
+import (
+	"sync"
+	"time"
+)
+
+// Header carrying the key DedupMiddleware recognizes repeats of a
+// request by
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Remembers the replies DedupMiddleware sent, by idempotency key.
+// Implement it to keep them somewhere shared, so a request redelivered
+// to another worker is recognized too.
+type DedupStore interface {
+	// Return the reply stored for key. The reply is nil when the
+	// request was one way and had none.
+	Get(key string) (reply *Message, ok bool, err error)
+
+	// Store reply for key, forgetting it once ttl has passed
+	Set(key string, reply *Message, ttl time.Duration) error
+}
+
+type dedupEntry struct {
+	reply   *Message
+	expires time.Time
+}
+
+// A DedupStore kept in memory, so only repeats handled by the same
+// process are recognized
+type MemDedupStore struct {
+	lock    sync.Mutex
+	entries map[string]dedupEntry
+	swept   time.Time
+}
+
+func NewMemDedupStore() *MemDedupStore {
+	return &MemDedupStore{entries: make(map[string]dedupEntry)}
+}
+
+func (s *MemDedupStore) Get(key string) (*Message, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	if !time.Now().Before(e.expires) {
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+
+	if e.reply == nil {
+		return nil, true, nil
+	}
+
+	// The caller stamps the reply with the request's CorrelationId
+	cp := *e.reply
+
+	return &cp, true, nil
+}
+
+func (s *MemDedupStore) Set(key string, reply *Message, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	// Every so often drop the entries nobody asked for again
+	if now.Sub(s.swept) >= ttl {
+		for k, e := range s.entries {
+			if !now.Before(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+
+		s.swept = now
+	}
+
+	if reply != nil {
+		cp := *reply
+		reply = &cp
+	}
+
+	s.entries[key] = dedupEntry{reply, now.Add(ttl)}
+
+	return nil
+}
@@ -550,5 +550,6 @@ func (m *diskMailbox) Stats() *vega.MailboxStats {
 	return &vega.MailboxStats{
 		Size:     header.Size + len(header.DCMessages),
 		InFlight: header.InFlight,
+		Watchers: len(m.watchers),
 	}
 }
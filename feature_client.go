@@ -1,7 +1,11 @@
 package vega
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +22,128 @@ func Dial(addr string) (*FeatureClient, error) {
 	}, nil
 }
 
+// Connect to the broker at addr over TLS, verifying it according to cfg.
+// All FeatureClient behaviors work unchanged over the encrypted connection.
+func DialTLS(addr string, cfg *tls.Config) (*FeatureClient, error) {
+	client, err := NewTLSClient(addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FeatureClient{
+		Client: client,
+	}, nil
+}
+
+type dialConfig struct {
+	tls       *tls.Config
+	timeout   time.Duration
+	insecure  bool
+	reconnect *ReconnectPolicy
+	lease     time.Duration
+}
+
+// Configures how DialWithOptions connects
+type DialOption func(*dialConfig)
+
+// Connect over TLS, verifying the broker according to cfg
+func WithTLS(cfg *tls.Config) DialOption {
+	return func(dc *dialConfig) {
+		dc.tls = cfg
+	}
+}
+
+// Give up connecting (including the handshake) after timeout,
+// returning ETimeout
+func WithDialTimeout(timeout time.Duration) DialOption {
+	return func(dc *dialConfig) {
+		dc.timeout = timeout
+	}
+}
+
+// Have the broker take back each message the client polls if it isn't
+// acked, nacked or extended within lease, and deliver it to another
+// consumer, as it does when the connection is lost. That way a consumer
+// that hangs, rather than going away, doesn't hold on to messages
+// forever. HandleRequests extends the lease while its handler runs,
+// otherwise use Delivery.Extend for processing that can take longer.
+//
+// A message taken back while it's still being processed is handled
+// twice, and its eventual Ack returns EUnknownMessage. Brokers that
+// predate leases ignore it and hold messages until the connection goes
+// away.
+func WithLease(lease time.Duration) DialOption {
+	return func(dc *dialConfig) {
+		dc.lease = lease
+	}
+}
+
+// Connect without encryption, like Local does
+func WithInsecure() DialOption {
+	return func(dc *dialConfig) {
+		dc.insecure = true
+	}
+}
+
+// Connect to the broker at addr configured by opts. Unlike Dial, the
+// connection is established immediately so any failure is returned here.
+func DialWithOptions(addr string, opts ...DialOption) (*FeatureClient, error) {
+	return dialClient(&Client{addr: addr}, opts)
+}
+
+var ENoAddrs = errors.New("no broker addresses given")
+
+// Connect to the first reachable broker in addrs, configured by opts.
+// The brokers are tried in the order given, each within the dial
+// timeout if one is set, and if none can be reached the error from the
+// last one is returned.
+//
+// The whole list is remembered for reconnecting (see WithReconnect):
+// each attempt starts with the broker after the one that was lost and
+// goes round the list, so an attempt only fails when every broker is
+// down, and the policy then decides whether to try again.
+func DialAny(addrs []string, opts ...DialOption) (*FeatureClient, error) {
+	if len(addrs) == 0 {
+		return nil, ENoAddrs
+	}
+
+	client := &Client{
+		addr:  addrs[0],
+		addrs: append([]string(nil), addrs...),
+	}
+
+	return dialClient(client, opts)
+}
+
+func dialClient(client *Client, opts []DialOption) (*FeatureClient, error) {
+	var cfg dialConfig
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	client.secure = !cfg.insecure
+	client.tlsConfig = cfg.tls
+	client.dialTimeout = cfg.timeout
+	client.lease = cfg.lease
+
+	_, err := client.Session()
+	if err != nil {
+		return nil, err
+	}
+
+	return &FeatureClient{
+		Client:    client,
+		reconnect: cfg.reconnect,
+	}, nil
+}
+
+// Connect to the broker at addr, returning ETimeout if the connection
+// can't be established within timeout
+func DialTimeout(addr string, timeout time.Duration) (*FeatureClient, error) {
+	return DialWithOptions(addr, WithDialTimeout(timeout))
+}
+
 func Local() (*FeatureClient, error) {
 	client, err := NewInsecureClient(fmt.Sprintf("127.0.0.1:%d", DefaultPort))
 	if err != nil {
@@ -52,140 +178,1377 @@ func HandlerFunc(h func(*Message) *Message) Handler {
 
 // type Handler func(*Message) *Message
 
+// A handler that can fail. Use HandleErrors to serve it with
+// HandleRequests.
+type ErrorHandler interface {
+	HandleMessage(*Message) (*Message, error)
+}
+
+type wrappedErrorHandlerFunc struct {
+	f func(*Message) (*Message, error)
+}
+
+func (w *wrappedErrorHandlerFunc) HandleMessage(m *Message) (*Message, error) {
+	return w.f(m)
+}
+
+func ErrorHandlerFunc(h func(*Message) (*Message, error)) ErrorHandler {
+	return &wrappedErrorHandlerFunc{h}
+}
+
+type errorReplyHandler struct {
+	h ErrorHandler
+}
+
+func (e *errorReplyHandler) HandleMessage(m *Message) *Message {
+	ret, err := e.h.HandleMessage(m)
+	if err != nil {
+		if rerr, ok := err.(*RejectError); ok {
+			return RejectMsg(rerr.Requeue)
+		}
+
+		return ErrorMsg(err)
+	}
+
+	return ret
+}
+
+// Adapt an ErrorHandler to a Handler that replies with ErrorMsg(err)
+// when the handler fails. Request turns such replies into a *RemoteError,
+// or a *CodedError if err has a code.
+func HandleErrors(h ErrorHandler) Handler {
+	return &errorReplyHandler{h}
+}
+
+const cErrorType = "error"
+
+// Create a reply message reporting err to the requester. If err has a
+// code, such as an *ErrorReply, the reply carries it as an ErrorReply
+// with ErrorReplyContentType, otherwise the Body is just err's text.
+func ErrorMsg(err error) *Message {
+	if msg, ok := codedErrorMsg(err); ok {
+		return msg
+	}
+
+	return &Message{
+		Type: cErrorType,
+		Body: []byte(err.Error()),
+	}
+}
+
+const (
+	cRejectType  = ":reject"
+	cRequeueType = ":requeue"
+)
+
+// Create a reply telling HandleRequests to Reject the request rather
+// than ack it, requeueing it for another attempt if requeue is set.
+// Nothing is sent to the requester.
+func RejectMsg(requeue bool) *Message {
+	if requeue {
+		return &Message{Type: cRequeueType}
+	}
+
+	return &Message{Type: cRejectType}
+}
+
+// Returned by an ErrorHandler served with HandleErrors to reject the
+// request like RejectMsg.
+type RejectError struct {
+	Requeue bool
+	Err     error
+}
+
+func (r *RejectError) Error() string {
+	return fmt.Sprintf("request rejected: %s", r.Err)
+}
+
+// An error reported by the handler of a request
+type RemoteError struct {
+	Message string
+}
+
+func (r *RemoteError) Error() string {
+	return r.Message
+}
+
 // Wraps Client to provide highlevel behaviors that build on the basics
-// of the distributed mailboxes. Should only be used by one goroutine
-// at a time.
+// of the distributed mailboxes.
+//
+// A FeatureClient is safe for concurrent use by many goroutines, which
+// can share one connection, local mailbox and reply dispatch. Configure
+// it first though: PollInterval and the Set methods (SetCodec,
+// SetCompression, SetTransformer, SetLogger, SetObserver, SetPropagator,
+// SetStateObserver, SetClock) aren't synchronized, so they shouldn't be
+// changed while it's in use. Make a Clone for a goroutine that needs its
+// own settings or local mailbox.
 type FeatureClient struct {
 	*Client
 
+	// How long each long poll made by the helpers (Request,
+	// HandleRequests, Receive, pipes) waits before polling again.
+	// Shorter makes them notice shutdown sooner, longer means less
+	// traffic to the broker. Defaults to DefaultPollInterval.
+	PollInterval time.Duration
+
 	localMailbox string
 	lock         sync.Mutex
+
+	// set on clones, which share the connection rather than own it
+	clone bool
+
+	reconnect  *ReconnectPolicy
+	codec      Codec
+	observer   MetricsObserver
+	logger     Logger
+	propagator Propagator
+	onState    StateObserver
+	clock      Clock
+
+	compressor    Compressor
+	compressAbove int
+
+	transformer   MessageTransformer
+	transformName string
+
+	// requests waiting on a reply in localMailbox, by correlation id
+	replies     map[string]chan *pendingReply
+	dispatching string
 }
 
-// Create a new FeatureClient that wraps the same Client as
-// this one. Useful for creating a new instance to use in a new
-// goroutine
+// Create a new FeatureClient that wraps the same Client as this one,
+// with the same settings but a local mailbox of its own. Changing the
+// clone's settings doesn't affect fc. Close the clone when done with
+// it so its local mailbox is abandoned on the broker.
 func (fc *FeatureClient) Clone() *FeatureClient {
-	return &FeatureClient{Client: fc.Client}
+	return &FeatureClient{
+		Client:       fc.Client,
+		PollInterval: fc.PollInterval,
+		clone:        true,
+		reconnect:    fc.reconnect,
+		codec:        fc.codec,
+		observer:     fc.observer,
+		logger:       fc.logger,
+		propagator:   fc.propagator,
+		onState:      fc.onState,
+		clock:        fc.clock,
+
+		compressor:    fc.compressor,
+		compressAbove: fc.compressAbove,
+
+		transformer:   fc.transformer,
+		transformName: fc.transformName,
+	}
+}
+
+// The PollInterval used when none is set
+const DefaultPollInterval = 1 * time.Minute
+
+func (fc *FeatureClient) pollInterval() time.Duration {
+	if fc.PollInterval <= 0 {
+		return DefaultPollInterval
+	}
+
+	return fc.PollInterval
+}
+
+// Returned to requests still waiting on a reply when their client is
+// closed
+var EClosed = errors.New("client closed")
+
+// Abandon the local mailbox, failing any requests still waiting on a
+// reply with EClosed. Unless fc is a clone, the connection to the
+// broker is closed as well; clones leave it open for the others.
+func (fc *FeatureClient) Close() error {
+	fc.lock.Lock()
+
+	for id, c := range fc.replies {
+		c <- &pendingReply{err: EClosed}
+		delete(fc.replies, id)
+	}
+
+	name := fc.localMailbox
+
+	fc.localMailbox = ""
+	fc.dispatching = ""
+
+	fc.lock.Unlock()
+
+	var err error
+
+	if name != "" {
+		err = fc.Abandon(name)
+	}
+
+	if fc.clone {
+		return err
+	}
+
+	if cerr := fc.Client.Close(); err == nil {
+		err = cerr
+	}
+
+	fc.setState(Disconnected)
+
+	return err
 }
 
-// Return the name of a ephemeral mailbox only for this instance
+// Return the name of a ephemeral mailbox only for this instance.
+// Panics if the mailbox can't be declared, use LocalMailboxE to get
+// the error instead.
 func (fc *FeatureClient) LocalMailbox() string {
+	name, err := fc.LocalMailboxE()
+	if err != nil {
+		panic(err)
+	}
+
+	return name
+}
+
+// Return the name of a ephemeral mailbox only for this instance,
+// declaring it if needed.
+func (fc *FeatureClient) LocalMailboxE() (string, error) {
 	fc.lock.Lock()
 	defer fc.lock.Unlock()
 
+	return fc.localMailboxLocked()
+}
+
+func (fc *FeatureClient) localMailboxLocked() (string, error) {
 	if fc.localMailbox != "" {
-		return fc.localMailbox
+		return fc.localMailbox, nil
 	}
 
 	r := RandomMailbox()
 
 	err := fc.EphemeralDeclare(r)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	fc.localMailbox = r
 
-	return r
+	return r, nil
 }
 
 const cEphemeral = "#ephemeral"
 
+// Returned without asking the broker when a mailbox name is empty, such
+// as pushing a reply to a message with no ReplyTo
+var EInvalidQueue = errors.New("invalid queue name")
+
+func checkName(name string) error {
+	if name == "" {
+		return EInvalidQueue
+	}
+
+	return nil
+}
+
 func (fc *FeatureClient) Declare(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
 	if strings.HasSuffix(name, cEphemeral) {
-		return fc.Client.EphemeralDeclare(name)
+		return fc.EphemeralDeclare(name)
 	}
 
-	return fc.Client.Declare(name)
+	return fc.withReconnect(func() error {
+		return fc.Client.Declare(name)
+	})
 }
 
+// Handle requests on the mailbox name with h, replying to each with
+// what h returns. Messages without a ReplyTo, or that h returns nil
+// for, are acked without a reply so one-way messages can be served by
+// the same loop.
 func (fc *FeatureClient) HandleRequests(name string, h Handler) error {
+	return fc.HandleRequestsContext(context.Background(), name, h)
+}
+
+// Handle requests until ctx is done. A message that is already being
+// handled when ctx is cancelled is still acked and replied to before
+// ctx.Err() is returned.
+func (fc *FeatureClient) HandleRequestsContext(ctx context.Context, name string, h Handler) error {
+	return fc.HandleRequestsWithOpts(ctx, name, h, HandleRequestsOpts{})
+}
+
+// Options for HandleRequestsWithOpts
+type HandleRequestsOpts struct {
+	// Called with the message and recovered value when the handler panics
+	OnPanic func(*Message, interface{})
+
+	// Reply with an error message when the handler panics rather than
+	// leaving the requester waiting
+	ReplyOnPanic bool
+
+	// Mailbox to push messages that caused the handler to panic, or
+	// that it rejected without requeueing, to
+	DeadLetterQueue string
+
+	// Give each message this many attempts before it's dead-lettered.
+	// An attempt fails if the handler panics, replies with an error or
+	// returns RejectMsg(true). Failed attempts are retried by pushing
+	// the message back with its AttemptsHeader incremented, and the
+	// requester only gets an error reply once the last attempt fails.
+	// Redeliveries by the broker, such as after a consumer went away
+	// mid-request, count as failed attempts too when the broker reports
+	// Delivery.DeliveryCount. 0 means no retries.
+	MaxAttempts int
+}
+
+// Header counting the failed attempts at handling a message when
+// HandleRequestsOpts.MaxAttempts is set
+const AttemptsHeader = "attempts"
+
+// Returned to the requester when the handler panics and ReplyOnPanic is set
+type PanicError struct {
+	Value interface{}
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", p.Value)
+}
+
+// Handle requests like HandleRequestsContext, using opts. A handler that
+// panics doesn't stop the loop, the message is acked (after being
+// pushed to opts.DeadLetterQueue if set) and the next one is handled.
+// A handler that returns RejectMsg has the request rejected the same
+// way, or requeued to be delivered again. A RequestCancelType message
+// cancels the request it names rather than reaching the handler, see
+// RequestFuture.CancelRequest.
+func (fc *FeatureClient) HandleRequestsWithOpts(ctx context.Context, name string, h Handler, opts HandleRequestsOpts) error {
 	for {
-		del, err := fc.LongPoll(name, 1*time.Minute)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		del, err := fc.pollContext(ctx, name, true)
 		if err != nil {
 			return err
 		}
 
-		if del == nil {
-			continue
+		fc.handleDelivery(ctx, name, del, h, &opts)
+	}
+}
+
+func (fc *FeatureClient) handleDelivery(ctx context.Context, name string, del *Delivery, h Handler, opts *HandleRequestsOpts) {
+	msg := del.Message
+
+	if msg.Type == RequestCancelType {
+		debugf("canceling request %s\n", msg.CorrelationId)
+		fc.Client.cancels.cancel(msg.CorrelationId)
+		fc.logError("ack request cancel", del.Ack())
+		return
+	}
+
+	if opts.DeadLetterQueue != "" {
+		del.deadLetter = fc.deadLetterTo(opts.DeadLetterQueue)
+	}
+
+	deadline, hasDeadline := msg.Deadline()
+
+	if hasDeadline && !fc.Clock().Now().Before(deadline) {
+		debugf("dropping expired request %s\n", msg.MessageId)
+		fc.logError("ack expired request", del.Ack())
+		return
+	}
+
+	if fc.holdUntilDue(name, del) {
+		return
+	}
+
+	if fc.propagator != nil {
+		ctx = fc.propagator.Extract(ctx, HeaderCarrier{msg})
+	}
+
+	if hasDeadline {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	var running *runningRequest
+
+	if msg.CorrelationId != "" {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		running = fc.Client.cancels.start(msg.CorrelationId, cancel)
+		if running == nil {
+			debugf("dropping canceled request %s\n", msg.CorrelationId)
+			fc.logError("ack canceled request", del.Ack())
+			return
 		}
 
-		msg := del.Message
+		defer fc.Client.cancels.finish(msg.CorrelationId, running)
+	}
+
+	var stopLease func()
+
+	if del.lease > 0 {
+		stopLease = fc.keepLeased(del)
+	}
 
-		ret := h.HandleMessage(msg)
+	start := time.Now()
 
-		del.Ack()
+	ret, perr := callHandler(ctx, h, msg)
 
-		fc.Push(msg.ReplyTo, ret)
+	if stopLease != nil {
+		stopLease()
 	}
-}
 
-func (fc *FeatureClient) Request(name string, msg *Message) (*Delivery, error) {
-	msg.ReplyTo = fc.LocalMailbox()
+	var herr error
 
-	err := fc.Push(name, msg)
-	if err != nil {
-		return nil, err
+	if perr != nil {
+		herr = perr
+	} else if ret != nil && ret.Type == cErrorType {
+		herr = DecodeErrorReply(ret)
 	}
 
-	for {
-		resp, err := fc.LongPoll(msg.ReplyTo, 1*time.Minute)
-		if err != nil {
-			return nil, err
+	fc.metrics().ObserveHandle(name, time.Since(start), herr)
+
+	if running != nil && fc.Client.cancels.wasCanceled(running) {
+		// The requester has stopped waiting, so there's nobody to reply
+		// to or retry for
+		debugf("request %s was canceled while being handled\n", msg.CorrelationId)
+		fc.logError("ack canceled request", del.Ack())
+		return
+	}
+
+	if perr != nil {
+		debugf("handler panic on %s: %v\n", msg.MessageId, perr.Value)
+
+		if opts.OnPanic != nil {
+			opts.OnPanic(msg, perr.Value)
 		}
 
-		if resp == nil {
-			continue
+		if fc.retry(name, del, opts) {
+			return
 		}
 
-		return resp, nil
+		fc.logError("reject request", del.Reject(false))
+
+		if !opts.ReplyOnPanic {
+			return
+		}
+
+		ret = ErrorMsg(perr)
+	} else if ret == nil {
+		// Nothing to reply with, the message was one way
+		fc.logError("ack request", del.Ack())
+		return
+	} else {
+		switch ret.Type {
+		case cRejectType:
+			fc.logError("reject request", del.Reject(false))
+			return
+		case cRequeueType:
+			if opts.MaxAttempts <= 0 {
+				fc.logError("requeue request", del.Reject(true))
+			} else if !fc.retry(name, del, opts) {
+				fc.logError("reject request", del.Reject(false))
+			}
+
+			return
+		case cErrorType:
+			if opts.MaxAttempts <= 0 {
+				fc.logError("ack request", del.Ack())
+				break
+			}
+
+			if fc.retry(name, del, opts) {
+				return
+			}
+
+			fc.logError("reject request", del.Reject(false))
+		default:
+			fc.logError("ack request", del.Ack())
+		}
 	}
-}
 
-type Receiver struct {
-	// channel that messages are sent to
-	Channel <-chan *Delivery
+	if msg.ReplyTo == "" {
+		debugf("not replying to %s, it has no ReplyTo\n", msg.MessageId)
+		return
+	}
 
-	// Any error detected while receiving
-	Error error
+	ret.CorrelationId = msg.CorrelationId
 
-	shutdown chan struct{}
+	fc.logError("send reply to "+msg.ReplyTo, fc.Push(msg.ReplyTo, ret))
 }
 
-func (rec *Receiver) Close() error {
-	close(rec.shutdown)
-	return nil
-}
+// Extend del's lease every half lease until the returned func is called,
+// so a handler taking longer than the lease doesn't lose its message
+func (fc *FeatureClient) keepLeased(del *Delivery) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
 
-func (fc *FeatureClient) Receive(name string) *Receiver {
-	c := make(chan *Delivery)
+	go func() {
+		defer close(stopped)
 
-	rec := &Receiver{c, nil, make(chan struct{})}
+		ticker := time.NewTicker(del.lease / 2)
+		defer ticker.Stop()
 
-	go func() {
 		for {
 			select {
-			case <-rec.shutdown:
-				close(c)
-				return
-			default:
-				// We don't cancel this action if Receive is told to Close. Instead
-				// we let it timeout and then detect the shutdown request and exit.
-				msg, err := fc.Client.LongPoll(name, 1*time.Minute)
+			case <-ticker.C:
+				err := del.Extend(del.lease)
 				if err != nil {
-					close(c)
+					fc.logError("extend lease on "+string(del.Message.MessageId), err)
 					return
 				}
+			case <-done:
+				return
+			}
+		}
+	}()
 
-				if msg == nil {
-					continue
-				}
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
 
-				c <- msg
-			}
+// Count a failed attempt at del and, if opts allows another, push it
+// back to name and ack the original. Returns false when the caller
+// should give up on the message instead.
+func (fc *FeatureClient) retry(name string, del *Delivery, opts *HandleRequestsOpts) bool {
+	if opts.MaxAttempts <= 0 {
+		return false
+	}
+
+	msg := del.Message
+
+	attempts, _ := msg.headerUint(AttemptsHeader)
+
+	// earlier deliveries of this copy, which the header doesn't count
+	if del.DeliveryCount > 1 {
+		attempts += uint64(del.DeliveryCount - 1)
+	}
+
+	attempts++
+
+	headers := make(map[string]interface{}, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	headers[AttemptsHeader] = attempts
+	msg.Headers = headers
+
+	if attempts >= uint64(opts.MaxAttempts) {
+		return false
+	}
+
+	again := *msg
+	again.MessageId = ""
+
+	err := fc.Push(name, &again)
+	if err != nil {
+		// Leave it for the broker to deliver again instead
+		fc.logError("retry request", err)
+		fc.logError("nack request", del.Nack())
+		return true
+	}
+
+	fc.logError("ack request", del.Ack())
+
+	return true
+}
+
+// Return a function pushing dead letters to name
+func (fc *FeatureClient) deadLetterTo(name string) func(*Message) error {
+	return func(msg *Message) error {
+		return fc.Push(name, msg)
+	}
+}
+
+// Call h, recovering a panic as a *PanicError
+func callHandler(ctx context.Context, h Handler, msg *Message) (ret *Message, perr *PanicError) {
+	defer func() {
+		if v := recover(); v != nil {
+			perr = &PanicError{v}
 		}
 	}()
 
-	return rec
+	return handleContext(ctx, h, msg), nil
+}
+
+// Handle requests with a pool of workers, so up to workers messages are
+// handled concurrently. If any worker fails, the rest are stopped and
+// the first error is returned.
+func (fc *FeatureClient) HandleRequestsN(name string, h Handler, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			errs <- fc.HandleRequestsContext(ctx, name, h)
+		}()
+	}
+
+	var first error
+
+	for i := 0; i < workers; i++ {
+		err := <-errs
+		if first == nil {
+			first = err
+			cancel()
+		}
+	}
+
+	return first
+}
+
+// Send msg to the mailbox name and wait for the reply, see
+// RequestContext.
+//
+// The reply delivery is left unacked. Ack it once it's been dealt with:
+// until then the broker counts it as in flight on the connection and
+// holds on to it, even after the local mailbox is abandoned, until the
+// connection closes. Use RequestAck when there's no reason to hold it.
+func (fc *FeatureClient) Request(name string, msg *Message) (*Delivery, error) {
+	return fc.RequestContext(context.Background(), name, msg)
+}
+
+// Like Request, acking the reply and returning just its message
+func (fc *FeatureClient) RequestAck(name string, msg *Message) (*Message, error) {
+	del, err := fc.Request(name, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = del.Ack()
+	if err != nil {
+		return nil, err
+	}
+
+	return del.Message, nil
+}
+
+// Push s to the mailbox name as the message body. The bytes of s are
+// sent as they are, with no codec or content type involved, so s is
+// normally UTF-8 text. Meant for scripts and debugging.
+func (fc *FeatureClient) PushString(name string, s string) error {
+	return fc.Push(name, &Message{Body: []byte(s)})
+}
+
+// Send a request with s as its body, like PushString, and wait up to
+// timeout for the reply, returning its body as a string with no
+// decoding. The reply is acked. Error replies and timeouts are returned
+// as with RequestTimeout.
+func (fc *FeatureClient) RequestStringTimeout(name string, s string, timeout time.Duration) (string, error) {
+	del, err := fc.RequestTimeout(name, &Message{Body: []byte(s)}, timeout)
+	if err != nil {
+		return "", err
+	}
+
+	err = del.Ack()
+	if err != nil {
+		return "", err
+	}
+
+	return string(del.Message.Body), nil
+}
+
+// Send msg to the mailbox name as a request whose reply goes to the
+// mailbox replyTo, without waiting for it. The reply is left for
+// whoever consumes replyTo, such as a collector in another process,
+// which can match it up by msg's CorrelationId. That's set here unless
+// msg already has one.
+func (fc *FeatureClient) RequestTo(name string, replyTo string, msg *Message) error {
+	if err := checkName(replyTo); err != nil {
+		return err
+	}
+
+	err := fc.prepareRequest(context.Background(), name, msg)
+	if err != nil {
+		return err
+	}
+
+	msg.ReplyTo = replyTo
+
+	return fc.Push(name, msg)
+}
+
+// Send a request and wait for the reply, giving up with ctx.Err() if
+// ctx is cancelled or its deadline passes first.
+//
+// If the handler replies with an error message (see HandleErrors), it's
+// returned as a *RemoteError, or a *CodedError if it has a code.
+//
+// The request is stamped with a unique CorrelationId (unless one is
+// already set) and only the reply carrying that id is returned, so it's
+// safe to call Request concurrently from many goroutines on the same
+// FeatureClient or its clones.
+//
+// If msg has an Expiry, EExpired is returned once it passes without a
+// reply. HandleRequests drops requests that have expired by the time
+// they're delivered.
+//
+// A deadline on ctx is sent along in DeadlineHeader, so handlers see it
+// on their context and stale requests are dropped the same way.
+func (fc *FeatureClient) RequestContext(ctx context.Context, name string, msg *Message) (*Delivery, error) {
+	start := time.Now()
+
+	del, _, err := fc.request(ctx, name, msg)
+
+	fc.metrics().ObserveRequest(name, time.Since(start), err)
+
+	return del, err
+}
+
+// Check msg can still be sent to name and stamp it with what the handler
+// needs to know: its CorrelationId, the trace and ctx's deadline
+func (fc *FeatureClient) prepareRequest(ctx context.Context, name string, msg *Message) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if fc.expired(msg) {
+		return EExpired
+	}
+
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = RandomID()
+	}
+
+	if fc.propagator != nil {
+		fc.propagator.Inject(ctx, HeaderCarrier{msg})
+	}
+
+	if d, ok := ctx.Deadline(); ok {
+		msg.AddHeader(DeadlineHeader, d.UTC().Format(time.RFC3339Nano))
+	}
+
+	return nil
+}
+
+// Perform RequestContext, also reporting whether msg was pushed
+func (fc *FeatureClient) request(ctx context.Context, name string, msg *Message) (*Delivery, bool, error) {
+	err := fc.prepareRequest(ctx, name, msg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	reply, err := fc.expectReply(msg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = fc.Push(name, msg)
+	if err != nil {
+		fc.cancelReply(msg.CorrelationId, reply)
+		return nil, false, err
+	}
+
+	var expired <-chan time.Time
+
+	if msg.Expiry != nil {
+		var stop func()
+
+		expired, stop = fc.timer(msg.Expiry.Sub(fc.Clock().Now()))
+		defer stop()
+	}
+
+	select {
+	case pr := <-reply:
+		del, err := pr.result()
+		return del, true, err
+	case <-ctx.Done():
+		fc.cancelReply(msg.CorrelationId, reply)
+		return nil, true, ctx.Err()
+	case <-expired:
+		fc.cancelReply(msg.CorrelationId, reply)
+		return nil, true, EExpired
+	}
+}
+
+// Returned by Request when the request's Expiry passes before a reply
+// arrives
+var EExpired = errors.New("request expired")
+
+// Send a request and wait at most timeout for the reply, returning
+// ETimeout if it doesn't arrive in time.
+func (fc *FeatureClient) RequestTimeout(name string, msg *Message, timeout time.Duration) (*Delivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	del, err := fc.RequestContext(ctx, name, msg)
+	if err == context.DeadlineExceeded {
+		return nil, ETimeout
+	}
+
+	return del, err
+}
+
+// Returned by RequestAll when some of the requests didn't get a reply.
+// The replies that did arrive are returned alongside it.
+type PartialError struct {
+	// Why each request failed, by mailbox name. Requests that didn't
+	// get a reply in time have ETimeout.
+	Errors map[string]error
+}
+
+func (p *PartialError) Error() string {
+	var names []string
+
+	for name := range p.Errors {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return fmt.Sprintf("no reply from %s", strings.Join(names, ", "))
+}
+
+// Send a copy of msg as a request to each mailbox in names and wait at
+// most timeout for the replies. The replies are returned in the order
+// of names, skipping any that failed. If any failed, a *PartialError
+// describing them is returned too. All replies arrive on the client's
+// local mailbox, each copy getting a CorrelationId derived from msg's.
+func (fc *FeatureClient) RequestAll(names []string, msg *Message, timeout time.Duration) ([]*Delivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	id := msg.CorrelationId
+	if id == "" {
+		id = RandomID()
+	}
+
+	results := make([]*Delivery, len(names))
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+
+	for i, name := range names {
+		cp := *msg
+		cp.CorrelationId = fmt.Sprintf("%s.%d", id, i)
+
+		// Each copy gets its own headers for the Propagator to write to
+		if msg.Headers != nil {
+			cp.Headers = make(map[string]interface{}, len(msg.Headers))
+
+			for k, v := range msg.Headers {
+				cp.Headers[k] = v
+			}
+		}
+
+		wg.Add(1)
+
+		go func(i int, name string, msg *Message) {
+			defer wg.Done()
+
+			results[i], errs[i] = fc.RequestContext(ctx, name, msg)
+		}(i, name, &cp)
+	}
+
+	wg.Wait()
+
+	var (
+		dels    []*Delivery
+		partial *PartialError
+	)
+
+	for i, del := range results {
+		err := errs[i]
+		if err == nil {
+			dels = append(dels, del)
+			continue
+		}
+
+		if err == context.DeadlineExceeded {
+			err = ETimeout
+		}
+
+		if partial == nil {
+			partial = &PartialError{Errors: make(map[string]error)}
+		}
+
+		partial.Errors[names[i]] = err
+	}
+
+	if partial != nil {
+		return dels, partial
+	}
+
+	return dels, nil
+}
+
+// Check that the broker is reachable and serving requests by declaring
+// and abandoning a throwaway ephemeral mailbox, returning ETimeout if
+// that takes longer than timeout. Connection errors are returned rather
+// than retried, so this is suitable for health checks.
+func (fc *FeatureClient) Ping(timeout time.Duration) error {
+	res := make(chan error, 1)
+
+	go func() {
+		name := "ping." + RandomID() + cEphemeral
+
+		err := fc.Client.EphemeralDeclare(name)
+		if err == nil {
+			err = fc.Client.Abandon(name)
+		}
+
+		res <- err
+	}()
+
+	expired, stop := fc.timer(timeout)
+	defer stop()
+
+	select {
+	case err := <-res:
+		return err
+	case <-expired:
+		return ETimeout
+	}
+}
+
+// Wait for a message on the mailbox name, long polling until one
+// arrives. Returns ctx.Err() once ctx is done, or the error if a poll
+// fails. A message that arrives as ctx is cancelled is left in the
+// mailbox rather than returned.
+func (fc *FeatureClient) PollContext(ctx context.Context, name string) (*Delivery, error) {
+	return fc.pollContext(ctx, name, false)
+}
+
+// PollContext, reporting each poll to the MetricsObserver if observe is
+// set
+func (fc *FeatureClient) pollContext(ctx context.Context, name string, observe bool) (*Delivery, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		del, err := fc.longPollContext(ctx, name, fc.pollInterval())
+		if err != nil {
+			return nil, err
+		}
+
+		if observe {
+			fc.metrics().ObservePoll(name, del != nil)
+		}
+
+		if del != nil {
+			return del, nil
+		}
+	}
+}
+
+func (fc *FeatureClient) longPollContext(ctx context.Context, name string, til time.Duration) (*Delivery, error) {
+	done, stop := doneChan(ctx)
+	defer stop()
+
+	if done == nil {
+		return fc.LongPoll(name, til)
+	}
+
+	return fc.LongPollCancelable(name, til, done)
+}
+
+type Receiver struct {
+	// channel that messages are sent to
+	Channel <-chan *Delivery
+
+	// Any error detected while receiving. It's set before Channel is
+	// closed, so check it once Channel has been drained. A nil Error
+	// after Channel closes means the Receiver was closed cleanly.
+	Error error
+
+	shutdown  chan struct{}
+	finished  chan struct{}
+	closeOnce sync.Once
+
+	// returns a delivery taken from Channel but never handed on
+	putBack func(*Delivery)
+}
+
+func newReceiver(c <-chan *Delivery) *Receiver {
+	return &Receiver{
+		Channel:  c,
+		shutdown: make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// Tell the receiver to stop. It returns straight away, use Wait to
+// know when receiving has actually stopped.
+func (rec *Receiver) Close() error {
+	rec.closeOnce.Do(func() {
+		close(rec.shutdown)
+	})
+
+	return nil
+}
+
+// Block until the receiving goroutine has exited after Close, or
+// after an error. A poll in progress is cancelled, so that's normally
+// straight away, and a message the broker took for it just then is put
+// back in the mailbox. Channel doesn't need to be drained to avoid
+// blocking either: a delivery still waiting to be taken is put back
+// too. Once Wait returns, nothing more is sent on Channel and it's
+// closed.
+func (rec *Receiver) Wait() {
+	<-rec.finished
+}
+
+func (fc *FeatureClient) Receive(name string) *Receiver {
+	return fc.ReceiveWithOpts(name, ReceiveOpts{})
+}
+
+// Options for ReceiveWithOpts
+type ReceiveOpts struct {
+	// Ack each delivery just before it's sent on the channel. Otherwise
+	// the consumer must Ack (or Nack) each delivery itself.
+	AutoAck bool
+
+	// Number of deliveries to pull ahead of the consumer. Without
+	// AutoAck, prefetched deliveries still need to be acked by the
+	// consumer when it gets to them.
+	Prefetch int
+
+	// Mailbox that Reject(false) pushes deliveries to
+	DeadLetterQueue string
+
+	// Stop pulling messages while this many deliveries are waiting to be
+	// acked or nacked, including any prefetched, and pick up again as
+	// they're settled. 0 means no limit. Ignored with AutoAck, where
+	// deliveries are acked as they're received.
+	MaxInFlight int
+
+	// When the connection to the broker is lost, re-dial it and declare
+	// the mailbox again, in case the broker restarted without it, then
+	// carry on receiving rather than closing Channel. Attempts back off
+	// as the client's ReconnectPolicy does, or its defaults, but don't
+	// give up until the Receiver is closed. Only a permanent error (see
+	// IsTemporary) ends the Receiver. Deliveries taken before the
+	// connection was lost can no longer be acked, the broker delivers
+	// them again instead.
+	AutoReconnect bool
+}
+
+// Receive messages from name on the returned Receiver's Channel
+func (fc *FeatureClient) ReceiveWithOpts(name string, opts ReceiveOpts) *Receiver {
+	c := make(chan *Delivery, opts.Prefetch)
+
+	rec := newReceiver(c)
+	rec.putBack = func(del *Delivery) {
+		fc.putBack(name, del, opts.AutoAck)
+	}
+
+	// one token per delivery not yet settled
+	var inflight chan struct{}
+
+	if opts.MaxInFlight > 0 && !opts.AutoAck {
+		inflight = make(chan struct{}, opts.MaxInFlight)
+	}
+
+	// Cancels the poll in progress when the receiver is closed
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-rec.shutdown:
+		case <-rec.finished:
+		}
+
+		cancel()
+	}()
+
+	go func() {
+		defer close(rec.finished)
+
+		for {
+			select {
+			case <-rec.shutdown:
+				close(c)
+				return
+			default:
+				if inflight != nil {
+					select {
+					case inflight <- struct{}{}:
+					case <-rec.shutdown:
+						close(c)
+						return
+					}
+				}
+
+				gen := fc.Client.currentGeneration()
+
+				msg, err := fc.pollContext(ctx, name, true)
+				if err != nil && opts.AutoReconnect && ctx.Err() == nil && IsTemporary(err) {
+					err = fc.resumeReceive(ctx, name, gen)
+					if err == nil {
+						if inflight != nil {
+							<-inflight
+						}
+
+						continue
+					}
+				}
+
+				if err != nil {
+					if ctx.Err() == nil {
+						rec.Error = err
+					}
+
+					close(c)
+					return
+				}
+
+				if fc.holdUntilDue(name, msg) {
+					if inflight != nil {
+						<-inflight
+					}
+
+					continue
+				}
+
+				if inflight != nil {
+					onSettle(msg, func() { <-inflight })
+				}
+
+				if opts.DeadLetterQueue != "" {
+					msg.deadLetter = fc.deadLetterTo(opts.DeadLetterQueue)
+				}
+
+				if opts.AutoAck {
+					err = msg.Ack()
+					if err != nil {
+						rec.Error = err
+						close(c)
+						return
+					}
+				}
+
+				select {
+				case c <- msg:
+				case <-rec.shutdown:
+					fc.putBack(name, msg, opts.AutoAck)
+					close(c)
+					return
+				}
+
+				fc.metrics().ObserveReceive(name)
+			}
+		}
+	}()
+
+	return rec
+}
+
+// Re-dial the connection identified by gen and declare name again, for
+// a Receiver with AutoReconnect. Keeps trying until it works, ctx is
+// done or an error isn't a connection error, returning that error.
+func (fc *FeatureClient) resumeReceive(ctx context.Context, name string, gen int) error {
+	policy := fc.reconnect
+	if policy == nil {
+		policy = &ReconnectPolicy{}
+	}
+
+	fc.setState(Reconnecting)
+
+	for attempt := 0; ; attempt++ {
+		debugf("receiver on %s lost its connection, reconnecting\n", name)
+
+		select {
+		case <-fc.Clock().After(policy.backoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		err := fc.Client.redial(gen)
+		if err == nil {
+			err = fc.Client.Declare(name)
+		}
+
+		if err == nil {
+			fc.setState(Connected)
+			return nil
+		}
+
+		if !isConnectionError(err) {
+			fc.setState(Connected)
+			return err
+		}
+
+		gen = fc.Client.currentGeneration()
+	}
+}
+
+// Wrap del's Ack and Nack so fn is called the first time either is,
+// whether or not it succeeds
+func onSettle(del *Delivery, fn func()) {
+	var once sync.Once
+
+	ack, nack := del.Ack, del.Nack
+
+	del.Ack = func() error {
+		err := ack()
+		once.Do(fn)
+		return err
+	}
+
+	del.Nack = func() error {
+		err := nack()
+		once.Do(fn)
+		return err
+	}
+}
+
+// Return a delivery the consumer never took to the mailbox name
+func (fc *FeatureClient) putBack(name string, del *Delivery, acked bool) {
+	if !acked {
+		fc.logError("nack untaken delivery", del.Nack())
+		return
+	}
+
+	again := *del.Message
+	again.MessageId = ""
+
+	fc.logError("requeue untaken delivery", fc.Push(name, &again))
+}
+
+// Receive messages from name, calling fn with each one in turn until
+// the returned Receiver is closed. fn is responsible for acking the
+// deliveries. If fn panics, the panic is logged and the delivery is
+// rejected, then the next one is handled.
+//
+// The Receiver's Channel carries no deliveries, it's closed once the
+// loop has stopped, after which Error reports why.
+func (fc *FeatureClient) ReceiveFunc(name string, fn func(*Delivery)) (*Receiver, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	inner := fc.Receive(name)
+
+	done := make(chan *Delivery)
+
+	rec := newReceiver(done)
+
+	go func() {
+		<-rec.shutdown
+		inner.Close()
+	}()
+
+	go func() {
+		defer close(rec.finished)
+
+		for del := range inner.Channel {
+			fc.callReceiveFunc(fn, del)
+		}
+
+		rec.Error = inner.Error
+
+		// make sure the goroutine stopping inner exits
+		rec.Close()
+
+		inner.Wait()
+		close(done)
+	}()
+
+	return rec, nil
+}
+
+// Combine the deliveries of receivers onto one Receiver. Closing it
+// closes all of them. The first error any of them stops with is
+// reported in Error, and stops the rest. Otherwise the Channel is
+// closed once all of them have closed.
+//
+// A delivery that was taken from one of the receivers but not from the
+// merged Channel when it's closed is put back in its mailbox, or nacked
+// if it didn't come from Receive.
+func Merge(receivers ...*Receiver) *Receiver {
+	c := make(chan *Delivery)
+
+	rec := newReceiver(c)
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+	)
+
+	stopAll := func() {
+		for _, r := range receivers {
+			r.Close()
+		}
+	}
+
+	for _, r := range receivers {
+		wg.Add(1)
+
+		go func(r *Receiver) {
+			defer wg.Done()
+
+			for del := range r.Channel {
+				select {
+				case c <- del:
+				case <-rec.shutdown:
+					if r.putBack != nil {
+						r.putBack(del)
+					} else {
+						del.Nack()
+					}
+				}
+			}
+
+			if r.Error != nil {
+				lock.Lock()
+				if rec.Error == nil {
+					rec.Error = r.Error
+				}
+				lock.Unlock()
+
+				rec.Close()
+			}
+		}(r)
+	}
+
+	go func() {
+		<-rec.shutdown
+		stopAll()
+	}()
+
+	go func() {
+		defer close(rec.finished)
+
+		wg.Wait()
+
+		// make sure the goroutine stopping the receivers exits
+		rec.Close()
+
+		for _, r := range receivers {
+			r.Wait()
+		}
+
+		close(c)
+	}()
+
+	return rec
+}
+
+func (fc *FeatureClient) callReceiveFunc(fn func(*Delivery), del *Delivery) {
+	defer func() {
+		if v := recover(); v != nil {
+			fc.logError("receive func", &PanicError{v})
+			del.Reject(false)
+		}
+	}()
+
+	fn(del)
 }
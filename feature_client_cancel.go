@@ -0,0 +1,121 @@
+package vega
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Message type pushed by RequestFuture.CancelRequest to the mailbox a
+// request went to, carrying the request's CorrelationId. HandleRequests
+// acts on it rather than passing it to the handler.
+const RequestCancelType = "request/cancel"
+
+// How long HandleRequests remembers a cancel whose request it hasn't
+// seen, in case the request is taken after it
+const cCancelMemory = time.Minute
+
+// Requests being handled on a connection, so a cancel taken by any
+// HandleRequests loop on it, clones included, reaches the handler
+type cancelTable struct {
+	lock     sync.Mutex
+	running  map[string]*runningRequest
+	canceled map[string]time.Time
+}
+
+type runningRequest struct {
+	cancel   context.CancelFunc
+	canceled bool
+}
+
+// Record that the request id is being handled, with cancel stopping it.
+// Returns nil if the request was already canceled, so it shouldn't be.
+func (t *cancelTable) start(id string, cancel context.CancelFunc) *runningRequest {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.canceled[id]; ok {
+		delete(t.canceled, id)
+		return nil
+	}
+
+	if t.running == nil {
+		t.running = make(map[string]*runningRequest)
+	}
+
+	rr := &runningRequest{cancel: cancel}
+	t.running[id] = rr
+
+	return rr
+}
+
+func (t *cancelTable) finish(id string, rr *runningRequest) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.running[id] == rr {
+		delete(t.running, id)
+	}
+}
+
+// Cancel the request id if it's being handled, otherwise remember it
+// for a while in case it's taken later
+func (t *cancelTable) cancel(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if rr, ok := t.running[id]; ok {
+		rr.canceled = true
+		rr.cancel()
+		return
+	}
+
+	now := time.Now()
+
+	for old, at := range t.canceled {
+		if now.Sub(at) > cCancelMemory {
+			delete(t.canceled, old)
+		}
+	}
+
+	if t.canceled == nil {
+		t.canceled = make(map[string]time.Time)
+	}
+
+	t.canceled[id] = now
+}
+
+func (t *cancelTable) wasCanceled(rr *runningRequest) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return rr.canceled
+}
+
+// Cancel the request like Cancel, and tell the handler too by pushing a
+// RequestCancelType message to the mailbox the request was sent to. If
+// the reply is already in, nothing is sent.
+//
+// HandleRequests acts on the cancel when it takes it. If the request is
+// being handled on the same connection, the handler's context is
+// canceled, so a HandlerWithContext can stop early, and no reply is
+// sent. If the request hasn't been taken yet, it's dropped when it is.
+// The cancel is taken like any other message, so it's only seen while
+// the handler runs if another loop is free to poll the mailbox, such as
+// in a WorkerPool with a concurrency over 1. A single HandleRequests
+// loop only sees it after the handler returns, when it's too late. And
+// with several consumer processes, it may go to one that isn't
+// handling the request, which ignores it.
+func (rf *RequestFuture) CancelRequest() error {
+	canceled := rf.resolve(nil, context.Canceled)
+	rf.fc.cancelReply(rf.id, rf.reply)
+
+	if !canceled {
+		return nil
+	}
+
+	return rf.fc.Push(rf.name, &Message{
+		Type:          RequestCancelType,
+		CorrelationId: rf.id,
+	})
+}
@@ -0,0 +1,78 @@
+package vega
+
+import "time"
+
+// Tells the time for a FeatureClient. Tests can set one with SetClock to
+// step through timeouts and delays without waiting for them.
+type Clock interface {
+	Now() time.Time
+
+	// Return a channel that receives the time once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// The system clock, used unless SetClock says otherwise
+var RealClock Clock = realClock{}
+
+// Use c for the client's own timing: request expiry and deadlines,
+// Ping's timeout, PushDelay and holding delayed messages, hedging, retry
+// and reconnect backoff, and pipe keepalives. Clones of fc inherit it.
+//
+// What the broker times, such as long polls and leases, and durations
+// reported to a MetricsObserver still follow the real clock, as do
+// deadlines given as a context or a pipe's SetDeadline, Delivery.Age
+// and the TTLs of a MemDedupStore.
+func (fc *FeatureClient) SetClock(c Clock) {
+	fc.clock = c
+}
+
+// Return the clock set with SetClock, RealClock if none is
+func (fc *FeatureClient) Clock() Clock {
+	if fc.clock == nil {
+		return RealClock
+	}
+
+	return fc.clock
+}
+
+// Report whether msg's Expiry has passed by the client's clock
+func (fc *FeatureClient) expired(msg *Message) bool {
+	return msg.Expiry != nil && !fc.Clock().Now().Before(*msg.Expiry)
+}
+
+// Return a channel that receives once d passes on the client's clock,
+// and a func to call once it's no longer wanted. On the real clock that
+// stops the timer, so long expiries don't pile up.
+func (fc *FeatureClient) timer(d time.Duration) (<-chan time.Time, func()) {
+	if _, ok := fc.Clock().(realClock); ok {
+		t := time.NewTimer(d)
+		return t.C, func() { t.Stop() }
+	}
+
+	return fc.Clock().After(d), func() {}
+}
+
+// Call f in its own goroutine once d passes on the client's clock
+func (fc *FeatureClient) afterFunc(d time.Duration, f func()) {
+	if _, ok := fc.Clock().(realClock); ok {
+		time.AfterFunc(d, f)
+		return
+	}
+
+	c := fc.Clock().After(d)
+
+	go func() {
+		<-c
+		f()
+	}()
+}
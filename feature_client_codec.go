@@ -0,0 +1,271 @@
+package vega
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Converts values to and from message bodies
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+
+	// The MIME type stamped on messages encoded with this codec
+	ContentType() string
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) ContentType() string {
+	return "application/x-gob"
+}
+
+var (
+	// Encodes bodies with encoding/json. This is the default.
+	JSONCodec Codec = jsonCodec{}
+
+	// Encodes bodies with encoding/gob
+	GobCodec Codec = gobCodec{}
+)
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[string]Codec{
+		JSONCodec.ContentType(): JSONCodec,
+		GobCodec.ContentType():  GobCodec,
+	}
+)
+
+// Make c known by its ContentType, so Delivery.Decode and handlers that
+// pick a codec by content type can use it. JSONCodec and GobCodec are
+// registered already.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	codecs[c.ContentType()] = c
+}
+
+// Return the codec registered for contentType
+func lookupCodec(contentType string) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	c, ok := codecs[contentType]
+	return c, ok
+}
+
+// Return the known codec for contentType, defaulting to JSONCodec
+func codecFor(contentType string) Codec {
+	if c, ok := lookupCodec(contentType); ok {
+		return c
+	}
+
+	return JSONCodec
+}
+
+// Returned by Delivery.Decode when there's no codec for the message's
+// content type
+type UnknownContentTypeError struct {
+	ContentType string
+}
+
+func (u *UnknownContentTypeError) Error() string {
+	if u.ContentType == "" {
+		return "message has no content type to decode with"
+	}
+
+	return fmt.Sprintf("no codec for content type %q", u.ContentType)
+}
+
+// Decode the message body into v with the codec registered for its
+// ContentType. A body that the codec can't decode is reported as a
+// *DecodeError.
+func (d *Delivery) Decode(v interface{}) error {
+	c, ok := lookupCodec(d.Message.ContentType)
+	if !ok {
+		return &UnknownContentTypeError{d.Message.ContentType}
+	}
+
+	err := c.Unmarshal(d.Message.Body, v)
+	if err != nil {
+		return &DecodeError{err}
+	}
+
+	return nil
+}
+
+// Returned when a message body can't be decoded, as opposed to the
+// request itself failing.
+type DecodeError struct {
+	Err error
+}
+
+func (d *DecodeError) Error() string {
+	return fmt.Sprintf("unable to decode body: %s", d.Err)
+}
+
+// Create a message with v encoded as the body using c
+func EncodeMsg(c Codec, v interface{}) (*Message, error) {
+	body, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		ContentType: c.ContentType(),
+		Body:        body,
+	}, nil
+}
+
+// Set the codec used by RequestTyped, PushTyped and PublishTyped.
+// Clones of fc inherit it.
+func (fc *FeatureClient) SetCodec(c Codec) {
+	fc.codec = c
+}
+
+// Return the codec used by RequestTyped, PushTyped and PublishTyped
+func (fc *FeatureClient) Codec() Codec {
+	if fc.codec == nil {
+		return JSONCodec
+	}
+
+	return fc.codec
+}
+
+// Encode v with the client's codec and push it to name
+func (fc *FeatureClient) PushTyped(name string, v interface{}) error {
+	msg, err := EncodeMsg(fc.Codec(), v)
+	if err != nil {
+		return err
+	}
+
+	return fc.Push(name, msg)
+}
+
+// Encode req with the client's codec, send it as a request to name and
+// decode the reply body into resp. The reply is acked. A reply that
+// can't be decoded is reported as a *DecodeError.
+func (fc *FeatureClient) RequestTyped(name string, req interface{}, resp interface{}) error {
+	return fc.requestCodec(fc.Codec(), name, req, resp)
+}
+
+// Like RequestTyped, but always encodes with JSONCodec
+func (fc *FeatureClient) RequestJSON(name string, req interface{}, resp interface{}) error {
+	return fc.requestCodec(JSONCodec, name, req, resp)
+}
+
+func (fc *FeatureClient) requestCodec(c Codec, name string, req interface{}, resp interface{}) error {
+	msg, err := EncodeMsg(c, req)
+	if err != nil {
+		return err
+	}
+
+	ret, err := fc.RequestAck(name, msg)
+	if err != nil {
+		return err
+	}
+
+	err = c.Unmarshal(ret.Body, resp)
+	if err != nil {
+		return &DecodeError{err}
+	}
+
+	return nil
+}
+
+type typedHandler struct {
+	codec Codec
+	fn    reflect.Value
+	in    reflect.Type
+	ptr   bool
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Adapt fn, which must have the form func(T) (U, error), into a Handler.
+// The request body is decoded into a T using c and the U returned
+// is encoded with c as the reply. Errors from decoding or from fn are
+// sent back as error replies.
+func TypedHandler(c Codec, fn interface{}) Handler {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() != 2 ||
+		t.Out(1) != errorType {
+		panic("TypedHandler requires a func(T) (U, error)")
+	}
+
+	h := &typedHandler{codec: c, fn: v, in: t.In(0)}
+
+	if h.in.Kind() == reflect.Ptr {
+		h.in = h.in.Elem()
+		h.ptr = true
+	}
+
+	return h
+}
+
+// TypedHandler using JSONCodec
+func JSONHandler(fn interface{}) Handler {
+	return TypedHandler(JSONCodec, fn)
+}
+
+func (h *typedHandler) HandleMessage(msg *Message) *Message {
+	in := reflect.New(h.in)
+
+	err := h.codec.Unmarshal(msg.Body, in.Interface())
+	if err != nil {
+		return ErrorMsg(&DecodeError{err})
+	}
+
+	if !h.ptr {
+		in = in.Elem()
+	}
+
+	out := h.fn.Call([]reflect.Value{in})
+
+	if err, ok := out[1].Interface().(error); ok && err != nil {
+		return ErrorMsg(err)
+	}
+
+	ret, err := EncodeMsg(h.codec, out[0].Interface())
+	if err != nil {
+		return ErrorMsg(err)
+	}
+
+	return ret
+}
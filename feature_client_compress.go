@@ -0,0 +1,139 @@
+package vega
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+)
+
+// Compresses and decompresses message bodies
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+
+	// The ContentEncoding stamped on messages compressed with this
+	ContentEncoding() string
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+func (gzipCompressor) ContentEncoding() string {
+	return "gzip"
+}
+
+// Compresses bodies with compress/gzip
+var GzipCompressor Compressor = gzipCompressor{}
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[string]Compressor{
+		GzipCompressor.ContentEncoding(): GzipCompressor,
+	}
+)
+
+// Make c known by its ContentEncoding, so received messages compressed
+// with it are decompressed. GzipCompressor is registered already.
+func RegisterCompressor(c Compressor) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+
+	compressors[c.ContentEncoding()] = c
+}
+
+func lookupCompressor(encoding string) (Compressor, bool) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+
+	c, ok := compressors[encoding]
+	return c, ok
+}
+
+// Compress the bodies of messages fc pushes with c when they're longer
+// than threshold bytes. The compressor's ContentEncoding is set on them,
+// and messages that already have a ContentEncoding are left alone. A
+// nil c turns compression off. Clones of fc inherit it.
+//
+// Messages are decompressed when they're received whether or not
+// compression is turned on, as long as their ContentEncoding is a
+// registered compressor, so uncompressed messages and ones from clients
+// that compress can be mixed freely.
+func (fc *FeatureClient) SetCompression(c Compressor, threshold int) {
+	fc.compressor = c
+	fc.compressAbove = threshold
+}
+
+// Return msg, or a copy of it with its body compressed if it should be
+func (fc *FeatureClient) compress(msg *Message) *Message {
+	if fc.compressor == nil || msg.ContentEncoding != "" || len(msg.Body) <= fc.compressAbove {
+		return msg
+	}
+
+	body, err := fc.compressor.Compress(msg.Body)
+	if err != nil {
+		fc.logError("compress body", err)
+		return msg
+	}
+
+	// Not worth it, the receiver would only have to undo it
+	if len(body) >= len(msg.Body) {
+		return msg
+	}
+
+	cp := *msg
+	cp.Body = body
+	cp.ContentEncoding = fc.compressor.ContentEncoding()
+
+	return &cp
+}
+
+// Decompress the body of del's message in place if it was compressed
+// with a known compressor
+func (fc *FeatureClient) decompress(del *Delivery) {
+	if del == nil || del.Message.ContentEncoding == "" {
+		return
+	}
+
+	c, ok := lookupCompressor(del.Message.ContentEncoding)
+	if !ok {
+		return
+	}
+
+	body, err := c.Decompress(del.Message.Body)
+	if err != nil {
+		fc.logError("decompress body", err)
+		return
+	}
+
+	del.Message.Body = body
+	del.Message.ContentEncoding = ""
+}
@@ -0,0 +1,72 @@
+package vega
+
+import "time"
+
+// Push msg to the mailbox name to be handled once delay has passed,
+// such as to retry something later or send a reminder.
+//
+// The broker has no scheduled delivery, so the delay is carried in
+// DeliverAfterHeader and honored by the consumer: HandleRequests and
+// Receivers hold a message that isn't due yet rather than handing it
+// on, then push it back to the end of the mailbox once it is. That has
+// some costs compared to the broker scheduling it:
+//
+//   - It's only delayed for consumers using HandleRequests or Receive,
+//     Poll and LongPoll return it straight away.
+//   - Nothing happens without a consumer running, and the message sits
+//     in flight on the one holding it, which the broker reports in its
+//     stats. If that consumer goes away, the broker delivers it again
+//     and another one holds it instead.
+//   - It's handled a little after it's due, behind whatever is queued
+//     by then, rather than in the order it was pushed.
+//   - Whether it's due is judged by the consumer's clock, so skew
+//     against the pusher's shifts the delay.
+func (fc *FeatureClient) PushDelay(name string, msg *Message, delay time.Duration) error {
+	if delay > 0 {
+		msg.AddHeader(DeliverAfterHeader, fc.Clock().Now().Add(delay).UTC().Format(time.RFC3339Nano))
+	}
+
+	return fc.Push(name, msg)
+}
+
+// If del's message isn't due yet, hold on to it until it is, then push
+// it back to the mailbox name and ack it, and return true. Otherwise
+// return false for the caller to handle it.
+func (fc *FeatureClient) holdUntilDue(name string, del *Delivery) bool {
+	at, ok := del.Message.DeliverAfter()
+	if !ok {
+		return false
+	}
+
+	wait := at.Sub(fc.Clock().Now())
+	if wait <= 0 {
+		return false
+	}
+
+	debugf("holding %s for %s until it's due\n", del.Message.MessageId, wait)
+
+	// Don't let the broker take it back while it's held
+	stopLease := func() {}
+	if del.lease > 0 {
+		stopLease = fc.keepLeased(del)
+	}
+
+	fc.afterFunc(wait, func() {
+		stopLease()
+
+		again := *del.Message
+		again.MessageId = ""
+
+		err := fc.Push(name, &again)
+		if err != nil {
+			// Leave it for the broker to deliver again instead
+			fc.logError("requeue delayed message", err)
+			fc.logError("nack delayed message", del.Nack())
+			return
+		}
+
+		fc.logError("ack delayed message", del.Ack())
+	})
+
+	return true
+}
@@ -0,0 +1,100 @@
+package vega
+
+import "encoding/json"
+
+// The content type of an error reply that carries an ErrorReply, so
+// requesters in any language can tell it from a plain text one
+const ErrorReplyContentType = "application/vnd.vega.error+json"
+
+// The wire format of an error reply with a code, encoded as JSON in the
+// reply's Body:
+//
+//	{"code": "not_found", "message": "no such user", "details": {"id": "42"}}
+//
+// It's also an error, so a handler served with HandleErrors can return
+// one to reply with it. Requesters get it back as a *CodedError.
+type ErrorReply struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func (e *ErrorReply) Error() string {
+	return e.Message
+}
+
+// An error reported by the handler of a request with an ErrorReply
+type CodedError struct {
+	Reply ErrorReply
+}
+
+func (c *CodedError) Error() string {
+	return c.Reply.Message
+}
+
+// The code the handler gave the error
+func (c *CodedError) Code() string {
+	return c.Reply.Code
+}
+
+// Extra details the handler gave, nil if none
+func (c *CodedError) Details() map[string]string {
+	return c.Reply.Details
+}
+
+// The reply reporting err, if it has a code. Besides *ErrorReply, any
+// error with a Code() string method has one, and Details() too if it has
+// a Details() map[string]string method, so a *CodedError from another
+// request is passed on as it was.
+func errorReplyFor(err error) (*ErrorReply, bool) {
+	switch e := err.(type) {
+	case *ErrorReply:
+		return e, true
+	case interface{ Code() string }:
+		reply := &ErrorReply{
+			Code:    e.Code(),
+			Message: err.Error(),
+		}
+
+		if d, ok := err.(interface{ Details() map[string]string }); ok {
+			reply.Details = d.Details()
+		}
+
+		return reply, true
+	default:
+		return nil, false
+	}
+}
+
+// The error reply carrying err as an ErrorReply, if it has a code
+func codedErrorMsg(err error) (*Message, bool) {
+	reply, ok := errorReplyFor(err)
+	if !ok {
+		return nil, false
+	}
+
+	body, err := json.Marshal(reply)
+	if err != nil {
+		return nil, false
+	}
+
+	return &Message{
+		Type:        cErrorType,
+		ContentType: ErrorReplyContentType,
+		Body:        body,
+	}, true
+}
+
+// Turn an error reply back into the error it reports: a *CodedError if
+// it carries an ErrorReply, otherwise a *RemoteError with its Body.
+func DecodeErrorReply(msg *Message) error {
+	if msg.ContentType == ErrorReplyContentType {
+		var reply ErrorReply
+
+		if json.Unmarshal(msg.Body, &reply) == nil {
+			return &CodedError{reply}
+		}
+	}
+
+	return &RemoteError{string(msg.Body)}
+}
@@ -0,0 +1,127 @@
+package vega
+
+import (
+	"context"
+	"sync"
+)
+
+// A request whose reply hasn't been waited on yet. Create with
+// RequestAsync.
+type RequestFuture struct {
+	fc    *FeatureClient
+	name  string
+	id    string
+	reply chan *pendingReply
+
+	once sync.Once
+	done chan struct{}
+	del  *Delivery
+	err  error
+}
+
+// Send a request without waiting for the reply. Use Wait on the
+// returned future to get it, or Cancel or CancelRequest to stop
+// waiting. Each future has its own CorrelationId, so many can be
+// outstanding on fc at once.
+func (fc *FeatureClient) RequestAsync(name string, msg *Message) (*RequestFuture, error) {
+	err := fc.prepareRequest(context.Background(), name, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := fc.expectReply(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fc.Push(name, msg)
+	if err != nil {
+		fc.cancelReply(msg.CorrelationId, reply)
+		return nil, err
+	}
+
+	return &RequestFuture{
+		fc:    fc,
+		name:  name,
+		id:    msg.CorrelationId,
+		reply: reply,
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// Set the outcome of the future, unless it already has one
+func (rf *RequestFuture) resolve(del *Delivery, err error) (ok bool) {
+	rf.once.Do(func() {
+		rf.del = del
+		rf.err = err
+		close(rf.done)
+		ok = true
+	})
+
+	return
+}
+
+// Wait for the reply, or until ctx is done. The future can be waited on
+// again if ctx ends first. Once the reply is in, every Wait returns it.
+func (rf *RequestFuture) Wait(ctx context.Context) (*Delivery, error) {
+	select {
+	case pr := <-rf.reply:
+		del, err := pr.result()
+
+		if !rf.resolve(del, err) && del != nil {
+			// Canceled while the reply was arriving
+			del.Ack()
+		}
+	case <-rf.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return rf.del, rf.err
+}
+
+// Stop waiting for the reply. A reply that arrives later is dropped and
+// Wait returns context.Canceled.
+func (rf *RequestFuture) Cancel() {
+	rf.resolve(nil, context.Canceled)
+	rf.fc.cancelReply(rf.id, rf.reply)
+}
+
+// Send a request, returning a channel that receives the reply so it
+// can be waited on in a select. Error replies are sent as they are,
+// with a Message.Type of "error". If the reply can't be received the
+// channel is closed without one.
+//
+// Call the returned func once done with the request, whether or not
+// the reply came. It stops waiting and abandons the reply mailbox if
+// nothing else on fc is using it.
+func (fc *FeatureClient) RequestChan(name string, msg *Message) (<-chan *Delivery, func(), error) {
+	rf, err := fc.RequestAsync(name, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := make(chan *Delivery, 1)
+
+	go func() {
+		defer close(c)
+
+		select {
+		case pr := <-rf.reply:
+			if pr.err != nil {
+				rf.resolve(nil, pr.err)
+				return
+			}
+
+			if rf.resolve(pr.del, nil) {
+				c <- pr.del
+			} else {
+				// Canceled while the reply was arriving
+				pr.del.Ack()
+			}
+		case <-rf.done:
+		}
+	}()
+
+	return c, rf.Cancel, nil
+}
@@ -0,0 +1,68 @@
+//go:build go1.18
+
+package vega
+
+// Encode req with fc's codec, send it as a request to name and decode
+// the reply into a Resp, acking it. On failure the zero Resp is returned
+// with the error; a reply that can't be decoded is a *DecodeError.
+func RequestT[Req, Resp any](fc *FeatureClient, name string, req Req) (Resp, error) {
+	return RequestTypeT[Req, Resp](fc, name, "", req)
+}
+
+// Like RequestT, but sets the request's Type to msgType so it can be
+// routed by a MessageMux, such as to a handler from RegisterHandlerT.
+func RequestTypeT[Req, Resp any](fc *FeatureClient, name, msgType string, req Req) (Resp, error) {
+	var resp Resp
+
+	c := fc.Codec()
+
+	msg, err := EncodeMsg(c, req)
+	if err != nil {
+		return resp, err
+	}
+
+	msg.Type = msgType
+
+	ret, err := fc.RequestAck(name, msg)
+	if err != nil {
+		return resp, err
+	}
+
+	err = c.Unmarshal(ret.Body, &resp)
+	if err != nil {
+		var zero Resp
+		return zero, &DecodeError{err}
+	}
+
+	return resp, nil
+}
+
+// Register fn on mux to handle messages of msgType. The request body is
+// decoded into a Req and the Resp returned is sent as the reply, both
+// using the codec that matches the request's ContentType (JSONCodec if
+// it's unknown). Errors from decoding or from fn are sent back as
+// error replies.
+func RegisterHandlerT[Req, Resp any](mux *MessageMux, msgType string, fn func(Req) (Resp, error)) {
+	mux.HandleFunc(msgType, func(msg *Message) *Message {
+		c := codecFor(msg.ContentType)
+
+		var req Req
+
+		err := c.Unmarshal(msg.Body, &req)
+		if err != nil {
+			return ErrorMsg(&DecodeError{err})
+		}
+
+		resp, err := fn(req)
+		if err != nil {
+			return ErrorMsg(err)
+		}
+
+		ret, err := EncodeMsg(c, resp)
+		if err != nil {
+			return ErrorMsg(err)
+		}
+
+		return ret
+	})
+}
@@ -0,0 +1,69 @@
+//go:build go1.18
+
+package vega
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeatureClientRequestT(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	mux := NewMessageMux()
+
+	RegisterHandlerT(mux, "sum", func(req testJSONReq) (testJSONResp, error) {
+		if req.A < 0 {
+			return testJSONResp{}, fmt.Errorf("negative")
+		}
+
+		return testJSONResp{Sum: req.A + req.B}, nil
+	})
+
+	go fc.Clone().HandleRequests("a", mux)
+
+	resp, err := RequestTypeT[testJSONReq, testJSONResp](fc, "a", "sum", testJSONReq{A: 1, B: 2})
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, resp.Sum)
+
+	resp, err = RequestTypeT[testJSONReq, testJSONResp](fc, "a", "sum", testJSONReq{A: -1, B: 5})
+	assert.Equal(t, &RemoteError{"negative"}, err)
+	assert.Equal(t, testJSONResp{}, resp)
+
+	// the handler replies with the codec the request was sent with
+	gfc := fc.Clone()
+	gfc.SetCodec(GobCodec)
+
+	resp, err = RequestTypeT[testJSONReq, testJSONResp](gfc, "a", "sum", testJSONReq{A: 2, B: 2})
+	require.NoError(t, err)
+
+	assert.Equal(t, 4, resp.Sum)
+
+	_, err = RequestT[testJSONReq, testJSONResp](fc, "a", testJSONReq{A: 1})
+	assert.Equal(t, &RemoteError{EUnknownType.Error()}, err)
+
+	stats, err := fc.Client.Stats()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.InFlight, "replies were left unacked")
+}
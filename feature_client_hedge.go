@@ -0,0 +1,109 @@
+package vega
+
+import (
+	"context"
+	"time"
+)
+
+// Send msg to the mailbox name and wait up to timeout for its reply,
+// like RequestTimeout, but if there's no reply within hedgeAfter, push a
+// second copy of the request and return whichever reply arrives first.
+// It's meant for idempotent requests served by several identical
+// workers on one mailbox, where a slow or stuck worker would otherwise
+// hold the requester up.
+//
+// Both copies carry msg's CorrelationId, so the reply to the losing copy
+// is dropped when it arrives rather than reaching a later request. Once
+// a reply is in, a RequestCancelType message is pushed for the losing
+// copy, as with RequestFuture.CancelRequest, so it's dropped if it
+// hasn't been taken yet or its handler is told to stop. Either way it
+// may still be handled, so the handler shouldn't mind seeing a request
+// twice.
+func (fc *FeatureClient) RequestHedged(name string, msg *Message, hedgeAfter time.Duration, timeout time.Duration) (*Delivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	del, err := fc.requestHedged(ctx, name, msg, hedgeAfter)
+	if err == context.DeadlineExceeded {
+		err = ETimeout
+	}
+
+	fc.metrics().ObserveRequest(name, time.Since(start), err)
+
+	return del, err
+}
+
+func (fc *FeatureClient) requestHedged(ctx context.Context, name string, msg *Message, hedgeAfter time.Duration) (*Delivery, error) {
+	err := fc.prepareRequest(ctx, name, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := fc.expectReply(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fc.Push(name, msg)
+	if err != nil {
+		fc.cancelReply(msg.CorrelationId, reply)
+		return nil, err
+	}
+
+	hedge, stopHedge := fc.timer(hedgeAfter)
+	defer stopHedge()
+
+	var expired <-chan time.Time
+
+	if msg.Expiry != nil {
+		var stop func()
+
+		expired, stop = fc.timer(msg.Expiry.Sub(fc.Clock().Now()))
+		defer stop()
+	}
+
+	hedged := false
+
+	for {
+		select {
+		case pr := <-reply:
+			if hedged {
+				fc.cancelHedge(name, msg)
+			}
+
+			return pr.result()
+		case <-hedge:
+			again := *msg
+			again.MessageId = ""
+
+			debugf("no reply to %s after %s, hedging\n", msg.CorrelationId, hedgeAfter)
+
+			// The first copy is still out there, so it's not worth
+			// failing over
+			err := fc.Push(name, &again)
+			if err != nil {
+				fc.logError("push hedged request", err)
+				break
+			}
+
+			hedged = true
+		case <-ctx.Done():
+			fc.cancelReply(msg.CorrelationId, reply)
+			return nil, ctx.Err()
+		case <-expired:
+			fc.cancelReply(msg.CorrelationId, reply)
+			return nil, EExpired
+		}
+	}
+}
+
+// Tell the handlers of name to drop the other copy of the hedged request
+// msg
+func (fc *FeatureClient) cancelHedge(name string, msg *Message) {
+	fc.logError("cancel hedged request", fc.Push(name, &Message{
+		Type:          RequestCancelType,
+		CorrelationId: msg.CorrelationId,
+	}))
+}
@@ -0,0 +1,21 @@
+package vega
+
+// Receives reports of errors a FeatureClient runs into but has no
+// caller to return them to, such as a failed ack in HandleRequests or
+// an Abandon while closing a pipe. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Report errors that would otherwise be dropped to l. Clones of fc,
+// and pipes made with it, report to l too.
+func (fc *FeatureClient) SetLogger(l Logger) {
+	fc.logger = l
+}
+
+// Log err, if there is one, as the result of doing what
+func (fc *FeatureClient) logError(what string, err error) {
+	if err != nil && fc.logger != nil {
+		fc.logger.Printf("vega: %s: %s", what, err)
+	}
+}
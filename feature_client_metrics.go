@@ -0,0 +1,51 @@
+package vega
+
+import "time"
+
+// Notified by a FeatureClient as it sends requests, handles them and
+// moves data, so callers can collect metrics. Methods are called
+// synchronously from the goroutine doing the work, possibly several
+// at once, so they should be quick and safe for concurrent use.
+//
+// Embed NopObserver to only implement some of the methods.
+type MetricsObserver interface {
+	// A request to name finished after d. err is nil for a reply.
+	ObserveRequest(name string, d time.Duration, err error)
+
+	// A poll of name by HandleRequests or a Receiver finished, got
+	// being false when it timed out empty.
+	ObservePoll(name string, got bool)
+
+	// A request from name was handled in d. err is set when the
+	// handler panicked or replied with an error.
+	ObserveHandle(name string, d time.Duration, err error)
+
+	// A message from name was sent on a Receiver's Channel
+	ObserveReceive(name string)
+
+	// n bytes were written to or read from a pipe
+	ObservePipe(n int, sent bool)
+}
+
+// A MetricsObserver that ignores everything
+type NopObserver struct{}
+
+func (NopObserver) ObserveRequest(name string, d time.Duration, err error) {}
+func (NopObserver) ObservePoll(name string, got bool)                      {}
+func (NopObserver) ObserveHandle(name string, d time.Duration, err error)  {}
+func (NopObserver) ObserveReceive(name string)                             {}
+func (NopObserver) ObservePipe(n int, sent bool)                           {}
+
+// Report to o as fc makes requests, handles them and uses pipes.
+// Clones of fc, and pipes made with it, report to o too.
+func (fc *FeatureClient) SetObserver(o MetricsObserver) {
+	fc.observer = o
+}
+
+func (fc *FeatureClient) metrics() MetricsObserver {
+	if fc.observer == nil {
+		return NopObserver{}
+	}
+
+	return fc.observer
+}
@@ -1,12 +1,13 @@
 package vega
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/sha256"
-	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -22,16 +23,78 @@ func (p *pipeAddr) String() string {
 	return "vega:" + p.q
 }
 
+// Largest body Write puts in a single message unless the pipe's
+// MaxMessageSize says otherwise
+const DefaultPipeMessageSize = 64 * 1024
+
 type PipeConn struct {
+	// Writes larger than this are split across several messages.
+	// Defaults to DefaultPipeMessageSize.
+	MaxMessageSize int
+
+	// Coalesce small writes, holding up to this many bytes until Flush
+	// is called or the buffer fills. 0 sends each Write immediately.
+	WriteBuffer int
+
+	// With WriteBuffer set, also flush this long after bytes are first
+	// buffered so a quiet writer doesn't leave them sitting there.
+	FlushDelay time.Duration
+
+	// Have Close wait up to this long for the peer to take everything
+	// written from the broker before closing, like SO_LINGER. Without
+	// it, Close returns straight away and the peer still reads the data
+	// before io.EOF, unless it gives up first. Ignored if the broker
+	// can't report QueueStats.
+	Linger time.Duration
+
 	fc     *FeatureClient
 	pairM  string
 	ownM   string
-	closed bool
 	buffer []byte
 	bulk   net.Conn
 
-	sharedKey    []byte
-	readDeadline time.Time
+	// set by CloseWrite, and when the peer has called CloseWrite
+	writeClosed bool
+	readClosed  bool
+
+	// sequence numbers of the last message sent and the next one to
+	// read, plus messages that arrived ahead of their turn
+	writeSeq uint64
+	readSeq  uint64
+	early    map[uint64]*Message
+
+	// seqLock keeps pushes in sequence order, wlock guards the write
+	// buffer which may be flushed by a timer
+	seqLock    sync.Mutex
+	wlock      sync.Mutex
+	wbuf       []byte
+	flushTimer *time.Timer
+	flushErr   error
+
+	// kaLock guards keepalive, which SetKeepalive may change while
+	// another goroutine reads, and pending, messages the last keepalive
+	// received that Read hasn't taken yet
+	kaLock    sync.Mutex
+	keepalive *pipeKeepalive
+	pending   []*Delivery
+
+	// Close may be called while another goroutine is reading or
+	// writing, as net.Conn allows
+	closeLock sync.Mutex
+	closed    bool
+
+	// called once the pipe is closed, by the PipeListener tracking it
+	onClose func()
+
+	sharedKey []byte
+
+	// Deadlines may be set while another goroutine reads or writes.
+	// readWake is closed, and replaced, each time the read deadline
+	// changes or the pipe closes, waking a Read that's waiting.
+	dlLock        sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readWake      chan struct{}
 }
 
 func (p *PipeConn) initialize() error {
@@ -58,18 +121,103 @@ func (p *PipeConn) initialize() error {
 	return nil
 }
 
+func (p *PipeConn) isClosed() bool {
+	p.closeLock.Lock()
+	defer p.closeLock.Unlock()
+
+	return p.closed
+}
+
 func (p *PipeConn) Close() error {
+	p.closeLock.Lock()
+
 	if p.closed {
+		p.closeLock.Unlock()
 		return nil
 	}
 
 	p.closed = true
+	p.closeLock.Unlock()
+
+	p.wakeRead()
+
+	p.Flush()
+
+	p.SetKeepalive(0)
+
+	if p.Linger > 0 {
+		p.linger(time.Now().Add(p.Linger))
+	}
+
+	// The close is sequenced after the data, so the peer's Read can't
+	// see it until everything written before it has been read
+	p.fc.logError("send pipe close", p.pushDeadline(&Message{Type: "pipe/close"}, time.Time{}))
+	p.fc.logError("abandon pipe mailbox "+p.ownM, p.fc.Abandon(p.ownM))
+
+	if p.onClose != nil {
+		p.onClose()
+	}
 
-	p.fc.Abandon(p.ownM)
-	p.fc.Push(p.pairM, &Message{Type: "pipe/close"})
 	return nil
 }
 
+// Wait until the peer has taken everything sent to it from the broker,
+// or deadline passes
+func (p *PipeConn) linger(deadline time.Time) {
+	for attempt := 0; ; attempt++ {
+		info, err := p.fc.QueueStats(p.pairM)
+		if err != nil {
+			debugf("not lingering on pipe %s: %s\n", p.pairM, err)
+			return
+		}
+
+		if info.Pending == 0 && info.InFlight == 0 {
+			return
+		}
+
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			debugf("pipe %s closed with %d messages unread\n", p.pairM, info.Pending+info.InFlight)
+			return
+		}
+
+		wait := expBackoff(attempt, 5*time.Millisecond, 100*time.Millisecond)
+		if wait > left {
+			wait = left
+		}
+
+		time.Sleep(wait)
+	}
+}
+
+// Implemented by connections that support half-close, like
+// *net.TCPConn and *PipeConn.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// Shut down the writing side of the pipe. The peer's Read returns
+// io.EOF once it has read everything written before, while this side
+// can keep reading until the peer closes.
+func (p *PipeConn) CloseWrite() error {
+	if p.isClosed() {
+		return io.EOF
+	}
+
+	if p.writeClosed {
+		return nil
+	}
+
+	err := p.Flush()
+	if err != nil {
+		return err
+	}
+
+	p.writeClosed = true
+
+	return p.pushDeadline(&Message{Type: "pipe/shutdown-write"}, time.Time{})
+}
+
 func (p *PipeConn) LocalAddr() net.Addr {
 	return &pipeAddr{p.ownM}
 }
@@ -78,10 +226,30 @@ func (p *PipeConn) RemoteAddr() net.Addr {
 	return &pipeAddr{p.pairM}
 }
 
-var ETimeout = errors.New("operation timeout")
+type timeoutError struct{}
+
+func (t *timeoutError) Error() string   { return "operation timeout" }
+func (t *timeoutError) Timeout() bool   { return true }
+func (t *timeoutError) Temporary() bool { return true }
+
+// Returned when a deadline passes. Implements net.Error so callers
+// that check for Timeout() treat it like any other network timeout.
+var ETimeout net.Error = &timeoutError{}
 
+// Read data sent by the peer, waiting for the first message if nothing
+// is buffered. Any further messages already waiting are packed into b
+// as well, without waiting, until it's full, so a large b takes many
+// small messages in one call. If the peer closed after them, that's
+// returned as io.EOF by the next Read, after the data.
 func (p *PipeConn) Read(b []byte) (int, error) {
-	if p.closed {
+	n, err := p.read(b)
+	p.observeRead(n)
+
+	return n, err
+}
+
+func (p *PipeConn) read(b []byte) (int, error) {
+	if p.isClosed() {
 		return 0, io.EOF
 	}
 
@@ -96,136 +264,523 @@ func (p *PipeConn) Read(b []byte) (int, error) {
 	}
 
 	total := 0
-	timeout := 1 * time.Minute
 
-	if p.buffer != nil {
-		n := len(p.buffer)
-		bn := len(b)
+	if len(p.buffer) > 0 {
+		total = copy(b, p.buffer)
 
-		if bn < n {
-			copy(b, p.buffer[:bn])
-			p.buffer = p.buffer[bn:]
-			return bn, nil
+		if total < len(p.buffer) {
+			p.buffer = p.buffer[total:]
+			return total, nil
 		}
 
-		copy(b, p.buffer)
 		p.buffer = nil
+	}
 
-		if bn == n {
-			return n, nil
+	if p.readClosed {
+		if total > 0 {
+			return total, nil
+		}
+
+		return 0, io.EOF
+	}
+
+	for total < len(b) {
+		// Only block if we have nothing to return yet, otherwise just
+		// pick up whatever is already waiting.
+		body, err := p.nextChunk(total == 0)
+		if err == io.EOF && total > 0 {
+			return total, nil
+		}
+
+		if err != nil {
+			return total, err
+		}
+
+		if p.bulk != nil {
+			n, err := p.bulk.Read(b[total:])
+			return total + n, err
+		}
+
+		if body == nil {
+			if total == 0 {
+				continue
+			}
+
+			break
+		}
+
+		n := copy(b[total:], body)
+		if n < len(body) {
+			p.buffer = body[n:]
 		}
 
 		total += n
-		timeout = 0 * time.Second
-		b = b[n:]
 	}
 
+	return total, nil
+}
+
+// Return the body of the next data message from the peer, handling
+// control messages on the way. io.EOF is returned once the peer closes
+// or shuts down writing. A nil body is returned when block is false and
+// nothing is waiting, or when the peer starts a bulk transfer, which is
+// then read from p.bulk.
+func (p *PipeConn) nextChunk(block bool) ([]byte, error) {
+	for {
+		msg, err := p.nextInOrder(block)
+		if err != nil || msg == nil {
+			return nil, err
+		}
+
+		switch msg.Type {
+		case "pipe/close":
+			p.Close()
+			return nil, io.EOF
+		case "pipe/shutdown-write":
+			p.readClosed = true
+			return nil, io.EOF
+		case "pipe/ping":
+			// The peer has keepalive on but we don't
+			p.fc.logError("send pipe pong", p.fc.Push(p.pairM, &Message{Type: "pipe/pong"}))
+			continue
+		case "pipe/pong":
+			continue
+		case "pipe/bulkstart":
+			return nil, p.openBulk(msg)
+		}
+
+		return msg.Body, nil
+	}
+}
+
+// Write everything read from the pipe to w until the peer closes or
+// shuts down writing, handing each message's body straight to w rather
+// than copying it through a buffer. Used by io.Copy.
+func (p *PipeConn) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+
 	for {
-		var resp *Delivery
-		var err error
+		if p.isClosed() {
+			return total, nil
+		}
 
-		if timeout == 0 {
-			resp, err = p.fc.Poll(p.ownM)
+		if p.bulk != nil {
+			n, err := io.Copy(w, p.bulk)
+			p.observeRead(int(n))
+			total += n
 
-			if resp == nil {
-				if total > 0 {
-					return total, nil
-				}
+			p.bulk.Close()
+			p.bulk = nil
 
-				return 0, err
-			}
-		} else {
-			if !p.readDeadline.IsZero() {
-				dur := p.readDeadline.Sub(time.Now())
-				if dur < timeout {
-					timeout = dur
-				}
+			if err != nil {
+				return total, err
 			}
 
-			resp, err = p.fc.LongPoll(p.ownM, timeout)
+			continue
+		}
+
+		if len(p.buffer) > 0 {
+			n, err := w.Write(p.buffer)
+			p.observeRead(n)
+			total += int64(n)
+
+			p.buffer = p.buffer[n:]
+
 			if err != nil {
-				return 0, err
+				return total, err
 			}
 
-			if resp == nil {
-				if !p.readDeadline.IsZero() && time.Now().After(p.readDeadline) {
-					return 0, ETimeout
-				}
+			p.buffer = nil
+		}
 
-				continue
-			}
+		if p.readClosed {
+			return total, nil
+		}
+
+		body, err := p.nextChunk(true)
+		if err == io.EOF {
+			return total, nil
 		}
 
-		err = resp.Ack()
 		if err != nil {
-			return 0, err
+			return total, err
 		}
 
-		switch resp.Message.Type {
-		case "pipe/close":
-			p.Close()
+		p.buffer = body
+	}
+}
+
+func (p *PipeConn) observeRead(n int) {
+	if n > 0 {
+		p.fc.metrics().ObservePipe(n, false)
+	}
+}
+
+const cPipeSeqHeader = "pipe-seq"
+
+// Send msg to the peer, stamped with the next sequence number, within
+// the write deadline
+func (p *PipeConn) push(msg *Message) error {
+	p.dlLock.Lock()
+	deadline := p.writeDeadline
+	p.dlLock.Unlock()
+
+	return p.pushDeadline(msg, deadline)
+}
+
+func (p *PipeConn) pushDeadline(msg *Message, deadline time.Time) error {
+	p.seqLock.Lock()
+	defer p.seqLock.Unlock()
+
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return ETimeout
+	}
+
+	// Only used up once the push succeeds, so a failed one doesn't
+	// leave the peer waiting for it
+	seq := p.writeSeq + 1
+	msg.AddHeader(cPipeSeqHeader, seq)
+
+	err := p.fc.pushDeadline(p.pairM, msg, deadline)
+	if err != nil {
+		return err
+	}
+
+	p.writeSeq = seq
+
+	return nil
+}
+
+// Return the next message from the peer in the order it was sent.
+// Redelivered messages that were already read are dropped, and messages
+// that arrive early are held until the ones before them show up.
+// Messages without a sequence number, like the LWT the broker sends
+// when the peer disappears, are returned as soon as they arrive.
+func (p *PipeConn) nextInOrder(block bool) (*Message, error) {
+	for {
+		if msg, ok := p.early[p.readSeq+1]; ok {
+			delete(p.early, p.readSeq+1)
+			p.readSeq++
+			return msg, nil
+		}
+
+		resp, err := p.nextMessage(block)
+		if err != nil || resp == nil {
+			return nil, err
+		}
 
-			if total > 0 {
-				return total, nil
+		msg := resp.Message
+
+		seq, ok := msg.headerUint(cPipeSeqHeader)
+		if !ok {
+			return msg, nil
+		}
+
+		switch {
+		case seq <= p.readSeq:
+			debugf("dropping duplicate pipe message %d\n", seq)
+		case seq == p.readSeq+1:
+			p.readSeq++
+			return msg, nil
+		default:
+			if p.early == nil {
+				p.early = make(map[uint64]*Message)
 			}
 
-			return 0, io.EOF
-		case "pipe/bulkstart":
-			return p.readBulk(resp.Message, b)
+			p.early[seq] = msg
 		}
+	}
+}
 
-		bn := len(b)
-		n := len(resp.Message.Body)
+// Fetch and ack the next message from the peer. When block is false
+// and nothing is waiting, a nil Delivery is returned. When block is true,
+// the read deadline bounds the wait.
+func (p *PipeConn) nextMessage(block bool) (*Delivery, error) {
+	for {
+		if resp := p.takePending(); resp != nil {
+			return resp, nil
+		}
 
-		if bn < n {
-			copy(b, resp.Message.Body[:bn])
-			p.buffer = resp.Message.Body[bn:]
-			return bn + total, nil
+		ka := p.currentKeepalive()
+		if ka == nil {
+			break
 		}
 
-		copy(b, resp.Message.Body)
-		p.buffer = nil
+		resp, err := p.nextKeepalive(ka, block)
+		if err != errKeepaliveStopped {
+			return resp, err
+		}
 
-		total += n
+		if p.isClosed() {
+			return nil, io.EOF
+		}
+	}
 
-		if bn == n {
-			return total, nil
+	if !block {
+		resp, err := p.fc.Poll(p.ownM)
+		if err != nil || resp == nil {
+			return nil, err
+		}
+
+		if err := resp.Ack(); err != nil {
+			return nil, err
+		}
+
+		return resp, nil
+	}
+
+	for {
+		if p.isClosed() {
+			return nil, io.EOF
+		}
+
+		deadline, wake := p.readDeadlineWake()
+
+		timeout := p.fc.pollInterval()
+
+		if !deadline.IsZero() {
+			dur := deadline.Sub(time.Now())
+			if dur <= 0 {
+				return nil, ETimeout
+			}
+
+			if dur < timeout {
+				timeout = dur
+			}
 		}
 
-		timeout = 0 * time.Second
+		// Cut short if the deadline moves, so it's looked at again
+		resp, err := p.fc.LongPollCancelable(p.ownM, timeout, wake)
+		if err != nil {
+			return nil, err
+		}
 
-		b = b[n:]
+		if resp == nil {
+			continue
+		}
+
+		if err := resp.Ack(); err != nil {
+			return nil, err
+		}
+
+		return resp, nil
 	}
 }
 
 func (p *PipeConn) Write(b []byte) (int, error) {
-	if p.closed {
+	if p.isClosed() {
 		return 0, io.EOF
 	}
 
-	msg := Message{
-		Body: b,
+	if p.writeClosed {
+		return 0, io.ErrClosedPipe
 	}
 
-	err := p.fc.Push(p.pairM, &msg)
-	if err != nil {
+	if ka := p.currentKeepalive(); ka != nil {
+		if err := ka.failure(); err != nil {
+			return 0, err
+		}
+	}
+
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+
+	if p.flushErr != nil {
+		err := p.flushErr
+		p.flushErr = nil
 		return 0, err
 	}
 
+	if p.WriteBuffer <= 0 && len(p.wbuf) == 0 {
+		return p.writeMessages(b)
+	}
+
+	p.wbuf = append(p.wbuf, b...)
+
+	if len(p.wbuf) >= p.WriteBuffer {
+		err := p.flushLocked()
+		if err != nil {
+			return 0, err
+		}
+
+		return len(b), nil
+	}
+
+	if p.FlushDelay > 0 && p.flushTimer == nil {
+		p.flushTimer = time.AfterFunc(p.FlushDelay, p.flushLater)
+	}
+
 	return len(b), nil
 }
 
+// Send any bytes held by WriteBuffer to the peer
+func (p *PipeConn) Flush() error {
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+
+	err := p.flushLocked()
+	if err == nil {
+		err, p.flushErr = p.flushErr, nil
+	}
+
+	return err
+}
+
+func (p *PipeConn) flushLocked() error {
+	if p.flushTimer != nil {
+		p.flushTimer.Stop()
+		p.flushTimer = nil
+	}
+
+	if len(p.wbuf) == 0 {
+		return nil
+	}
+
+	b := p.wbuf
+	p.wbuf = nil
+
+	_, err := p.writeMessages(b)
+	return err
+}
+
+// Flush from FlushDelay's timer, keeping any error for the next Write
+// or Flush to return
+func (p *PipeConn) flushLater() {
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+
+	p.flushTimer = nil
+
+	err := p.flushLocked()
+	if err != nil {
+		p.flushErr = err
+	}
+}
+
+func (p *PipeConn) maxMessageSize() int {
+	if p.MaxMessageSize <= 0 {
+		return DefaultPipeMessageSize
+	}
+
+	return p.MaxMessageSize
+}
+
+// Send everything read from src to the peer until src returns io.EOF,
+// reading up to MaxMessageSize at a time so each read goes out as a
+// single message rather than io.Copy's smaller ones. Anything held by
+// WriteBuffer is flushed at the end. Used by io.Copy.
+func (p *PipeConn) ReadFrom(src io.Reader) (int64, error) {
+	buf := make([]byte, p.maxMessageSize())
+
+	var total int64
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			w, werr := p.Write(buf[:n])
+			total += int64(w)
+
+			if werr != nil {
+				return total, werr
+			}
+		}
+
+		if err == io.EOF {
+			return total, p.Flush()
+		}
+
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Push b to the peer, split into messages of at most MaxMessageSize
+func (p *PipeConn) writeMessages(b []byte) (int, error) {
+	max := p.maxMessageSize()
+
+	total := 0
+
+	for total < len(b) {
+		chunk := b[total:]
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+
+		msg := Message{
+			Body: chunk,
+		}
+
+		err := p.push(&msg)
+		if err != nil {
+			return total, err
+		}
+
+		p.fc.metrics().ObservePipe(len(chunk), true)
+
+		total += len(chunk)
+	}
+
+	return total, nil
+}
+
+// Set both the read and write deadlines
 func (p *PipeConn) SetDeadline(t time.Time) error {
-	p.readDeadline = t
+	p.SetReadDeadline(t)
+	p.SetWriteDeadline(t)
 	return nil
 }
 
+// Bound how long Read will wait for data. Once t passes, Read returns
+// ETimeout unless buffered data is available. A Read already waiting
+// picks up the new deadline straight away, so a deadline in the past
+// stops it, as http.Server relies on.
 func (p *PipeConn) SetReadDeadline(t time.Time) error {
+	p.dlLock.Lock()
 	p.readDeadline = t
+	p.dlLock.Unlock()
+
+	p.wakeRead()
+
 	return nil
 }
 
+// Return the read deadline, and a channel that's closed once it changes
+func (p *PipeConn) readDeadlineWake() (time.Time, chan struct{}) {
+	p.dlLock.Lock()
+	defer p.dlLock.Unlock()
+
+	if p.readWake == nil {
+		p.readWake = make(chan struct{})
+	}
+
+	return p.readDeadline, p.readWake
+}
+
+// Wake a Read that's waiting, to look at the deadline and pipe again
+func (p *PipeConn) wakeRead() {
+	p.dlLock.Lock()
+	defer p.dlLock.Unlock()
+
+	if p.readWake != nil {
+		close(p.readWake)
+		p.readWake = nil
+	}
+}
+
+// Bound how long Write, Flush and ReadFrom wait for the broker to accept
+// what they send. Once t passes they return ETimeout, along with how
+// many bytes were sent. Bytes held by WriteBuffer aren't sent until a
+// flush, so only the flush can time out.
+//
+// As with a TCP connection, a write that timed out may still reach the
+// peer, so the pipe shouldn't be used again after one. If it does reach
+// the peer, it's read in place of whatever is written next.
 func (p *PipeConn) SetWriteDeadline(t time.Time) error {
+	p.dlLock.Lock()
+	p.writeDeadline = t
+	p.dlLock.Unlock()
+
 	return nil
 }
 
@@ -253,32 +808,43 @@ func (w *streamWrapper) Write(src []byte) (n int, err error) {
 	return
 }
 
-func (p *PipeConn) readBulk(msg *Message, data []byte) (int, error) {
+// Connect to the bulk transfer announced by msg, which is then read
+// from p.bulk
+func (p *PipeConn) openBulk(msg *Message) error {
 	socketId := msg.CorrelationId
 
 	s, err := net.Dial("tcp", socketId)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	block, err := aes.NewCipher(p.sharedKey)
 	if err != nil {
-		return 0, err
+		s.Close()
+		return err
 	}
 
 	stream := cipher.NewOFB(block, msg.Body)
-	s = &streamWrapper{s, stream}
 
-	p.bulk = s
+	p.bulk = &streamWrapper{s, stream}
 
-	return s.Read(data)
+	return nil
 }
 
 func (p *PipeConn) SendBulk(data io.Reader) (int64, error) {
-	if p.closed {
+	if p.isClosed() {
 		return 0, io.EOF
 	}
 
+	if p.writeClosed {
+		return 0, io.ErrClosedPipe
+	}
+
+	err := p.Flush()
+	if err != nil {
+		return 0, err
+	}
+
 	l, err := net.Listen("tcp", ":0")
 	if err != nil {
 		return 0, err
@@ -301,7 +867,7 @@ func (p *PipeConn) SendBulk(data io.Reader) (int64, error) {
 	stream := cipher.NewOFB(block, msg.Body)
 	data = &cipher.StreamReader{S: stream, R: data}
 
-	err = p.fc.Push(p.pairM, &msg)
+	err = p.push(&msg)
 	if err != nil {
 		return 0, err
 	}
@@ -314,23 +880,116 @@ func (p *PipeConn) SendBulk(data io.Reader) (int64, error) {
 	defer s.Close()
 
 	n, err := io.Copy(s, data)
+	if n > 0 {
+		p.fc.metrics().ObservePipe(int(n), true)
+	}
+
 	return n, err
 }
 
 func (fc *FeatureClient) ListenPipe(name string) (*PipeConn, error) {
+	return fc.ListenPipeContext(context.Background(), name)
+}
+
+// Like ListenPipe, but give up with ETimeout if no connection arrives
+// within timeout
+func (fc *FeatureClient) ListenPipeTimeout(name string, timeout time.Duration) (*PipeConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pc, err := fc.ListenPipeContext(ctx, name)
+	if err == context.DeadlineExceeded {
+		return nil, ETimeout
+	}
+
+	return pc, err
+}
+
+// Like ListenPipe, but give up once ctx is done, returning its error.
+// Other listeners and PipeListeners may share the listening mailbox, so
+// it's left declared when this gives up or the handshake fails. Only
+// the new connection's own mailbox is abandoned then.
+func (fc *FeatureClient) ListenPipeContext(ctx context.Context, name string) (*PipeConn, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
 	q := "pipe:" + name
 	err := fc.Declare(q)
 	if err != nil {
 		return nil, err
 	}
 
+	done, stop := doneChan(ctx)
+	defer stop()
+
+	resp, err := fc.waitPipeConnect(q, done)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp == nil {
+		return nil, ctx.Err()
+	}
+
+	if resp.Message.Type != "pipe/initconnect" {
+		return nil, EProtocolError
+	}
+
+	return fc.setupPipe(resp.Message)
+}
+
+// Return a channel that's closed when ctx is done, for the cancelable
+// long polls. It's nil if ctx can't be done. Call stop once the channel
+// is no longer needed.
+func doneChan(ctx context.Context) (done chan struct{}, stop func()) {
+	if ctx.Done() == nil {
+		return nil, func() {}
+	}
+
+	done = make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(done)
+		case <-stopped:
+		}
+	}()
+
+	return done, func() { close(stopped) }
+}
+
+// Wait for the next message on the listening mailbox q and ack it.
+// Connection attempts whose connector gave up waiting are skipped. If
+// done is closed before a message arrives, nil is returned.
+func (fc *FeatureClient) waitPipeConnect(q string, done chan struct{}) (*Delivery, error) {
 	for {
-		resp, err := fc.LongPoll(q, 1*time.Minute)
+		var (
+			resp *Delivery
+			err  error
+		)
+
+		if done == nil {
+			resp, err = fc.LongPoll(q, fc.pollInterval())
+		} else {
+			resp, err = fc.LongPollCancelable(q, fc.pollInterval(), done)
+		}
+
 		if err != nil {
 			return nil, err
 		}
 
 		if resp == nil {
+			if done != nil {
+				select {
+				case <-done:
+					return nil, nil
+				default:
+				}
+			}
+
 			continue
 		}
 
@@ -339,80 +998,271 @@ func (fc *FeatureClient) ListenPipe(name string) (*PipeConn, error) {
 			return nil, err
 		}
 
-		if resp.Message.Type != "pipe/initconnect" {
-			return nil, EProtocolError
+		if fc.expired(resp.Message) {
+			debugf("skipping expired %s on %s", resp.Message.Type, q)
+			continue
 		}
 
-		debugf("successful pipe start from %s", resp.Message.ReplyTo)
+		return resp, nil
+	}
+}
 
-		ownM := RandomMailbox()
-		fc.EphemeralDeclare(ownM)
+// Complete the listening side of the handshake for a pipe/initconnect
+// message, returning the new connection.
+func (fc *FeatureClient) setupPipe(req *Message) (*PipeConn, error) {
+	debugf("successful pipe start from %s", req.ReplyTo)
 
-		msg := Message{
-			Type:    "pipe/setup",
-			ReplyTo: ownM,
-		}
+	ownM := RandomMailbox()
 
-		err = fc.Push(resp.Message.ReplyTo, &msg)
+	err := fc.EphemeralDeclare(ownM)
+	if err != nil {
+		return nil, err
+	}
+
+	// Echo the connection id so the connector knows the setup is
+	// for its own attempt
+	msg := Message{
+		Type:          "pipe/setup",
+		ReplyTo:       ownM,
+		CorrelationId: req.CorrelationId,
+	}
+
+	err = fc.Push(req.ReplyTo, &msg)
+	if err != nil {
+		fc.logError("abandon pipe mailbox "+ownM, fc.Abandon(ownM))
+		return nil, err
+	}
+
+	pc := &PipeConn{
+		fc:    fc,
+		pairM: req.ReplyTo,
+		ownM:  ownM,
+	}
+
+	err = pc.initialize()
+	if err != nil {
+		fc.logError("abandon pipe mailbox "+ownM, fc.Abandon(ownM))
+		return nil, err
+	}
+
+	debugf("pipe created at %s", ownM)
+
+	return pc, nil
+}
+
+// A net.Listener that accepts pipe connections made by ConnectPipe,
+// so standard servers (http.Serve, etc) can run over vega.
+type PipeListener struct {
+	fc *FeatureClient
+	q  string
+
+	lock   sync.Mutex
+	closed bool
+	done   chan struct{}
+
+	// accepted connections that are still open, for CloseAll
+	conns map[*PipeConn]struct{}
+}
+
+// Create a PipeListener accepting connections for name
+func NewPipeListener(fc *FeatureClient, name string) (*PipeListener, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	q := "pipe:" + name
+	err := fc.Declare(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PipeListener{
+		fc:    fc,
+		q:     q,
+		done:  make(chan struct{}),
+		conns: make(map[*PipeConn]struct{}),
+	}, nil
+}
+
+// Wait for and return the next connection. Each connection gets its
+// own pair of ephemeral mailboxes. Malformed or failed handshakes are
+// skipped rather than returned so one bad connector doesn't stop the
+// listener.
+func (pl *PipeListener) Accept() (net.Conn, error) {
+	for {
+		resp, err := pl.fc.waitPipeConnect(pl.q, pl.done)
 		if err != nil {
-			fc.Abandon(ownM)
 			return nil, err
 		}
 
-		pc := &PipeConn{
-			fc:    fc,
-			pairM: resp.Message.ReplyTo,
-			ownM:  ownM,
+		if resp == nil {
+			return nil, net.ErrClosed
 		}
 
-		err = pc.initialize()
+		if resp.Message.Type != "pipe/initconnect" {
+			debugf("skipping unexpected %s on %s", resp.Message.Type, pl.q)
+			continue
+		}
+
+		pc, err := pl.fc.setupPipe(resp.Message)
 		if err != nil {
-			fc.Abandon(ownM)
-			return nil, err
+			debugf("pipe handshake failed: %s", err)
+			continue
 		}
 
-		debugf("pipe created at %s", ownM)
+		pl.lock.Lock()
+
+		if pl.closed {
+			pl.lock.Unlock()
+			pc.Close()
+			return nil, net.ErrClosed
+		}
+
+		pl.conns[pc] = struct{}{}
+		pl.lock.Unlock()
+
+		pc.onClose = func() {
+			pl.lock.Lock()
+			delete(pl.conns, pc)
+			pl.lock.Unlock()
+		}
 
 		return pc, nil
 	}
 }
 
+// Stop accepting connections and abandon the listening mailbox.
+// Connections already accepted are left open, to be closed by whoever
+// is serving them, which is what http.Server.Shutdown expects. Use
+// CloseAll to drop them as well.
+func (pl *PipeListener) Close() error {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	return pl.closeLocked()
+}
+
+func (pl *PipeListener) closeLocked() error {
+	if pl.closed {
+		return nil
+	}
+
+	pl.closed = true
+	close(pl.done)
+
+	return pl.fc.Abandon(pl.q)
+}
+
+// Stop accepting connections like Close, and close every accepted
+// connection that's still open. Their peers read io.EOF once they've
+// read what was already sent.
+func (pl *PipeListener) CloseAll() error {
+	pl.lock.Lock()
+
+	err := pl.closeLocked()
+
+	conns := make([]*PipeConn, 0, len(pl.conns))
+	for pc := range pl.conns {
+		conns = append(conns, pc)
+	}
+
+	pl.lock.Unlock()
+
+	for _, pc := range conns {
+		pc.Close()
+	}
+
+	return err
+}
+
+func (pl *PipeListener) Addr() net.Addr {
+	return &pipeAddr{pl.q}
+}
+
 func (fc *FeatureClient) ConnectPipe(name string) (*PipeConn, error) {
+	return fc.ConnectPipeContext(context.Background(), name)
+}
+
+// Like ConnectPipe, but give up with ETimeout if the listener doesn't
+// answer within timeout
+func (fc *FeatureClient) ConnectPipeTimeout(name string, timeout time.Duration) (*PipeConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pc, err := fc.ConnectPipeContext(ctx, name)
+	if err == context.DeadlineExceeded {
+		return nil, ETimeout
+	}
+
+	return pc, err
+}
+
+// Like ConnectPipe, but give up once ctx is done, returning its error.
+// The pipe's mailbox is abandoned when it gives up, and the connection
+// attempt expires at ctx's deadline so a listener that comes along
+// later skips it.
+func (fc *FeatureClient) ConnectPipeContext(ctx context.Context, name string) (*PipeConn, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	ownM := RandomMailbox()
-	fc.EphemeralDeclare(ownM)
+
+	err := fc.EphemeralDeclare(ownM)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every failure from here on leaves nothing declared behind
+	fail := func(err error) (*PipeConn, error) {
+		fc.logError("abandon pipe mailbox "+ownM, fc.Abandon(ownM))
+		return nil, err
+	}
+
+	id := RandomID()
 
 	msg := Message{
-		Type:    "pipe/initconnect",
-		ReplyTo: ownM,
+		Type:          "pipe/initconnect",
+		ReplyTo:       ownM,
+		CorrelationId: id,
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Expiry = &deadline
 	}
 
 	q := "pipe:" + name
 
-	err := fc.Push(q, &msg)
+	err = fc.Push(q, &msg)
 	if err != nil {
-		fc.Abandon(ownM)
-		return nil, err
+		return fail(err)
 	}
 
 	for {
 		debugf("waiting on %s for handshake", ownM)
-		resp, err := fc.LongPoll(ownM, 1*time.Minute)
-		if err != nil {
-			return nil, err
-		}
 
-		if resp == nil {
-			continue
+		resp, err := fc.PollContext(ctx, ownM)
+		if err != nil {
+			return fail(err)
 		}
 
 		err = resp.Ack()
 		if err != nil {
-			return nil, err
+			return fail(err)
 		}
 
 		if resp.Message.Type != "pipe/setup" {
-			fc.Abandon(ownM)
-			return nil, EProtocolError
+			return fail(EProtocolError)
+		}
+
+		// Listeners that predate connection ids don't echo one back
+		if cid := resp.Message.CorrelationId; cid != "" && cid != id {
+			debugf("skipping pipe setup %s meant for another connection", cid)
+			continue
 		}
 
 		pc := &PipeConn{
@@ -423,8 +1273,7 @@ func (fc *FeatureClient) ConnectPipe(name string) (*PipeConn, error) {
 
 		err = pc.initialize()
 		if err != nil {
-			fc.Abandon(ownM)
-			return nil, err
+			return fail(err)
 		}
 
 		return pc, nil
@@ -0,0 +1,151 @@
+package vega
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Use the pipe as a stream of frames rather than bytes, for
+// applications whose data is already split into messages. Each frame
+// sent on the second channel goes to the peer as one message, however
+// large, and each message from the peer arrives on the first channel as
+// one frame, so message boundaries are kept as they are over a
+// datagram socket. A bulk transfer from the peer's SendBulk arrives as
+// a single frame. Empty frames aren't delivered.
+//
+// The receive channel is closed once the peer closes or shuts down
+// writing, or reading fails. Closing the send channel shuts down
+// writing, as CloseWrite does. The returned function closes the pipe,
+// after the frame being sent if there is one, and returns the first
+// error either direction hit. Nothing should be sent once it's called.
+//
+// The pipe's Read and Write shouldn't be used once Frames is.
+func (p *PipeConn) Frames() (<-chan []byte, chan<- []byte, func() error) {
+	recv := make(chan []byte)
+	send := make(chan []byte)
+	done := make(chan struct{})
+
+	var (
+		wg      sync.WaitGroup
+		errLock sync.Mutex
+		first   error
+	)
+
+	fail := func(err error) {
+		errLock.Lock()
+		defer errLock.Unlock()
+
+		if first == nil && !p.isClosed() {
+			first = err
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		err := p.Flush()
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		for {
+			select {
+			case frame, ok := <-send:
+				if !ok {
+					err := p.CloseWrite()
+					if err != nil && err != io.EOF {
+						fail(err)
+					}
+
+					return
+				}
+
+				err := p.push(&Message{Body: frame})
+				if err != nil {
+					fail(err)
+					return
+				}
+
+				p.fc.metrics().ObservePipe(len(frame), true)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(recv)
+
+		for {
+			frame, err := p.nextFrame()
+			if err != nil {
+				if err != io.EOF {
+					fail(err)
+				}
+
+				return
+			}
+
+			if len(frame) == 0 {
+				continue
+			}
+
+			p.observeRead(len(frame))
+
+			select {
+			case recv <- frame:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	stop := func() error {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+			p.Close()
+		})
+
+		errLock.Lock()
+		defer errLock.Unlock()
+
+		return first
+	}
+
+	return recv, send, stop
+}
+
+// Return the next message from the peer as a frame, starting with
+// whatever an earlier Read left
+func (p *PipeConn) nextFrame() ([]byte, error) {
+	if len(p.buffer) > 0 {
+		frame := p.buffer
+		p.buffer = nil
+		return frame, nil
+	}
+
+	if p.isClosed() || p.readClosed {
+		return nil, io.EOF
+	}
+
+	body, err := p.nextChunk(true)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.bulk != nil {
+		frame, err := ioutil.ReadAll(p.bulk)
+		p.bulk.Close()
+		p.bulk = nil
+
+		return frame, err
+	}
+
+	return body, nil
+}
@@ -0,0 +1,64 @@
+package vega
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// An http.RoundTripper that sends requests over pipes to a PipeListener,
+// so an http.Client can talk to a service served over vega without
+// either side listening on TCP. Connections are kept open between
+// requests and reused like http.Transport does, and a request's context
+// bounds both connecting and the exchange itself.
+type PipeTransport struct {
+	fc        *FeatureClient
+	name      string
+	transport *http.Transport
+}
+
+// Create a PipeTransport connecting with fc to the PipeListener for
+// name. If name is empty, the host of each request's URL is used
+// instead, so http://billing/invoices goes to the listener for
+// "billing".
+func NewPipeTransport(fc *FeatureClient, name string) *PipeTransport {
+	pt := &PipeTransport{
+		fc:   fc,
+		name: name,
+	}
+
+	pt.transport = &http.Transport{
+		DialContext: pt.dial,
+	}
+
+	return pt
+}
+
+func (pt *PipeTransport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	name := pt.name
+
+	if name == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+
+		name = host
+	}
+
+	pc, err := pt.fc.ConnectPipeContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+func (pt *PipeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return pt.transport.RoundTrip(req)
+}
+
+// Close the connections kept open for reuse that aren't in use
+func (pt *PipeTransport) CloseIdleConnections() {
+	pt.transport.CloseIdleConnections()
+}
@@ -0,0 +1,280 @@
+package vega
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned by Read and Write once a pipe with keepalive enabled stops
+// hearing from its peer.
+var EPipeDead = errors.New("pipe peer stopped responding")
+
+type pipeKeepalive struct {
+	interval time.Duration
+
+	lock      sync.Mutex
+	queue     []*Delivery
+	err       error
+	lastHeard time.Time
+	lastPing  time.Time
+
+	// set once the keepalive is turned off, after which the queue
+	// belongs to the pipe
+	stopped bool
+
+	notify chan struct{}
+	stop   chan struct{}
+}
+
+// Send a "pipe/ping" to the peer every interval, expecting a "pipe/pong"
+// back. If nothing is heard from the peer within interval of a ping,
+// Read and Write return EPipeDead. Keepalive is off by default, and a
+// zero interval turns it back off.
+//
+// While keepalive is on, a goroutine receives from the pipe on behalf
+// of Read so pings are answered even when the application isn't
+// reading.
+func (p *PipeConn) SetKeepalive(interval time.Duration) {
+	p.kaLock.Lock()
+	defer p.kaLock.Unlock()
+
+	if ka := p.keepalive; ka != nil {
+		// Anything already received for Read is kept for it
+		ka.lock.Lock()
+		ka.stopped = true
+		p.pending = append(p.pending, ka.queue...)
+		ka.queue = nil
+		ka.lock.Unlock()
+
+		close(ka.stop)
+		p.keepalive = nil
+	}
+
+	if interval <= 0 {
+		return
+	}
+
+	ka := &pipeKeepalive{
+		interval:  interval,
+		lastHeard: p.fc.Clock().Now(),
+		notify:    make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+
+	p.keepalive = ka
+
+	go p.pumpKeepalive(ka)
+	go p.pingKeepalive(ka)
+}
+
+// Returned by nextKeepalive once ka is turned off, so the caller looks
+// again at how the pipe is being read
+var errKeepaliveStopped = errors.New("keepalive stopped")
+
+func (p *PipeConn) currentKeepalive() *pipeKeepalive {
+	p.kaLock.Lock()
+	defer p.kaLock.Unlock()
+
+	return p.keepalive
+}
+
+// Take the oldest message left over from a keepalive that was turned
+// off, if there is one
+func (p *PipeConn) takePending() *Delivery {
+	p.kaLock.Lock()
+	defer p.kaLock.Unlock()
+
+	if len(p.pending) == 0 {
+		return nil
+	}
+
+	resp := p.pending[0]
+	p.pending = p.pending[1:]
+
+	return resp
+}
+
+func (ka *pipeKeepalive) fail(err error) {
+	ka.lock.Lock()
+	defer ka.lock.Unlock()
+
+	if ka.err == nil {
+		ka.err = err
+	}
+
+	select {
+	case ka.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (ka *pipeKeepalive) failure() error {
+	ka.lock.Lock()
+	defer ka.lock.Unlock()
+
+	return ka.err
+}
+
+// Receive everything the peer sends, answering pings and queueing the
+// rest for Read
+func (p *PipeConn) pumpKeepalive(ka *pipeKeepalive) {
+	for {
+		resp, err := p.fc.LongPollCancelable(p.ownM, ka.interval, ka.stop)
+
+		select {
+		case <-ka.stop:
+			if resp != nil {
+				resp.Nack()
+			}
+
+			return
+		default:
+		}
+
+		if err != nil {
+			ka.fail(err)
+			return
+		}
+
+		if resp == nil {
+			continue
+		}
+
+		err = resp.Ack()
+		if err != nil {
+			ka.fail(err)
+			return
+		}
+
+		ka.lock.Lock()
+		ka.lastHeard = p.fc.Clock().Now()
+		ka.lock.Unlock()
+
+		switch resp.Message.Type {
+		case "pipe/ping":
+			p.fc.logError("send pipe pong", p.fc.Push(p.pairM, &Message{Type: "pipe/pong"}))
+			continue
+		case "pipe/pong":
+			continue
+		}
+
+		ka.lock.Lock()
+
+		if ka.stopped {
+			// Already acked, so it's handed to the pipe instead
+			ka.lock.Unlock()
+
+			p.kaLock.Lock()
+			p.pending = append(p.pending, resp)
+			p.kaLock.Unlock()
+
+			return
+		}
+
+		ka.queue = append(ka.queue, resp)
+		ka.lock.Unlock()
+
+		select {
+		case ka.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Ping the peer every interval, failing the pipe if the previous ping
+// went unanswered
+func (p *PipeConn) pingKeepalive(ka *pipeKeepalive) {
+	for {
+		tick, stop := p.fc.timer(ka.interval)
+
+		select {
+		case <-ka.stop:
+			stop()
+			return
+		case <-tick:
+		}
+
+		ka.lock.Lock()
+		dead := !ka.lastPing.IsZero() && ka.lastHeard.Before(ka.lastPing)
+		ka.lock.Unlock()
+
+		if dead {
+			ka.fail(EPipeDead)
+			return
+		}
+
+		// Taken before sending, since the pong can beat Push returning
+		sent := p.fc.Clock().Now()
+
+		err := p.fc.Push(p.pairM, &Message{Type: "pipe/ping"})
+		if err != nil {
+			ka.fail(err)
+			return
+		}
+
+		ka.lock.Lock()
+		ka.lastPing = sent
+		ka.lock.Unlock()
+	}
+}
+
+// Like nextMessage, but taking messages from the keepalive queue
+func (p *PipeConn) nextKeepalive(ka *pipeKeepalive, block bool) (*Delivery, error) {
+	for {
+		ka.lock.Lock()
+
+		if len(ka.queue) > 0 {
+			resp := ka.queue[0]
+			ka.queue = ka.queue[1:]
+			ka.lock.Unlock()
+
+			return resp, nil
+		}
+
+		err := ka.err
+		stopped := ka.stopped
+
+		ka.lock.Unlock()
+
+		if stopped {
+			return nil, errKeepaliveStopped
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !block {
+			return nil, nil
+		}
+
+		deadline, wake := p.readDeadlineWake()
+
+		if deadline.IsZero() {
+			select {
+			case <-ka.notify:
+			case <-ka.stop:
+			case <-wake:
+			}
+
+			continue
+		}
+
+		dur := deadline.Sub(time.Now())
+		if dur <= 0 {
+			return nil, ETimeout
+		}
+
+		timer := time.NewTimer(dur)
+
+		select {
+		case <-ka.notify:
+		case <-ka.stop:
+		case <-wake:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+	}
+}
@@ -0,0 +1,136 @@
+package vega
+
+import (
+	"context"
+	"time"
+)
+
+// How long PriorityReceiver waits on its highest priority queue when
+// they're all empty, if IdleInterval isn't set
+const DefaultPriorityIdle = 100 * time.Millisecond
+
+// Options for PriorityReceiver
+type PriorityOpts struct {
+	// After this many deliveries in a row, the next one is looked for
+	// starting at a lower priority queue, each of the lower queues
+	// taking that turn in order, so a busy queue can't starve the ones
+	// below it. 0 means strict priority, where a queue only gets
+	// messages while every queue above it is empty.
+	Fairness int
+
+	// How long to wait for a message on the highest priority queue once
+	// they're all empty, before checking them all again. It bounds how
+	// long a message arriving on a lower queue waits to be picked up.
+	IdleInterval time.Duration
+}
+
+// Receive messages from several queues, given highest priority first,
+// on the returned Receiver's Channel. Each delivery is taken from the
+// highest priority queue that has one, subject to opts.Fairness. The
+// consumer must Ack (or Nack) each delivery itself.
+func (fc *FeatureClient) PriorityReceiver(names []string, opts PriorityOpts) *Receiver {
+	c := make(chan *Delivery)
+
+	rec := newReceiver(c)
+	rec.putBack = func(del *Delivery) {
+		fc.logError("nack untaken delivery", del.Nack())
+	}
+
+	idle := opts.IdleInterval
+	if idle <= 0 {
+		idle = DefaultPriorityIdle
+	}
+
+	// Cancels the poll in progress when the receiver is closed
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-rec.shutdown:
+		case <-rec.finished:
+		}
+
+		cancel()
+	}()
+
+	go func() {
+		defer close(rec.finished)
+		defer close(c)
+
+		if len(names) == 0 {
+			return
+		}
+
+		// deliveries since the last fairness turn, and the queue that
+		// takes the next one
+		streak, turn := 0, 0
+
+		for {
+			select {
+			case <-rec.shutdown:
+				return
+			default:
+			}
+
+			start := 0
+
+			if opts.Fairness > 0 && len(names) > 1 && streak >= opts.Fairness {
+				turn = turn%(len(names)-1) + 1
+				start = turn
+				streak = 0
+			}
+
+			var (
+				del  *Delivery
+				name string
+				err  error
+			)
+
+			// From start down, then wrapping round to the queues above it
+			for i := range names {
+				name = names[(start+i)%len(names)]
+
+				del, err = fc.Poll(name)
+				if err != nil || del != nil {
+					break
+				}
+			}
+
+			if err == nil && del == nil {
+				name = names[0]
+				del, err = fc.longPollContext(ctx, name, idle)
+			}
+
+			if err != nil {
+				if ctx.Err() == nil {
+					rec.Error = err
+				}
+
+				return
+			}
+
+			if del == nil {
+				continue
+			}
+
+			if fc.holdUntilDue(name, del) {
+				continue
+			}
+
+			if start == 0 {
+				streak++
+			}
+
+			select {
+			case c <- del:
+			case <-rec.shutdown:
+				fc.putBack(name, del, false)
+				return
+			}
+
+			fc.metrics().ObserveReceive(name)
+		}
+	}()
+
+	return rec
+}
@@ -0,0 +1,70 @@
+package vega
+
+// Subscribe to messages published to topics matching pattern (see
+// TopicMatcher). Topics are split into segments on "." or "/", where
+// "*" or "+" matches any one segment and a trailing "#" matches any
+// remaining segments.
+//
+// Each subscriber gets messages in its own ephemeral mailbox, so the
+// subscription lasts until the client disconnects. Mailboxes that go
+// away are pruned from the topic automatically.
+func (fc *FeatureClient) Subscribe(pattern string) (*Receiver, error) {
+	name := RandomMailboxPrefixed("sub.") + cEphemeral
+
+	err := fc.EphemeralDeclare(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fc.Push(":subscribe", &Message{ReplyTo: name, CorrelationId: pattern})
+	if err != nil {
+		fc.Abandon(name)
+		return nil, err
+	}
+
+	return fc.Receive(name), nil
+}
+
+// Deliver a copy of msg to every subscriber of topic. The topic travels
+// in the message's CorrelationId, so any CorrelationId msg has is
+// replaced.
+func (fc *FeatureClient) Publish(topic string, msg *Message) error {
+	cp := *msg
+	cp.CorrelationId = topic
+
+	return fc.Push(":publish", &cp)
+}
+
+// Publish msg to topic like Publish, returning how many subscribers
+// it was delivered to. Subscribers whose mailbox is gone are pruned and
+// not counted.
+//
+// The count is a snapshot: a subscriber can go away right after being
+// counted, before it reads the message, and one that subscribes just
+// after isn't counted or sent the message.
+func (fc *FeatureClient) PublishCount(topic string, msg *Message) (count int, err error) {
+	cp := *msg
+	cp.CorrelationId = topic
+
+	out, err := fc.outgoing(&cp)
+	if err != nil {
+		return 0, err
+	}
+
+	err = fc.withReconnect(func() error {
+		count, err = fc.Client.PublishCount(out)
+		return err
+	})
+
+	return
+}
+
+// Encode v with the client's codec and publish it to topic
+func (fc *FeatureClient) PublishTyped(topic string, v interface{}) error {
+	msg, err := EncodeMsg(fc.Codec(), v)
+	if err != nil {
+		return err
+	}
+
+	return fc.Publish(topic, msg)
+}
@@ -0,0 +1,85 @@
+package vega
+
+// Take everything currently in the mailbox name, up to max messages,
+// without waiting for more to arrive. Each delivery is acked as it's
+// taken. A max of 0 or less takes all of them.
+func (fc *FeatureClient) DrainQueue(name string, max int) ([]*Delivery, error) {
+	var dels []*Delivery
+
+	for max <= 0 || len(dels) < max {
+		del, err := fc.Poll(name)
+		if err != nil {
+			return dels, err
+		}
+
+		if del == nil {
+			break
+		}
+
+		err = del.Ack()
+		if err != nil {
+			return dels, err
+		}
+
+		dels = append(dels, del)
+	}
+
+	return dels, nil
+}
+
+// Return the message at the head of the mailbox name without consuming
+// it, or nil if it's empty. The message is taken and immediately
+// nacked, which puts it back at the front of the mailbox, so it's
+// briefly invisible to other consumers but its position is kept.
+func (fc *FeatureClient) Peek(name string) (*Message, error) {
+	del, err := fc.Poll(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if del == nil {
+		return nil, nil
+	}
+
+	err = del.Nack()
+	if err != nil {
+		return nil, err
+	}
+
+	return del.Message, nil
+}
+
+// A snapshot of a queue's backlog, from QueueStats
+type QueueInfo struct {
+	// Messages waiting to be delivered
+	Pending int
+
+	// Messages delivered but not yet acked or nacked
+	InFlight int
+
+	// Consumers currently long polling the queue for a message. Busy
+	// consumers that aren't waiting aren't counted.
+	Consumers int
+}
+
+// Return how many messages are waiting in the mailbox name, and how
+// many consumers are waiting for them. ENotSupported is returned if the
+// broker can't report it.
+func (fc *FeatureClient) QueueStats(name string) (info QueueInfo, err error) {
+	err = fc.withReconnect(func() error {
+		stats, err := fc.Client.QueueStats(name)
+		if err != nil {
+			return err
+		}
+
+		info = QueueInfo{
+			Pending:   stats.Size,
+			InFlight:  stats.InFlight,
+			Consumers: stats.Watchers,
+		}
+
+		return nil
+	})
+
+	return
+}
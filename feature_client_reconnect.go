@@ -0,0 +1,321 @@
+package vega
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Controls how a FeatureClient created with WithReconnect recovers
+// from losing its connection to the broker.
+type ReconnectPolicy struct {
+	// Give up after this many failed attempts. 0 means never give up.
+	MaxAttempts int
+
+	// Delay before the first attempt, doubling on each failure up to
+	// MaxBackoff. Default to 100ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Re-dial the broker with policy whenever the connection is lost.
+//
+// Declare, EphemeralDeclare, Push, PushBatch, Poll, LongPoll and
+// LongPollCancelable are retried once the connection is restored,
+// along with everything built on them (Request, HandleRequests,
+// Receive, pipes). Ephemeral mailboxes and LWTs are re-declared on the
+// new connection first. LongPollCancelable gives up reconnecting once
+// its done channel is closed, so closing a Receiver or cancelling a
+// context doesn't wait for the connection to come back.
+//
+// Ack and Nack are not retried and return the connection error, since
+// the broker returns unacked messages of a lost connection to their
+// mailbox to be delivered again.
+func WithReconnect(policy ReconnectPolicy) DialOption {
+	return func(dc *dialConfig) {
+		dc.reconnect = &policy
+	}
+}
+
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	return policyBackoff(attempt, p.MinBackoff, p.MaxBackoff,
+		100*time.Millisecond, 10*time.Second)
+}
+
+// The backoff for a policy's MinBackoff and MaxBackoff, using defMin
+// and defMax for whichever is left at 0
+func policyBackoff(attempt int, min, max, defMin, defMax time.Duration) time.Duration {
+	if min == 0 {
+		min = defMin
+	}
+
+	if max == 0 {
+		max = defMax
+	}
+
+	return expBackoff(attempt, min, max)
+}
+
+// Double min for each attempt, capped at max
+func expBackoff(attempt int, min, max time.Duration) time.Duration {
+	d := min
+
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	return d
+}
+
+// Wraps an error talking to the broker that may go away if the
+// operation is tried again, such as the connection being lost.
+type TemporaryError struct {
+	Err error
+}
+
+func (t *TemporaryError) Error() string {
+	return t.Err.Error()
+}
+
+func (t *TemporaryError) Temporary() bool {
+	return true
+}
+
+func (t *TemporaryError) Unwrap() error {
+	return t.Err
+}
+
+// Report whether err is worth retrying. That's true of a
+// *TemporaryError, which the FeatureClient methods return when the
+// connection fails, and of network timeouts like ETimeout. Protocol
+// errors, errors replied by handlers and bodies that can't be decoded
+// are permanent.
+func IsTemporary(err error) bool {
+	if t, ok := err.(interface {
+		Temporary() bool
+	}); ok {
+		return t.Temporary()
+	}
+
+	return false
+}
+
+// Wrap err in a *TemporaryError if it's a connection error
+func temporary(err error) error {
+	if _, ok := err.(*TemporaryError); ok || !isConnectionError(err) {
+		return err
+	}
+
+	return &TemporaryError{err}
+}
+
+// Indicates the connection to the broker is gone and redialing may help.
+// A timeout, such as ETimeout, is temporary but doesn't mean the
+// connection is gone.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if _, ok := err.(*TemporaryError); ok {
+		return true
+	}
+
+	if ne, ok := err.(net.Error); ok {
+		return !ne.Timeout()
+	}
+
+	switch err {
+	case io.ErrUnexpectedEOF, yamux.ErrStreamClosed, yamux.ErrConnectionReset,
+		yamux.ErrSessionShutdown:
+		return true
+	}
+
+	return eofish(err)
+}
+
+// Run op, re-dialing and running it again if it fails because the
+// connection was lost and fc is configured to reconnect. Connection
+// errors are returned as a *TemporaryError.
+func (fc *FeatureClient) withReconnect(op func() error) error {
+	return fc.withReconnectDone(nil, op)
+}
+
+// Like withReconnect, but stop trying once done is closed and return
+// nil, as a cancelled op does
+func (fc *FeatureClient) withReconnectDone(done chan struct{}, op func() error) error {
+	gen := fc.Client.currentGeneration()
+
+	err := op()
+
+	if fc.reconnect == nil {
+		fc.noteOutcome(err, Disconnected)
+		return temporary(err)
+	}
+
+	for attempt := 0; isConnectionError(err); attempt++ {
+		if fc.reconnect.MaxAttempts > 0 && attempt >= fc.reconnect.MaxAttempts {
+			fc.setState(Disconnected)
+			return temporary(err)
+		}
+
+		fc.setState(Reconnecting)
+
+		debugf("connection lost (%s), reconnecting\n", err)
+
+		select {
+		case <-fc.Clock().After(fc.reconnect.backoff(attempt)):
+		case <-done:
+			fc.setState(Disconnected)
+			return nil
+		}
+
+		err = fc.Client.redial(gen)
+		if err != nil {
+			continue
+		}
+
+		gen = fc.Client.currentGeneration()
+
+		err = op()
+	}
+
+	fc.noteOutcome(err, Disconnected)
+
+	return err
+}
+
+func (fc *FeatureClient) EphemeralDeclare(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	return fc.withReconnect(func() error {
+		return fc.Client.EphemeralDeclare(name)
+	})
+}
+
+// Abandon the mailbox name. Abandoning one that's already been
+// abandoned, or was never declared, is a no-op returning nil, so the
+// several teardown paths of a pipe or stream can each call it without
+// tracking whether another already has. Like Ack, it isn't retried if
+// the connection is lost.
+func (fc *FeatureClient) Abandon(name string) error {
+	err := fc.Client.Abandon(name)
+	if err == ENoMailbox {
+		debugf("%s was already abandoned\n", name)
+		fc.Client.untrack(name)
+		return nil
+	}
+
+	return temporary(err)
+}
+
+func (fc *FeatureClient) Push(name string, msg *Message) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	msg, err := fc.outgoing(msg)
+	if err != nil {
+		return err
+	}
+
+	return fc.withReconnect(func() error {
+		return fc.Client.Push(name, msg)
+	})
+}
+
+// Push msg like Push, giving up with ETimeout once deadline passes. A
+// timeout isn't treated as the connection being lost, so it's returned
+// rather than retried.
+func (fc *FeatureClient) pushDeadline(name string, msg *Message, deadline time.Time) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	msg, err := fc.outgoing(msg)
+	if err != nil {
+		return err
+	}
+
+	return fc.withReconnect(func() error {
+		return fc.Client.pushDeadline(name, msg, deadline)
+	})
+}
+
+func (fc *FeatureClient) PushBatch(name string, msgs []*Message) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	if fc.compressor != nil || fc.transformer != nil {
+		out := make([]*Message, len(msgs))
+
+		for i, msg := range msgs {
+			var err error
+
+			out[i], err = fc.outgoing(msg)
+			if err != nil {
+				return err
+			}
+		}
+
+		msgs = out
+	}
+
+	return fc.withReconnect(func() error {
+		return fc.Client.PushBatch(name, msgs)
+	})
+}
+
+func (fc *FeatureClient) Poll(name string) (del *Delivery, err error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	err = fc.withReconnect(func() error {
+		del, err = fc.Client.Poll(name)
+		return err
+	})
+
+	del = fc.incoming(del)
+
+	return
+}
+
+func (fc *FeatureClient) LongPoll(name string, til time.Duration) (del *Delivery, err error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	err = fc.withReconnect(func() error {
+		del, err = fc.Client.LongPoll(name, til)
+		return err
+	})
+
+	del = fc.incoming(del)
+
+	return
+}
+
+func (fc *FeatureClient) LongPollCancelable(name string, til time.Duration, done chan struct{}) (del *Delivery, err error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	err = fc.withReconnectDone(done, func() error {
+		del, err = fc.Client.LongPollCancelable(name, til, done)
+		return err
+	})
+
+	del = fc.incoming(del)
+
+	return
+}
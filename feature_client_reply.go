@@ -0,0 +1,229 @@
+package vega
+
+import (
+	"context"
+	"time"
+)
+
+type pendingReply struct {
+	del *Delivery
+	err error
+}
+
+// Return the reply, turning error replies into the error they report
+func (pr *pendingReply) result() (*Delivery, error) {
+	if pr.err != nil {
+		return nil, pr.err
+	}
+
+	if pr.del.Message.Type == cErrorType {
+		pr.del.Ack()
+		return nil, DecodeErrorReply(pr.del.Message)
+	}
+
+	return pr.del, nil
+}
+
+// Point msg's ReplyTo at the local mailbox and register interest in the
+// reply with msg's CorrelationId. The returned channel receives exactly
+// one value unless the reply is canceled first.
+func (fc *FeatureClient) expectReply(msg *Message) (chan *pendingReply, error) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	name, err := fc.localMailboxLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	msg.ReplyTo = name
+
+	if fc.replies == nil {
+		fc.replies = make(map[string]chan *pendingReply)
+	}
+
+	c := make(chan *pendingReply, 1)
+
+	fc.replies[msg.CorrelationId] = c
+
+	if fc.dispatching != name {
+		fc.dispatching = name
+		go fc.dispatchReplies(name)
+	}
+
+	return c, nil
+}
+
+// Stop waiting for the reply with the given id. If nothing else is
+// waiting on the local mailbox, it's abandoned so stale replies don't
+// pile up in it.
+func (fc *FeatureClient) cancelReply(id string, c chan *pendingReply) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	delete(fc.replies, id)
+
+	select {
+	case pr := <-c:
+		if pr.del != nil {
+			pr.del.Ack()
+		}
+	default:
+	}
+
+	if len(fc.replies) == 0 && fc.localMailbox != "" {
+		fc.logError("abandon reply mailbox", fc.Abandon(fc.localMailbox))
+		fc.localMailbox = ""
+	}
+}
+
+// Poll the reply mailbox, handing each reply to the request waiting on
+// its CorrelationId. Replies nobody is waiting on are acked and dropped,
+// which includes redelivered duplicates of a reply already handed over,
+// so they never reach a later request using the same mailbox. Runs
+// until no requests are waiting or the mailbox is replaced.
+func (fc *FeatureClient) dispatchReplies(name string) {
+	for {
+		del, err := fc.LongPoll(name, fc.pollInterval())
+
+		fc.lock.Lock()
+
+		if fc.dispatching != name {
+			fc.lock.Unlock()
+
+			if del != nil {
+				del.Ack()
+			}
+
+			return
+		}
+
+		if err != nil {
+			for id, c := range fc.replies {
+				c <- &pendingReply{err: err}
+				delete(fc.replies, id)
+			}
+
+			fc.dispatching = ""
+			fc.lock.Unlock()
+			return
+		}
+
+		var stray *Delivery
+
+		if del != nil {
+			if c, ok := fc.replies[del.Message.CorrelationId]; ok {
+				delete(fc.replies, del.Message.CorrelationId)
+				c <- &pendingReply{del: del}
+			} else {
+				stray = del
+			}
+		}
+
+		idle := len(fc.replies) == 0
+		if idle {
+			fc.dispatching = ""
+		}
+
+		fc.lock.Unlock()
+
+		if stray != nil {
+			debugf("dropping reply %s nobody is waiting on\n", stray.Message.CorrelationId)
+			stray.Ack()
+		}
+
+		if idle {
+			return
+		}
+	}
+}
+
+// Options for RequestWithOpts
+type RequestOpts struct {
+	// Have the reply sent to a mailbox declared for this request alone
+	// and abandoned when it returns, instead of the client's local
+	// mailbox shared by all its requests. It costs a declare and an
+	// abandon per request, but a stale reply can never be left behind
+	// for a later request to wade through.
+	FreshReplyMailbox bool
+}
+
+// Perform RequestContext using opts
+func (fc *FeatureClient) RequestWithOpts(ctx context.Context, name string, msg *Message, opts RequestOpts) (*Delivery, error) {
+	if !opts.FreshReplyMailbox {
+		return fc.RequestContext(ctx, name, msg)
+	}
+
+	start := time.Now()
+
+	del, err := fc.requestFresh(ctx, name, msg)
+
+	fc.metrics().ObserveRequest(name, time.Since(start), err)
+
+	return del, err
+}
+
+// Perform a request with its own reply mailbox
+func (fc *FeatureClient) requestFresh(ctx context.Context, name string, msg *Message) (*Delivery, error) {
+	err := fc.prepareRequest(ctx, name, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	mailbox := RandomMailbox()
+
+	err = fc.EphemeralDeclare(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		fc.logError("abandon reply mailbox "+mailbox, fc.Abandon(mailbox))
+	}()
+
+	msg.ReplyTo = mailbox
+
+	err = fc.Push(name, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Expiry != nil {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		expired, stop := fc.timer(msg.Expiry.Sub(fc.Clock().Now()))
+		defer stop()
+
+		go func() {
+			select {
+			case <-expired:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	for {
+		del, err := fc.PollContext(ctx, mailbox)
+		if err != nil {
+			if ctx.Err() != nil && fc.expired(msg) {
+				return nil, EExpired
+			}
+
+			return nil, err
+		}
+
+		if del.Message.CorrelationId != msg.CorrelationId {
+			debugf("dropping reply %s nobody is waiting on\n", del.Message.CorrelationId)
+			fc.logError("ack stray reply", del.Ack())
+			continue
+		}
+
+		pr := &pendingReply{del: del}
+
+		return pr.result()
+	}
+}
@@ -0,0 +1,62 @@
+package vega
+
+import (
+	"context"
+	"time"
+)
+
+// Controls how RequestRetry retries a request that failed because the
+// connection to the broker had trouble.
+type RetryPolicy struct {
+	// Total number of tries, including the first. Anything less than 2
+	// means the request is only tried once.
+	MaxAttempts int
+
+	// Delay before the first retry, doubling on each one up to
+	// MaxBackoff. Default to 100ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Set when the handler can safely see the same request more than
+	// once. Only then is a request retried after it was pushed, since
+	// it may already have been handled. Every attempt carries the same
+	// CorrelationId so the handler can spot repeats.
+	Idempotent bool
+}
+
+// Try 4 times, backing off from 100ms to at most 2s
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	MinBackoff:  100 * time.Millisecond,
+	MaxBackoff:  2 * time.Second,
+}
+
+// Send a request like Request, retrying according to policy when it
+// fails with a temporary error (see IsTemporary). Errors from the
+// handler, protocol errors and expiry are returned straight away.
+func (fc *FeatureClient) RequestRetry(name string, msg *Message, policy RetryPolicy) (*Delivery, error) {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+
+		del, pushed, err := fc.request(context.Background(), name, msg)
+
+		fc.metrics().ObserveRequest(name, time.Since(start), err)
+
+		if err == nil || attempt >= policy.MaxAttempts || !IsTemporary(err) {
+			return del, err
+		}
+
+		if pushed && !policy.Idempotent {
+			return nil, err
+		}
+
+		debugf("request to %s failed (%s), retrying\n", name, err)
+
+		<-fc.Clock().After(policy.backoff(attempt - 1))
+	}
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	return policyBackoff(attempt, p.MinBackoff, p.MaxBackoff,
+		100*time.Millisecond, 10*time.Second)
+}
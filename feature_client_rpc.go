@@ -0,0 +1,299 @@
+package vega
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Message types of RPC requests and responses
+const (
+	RPCRequestType  = "rpc/request"
+	RPCResponseType = "rpc/response"
+)
+
+// Headers carrying an RPC message's method and version
+const (
+	RPCMethodHeader  = "rpc-method"
+	RPCVersionHeader = "rpc-version"
+)
+
+// Codes of the *CodedError returned when the server has no handler for
+// a call
+const (
+	RPCUnknownMethod  = "rpc.unknown_method"
+	RPCUnknownVersion = "rpc.unknown_version"
+)
+
+// The version of calls that don't give one
+const DefaultRPCVersion = 1
+
+// Returned when parsing a message that isn't an RPC request or response
+var ENotRPC = errors.New("not an rpc message")
+
+// Returned by DoRPC for a method that doesn't name a mailbox
+var EBadRPCMethod = errors.New("rpc method must be of the form mailbox.Method")
+
+// A call to Method at Version, with Payload as its argument. On the wire
+// it's a message of RPCRequestType with the method and version in
+// headers and Payload as the Body, so clients in other languages can
+// make calls without a codec of their own for the envelope.
+type RPCRequest struct {
+	Method  string
+	Version int
+	Payload []byte
+}
+
+// The result of a call, carrying its Method and Version back. Failed
+// calls are answered with an error reply instead, see ErrorMsg.
+type RPCResponse struct {
+	Method  string
+	Version int
+	Payload []byte
+}
+
+// Create the message carrying r
+func (r *RPCRequest) Msg() *Message {
+	return rpcMsg(RPCRequestType, r.Method, r.Version, r.Payload)
+}
+
+// Create the message carrying r
+func (r *RPCResponse) Msg() *Message {
+	return rpcMsg(RPCResponseType, r.Method, r.Version, r.Payload)
+}
+
+func rpcMsg(typ, method string, version int, payload []byte) *Message {
+	if version <= 0 {
+		version = DefaultRPCVersion
+	}
+
+	msg := &Message{Type: typ, Body: payload}
+
+	msg.AddHeader(RPCMethodHeader, method)
+	msg.AddHeader(RPCVersionHeader, version)
+
+	return msg
+}
+
+// Read the RPCRequest carried by msg, returning ENotRPC if it isn't one
+func ParseRPCRequest(msg *Message) (*RPCRequest, error) {
+	method, version, err := parseRPC(msg, RPCRequestType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RPCRequest{method, version, msg.Body}, nil
+}
+
+// Read the RPCResponse carried by msg, returning ENotRPC if it isn't one
+func ParseRPCResponse(msg *Message) (*RPCResponse, error) {
+	method, version, err := parseRPC(msg, RPCResponseType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RPCResponse{method, version, msg.Body}, nil
+}
+
+func parseRPC(msg *Message, typ string) (string, int, error) {
+	if msg.Type != typ {
+		return "", 0, ENotRPC
+	}
+
+	method, ok := msg.HeaderString(RPCMethodHeader)
+	if !ok || method == "" {
+		return "", 0, ENotRPC
+	}
+
+	version := DefaultRPCVersion
+
+	if v, ok := msg.headerUint(RPCVersionHeader); ok && v > 0 {
+		version = int(v)
+	}
+
+	return method, version, nil
+}
+
+// Call method, of the form "mailbox.Method", at DefaultRPCVersion. req is
+// encoded with the client's codec and the response payload is decoded
+// into resp, unless it's nil. The call goes to the mailbox before the
+// last dot, where an RPCServer should be handling requests.
+//
+// Errors from the handler are returned as with Request, and the server
+// answers calls it has no handler for with a *CodedError whose code is
+// RPCUnknownMethod or RPCUnknownVersion. A response that can't be
+// decoded is a *DecodeError.
+func (fc *FeatureClient) DoRPC(method string, req, resp interface{}) error {
+	return fc.DoRPCVersion(method, DefaultRPCVersion, req, resp)
+}
+
+// Like DoRPC, calling the given version of method
+func (fc *FeatureClient) DoRPCVersion(method string, version int, req, resp interface{}) error {
+	dot := strings.LastIndex(method, ".")
+	if dot <= 0 || dot == len(method)-1 {
+		return EBadRPCMethod
+	}
+
+	c := fc.Codec()
+
+	payload, err := c.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	rr := &RPCRequest{
+		Method:  method,
+		Version: version,
+		Payload: payload,
+	}
+
+	msg := rr.Msg()
+	msg.ContentType = c.ContentType()
+
+	ret, err := fc.RequestAck(method[:dot], msg)
+	if err != nil {
+		return err
+	}
+
+	res, err := ParseRPCResponse(ret)
+	if err != nil {
+		return err
+	}
+
+	if resp == nil {
+		return nil
+	}
+
+	err = codecFor(ret.ContentType).Unmarshal(res.Payload, resp)
+	if err != nil {
+		return &DecodeError{err}
+	}
+
+	return nil
+}
+
+// Dispatches RPC requests to the Handler registered for their method
+// and version, so several versions of a method can be served side by
+// side while callers move from one to the next. An RPCServer is a
+// Handler, so serve it on the methods' mailbox with HandleRequests.
+//
+// Handlers are passed the request message, whose Body is the payload,
+// and reply with the response payload as the Body, so JSONHandler and
+// TypedHandler can be used for them. The reply is sent as an
+// RPCResponse, unless it's an error reply (or a RejectMsg), which is
+// passed on as it is.
+type RPCServer struct {
+	lock     sync.RWMutex
+	handlers map[string]map[int]Handler
+}
+
+func NewRPCServer() *RPCServer {
+	return &RPCServer{handlers: make(map[string]map[int]Handler)}
+}
+
+// Register h to handle calls to version of method, which is given in
+// full, such as "users.Get"
+func (rs *RPCServer) Handle(method string, version int, h Handler) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	if rs.handlers == nil {
+		rs.handlers = make(map[string]map[int]Handler)
+	}
+
+	if version <= 0 {
+		version = DefaultRPCVersion
+	}
+
+	versions, ok := rs.handlers[method]
+	if !ok {
+		versions = make(map[int]Handler)
+		rs.handlers[method] = versions
+	}
+
+	versions[version] = h
+}
+
+func (rs *RPCServer) HandleMessage(m *Message) *Message {
+	return rs.HandleMessageContext(context.Background(), m)
+}
+
+// Dispatch m, passing ctx on to handlers that take a context
+func (rs *RPCServer) HandleMessageContext(ctx context.Context, m *Message) *Message {
+	req, err := ParseRPCRequest(m)
+	if err != nil {
+		return ErrorMsg(err)
+	}
+
+	h, err := rs.handler(req)
+	if err != nil {
+		return ErrorMsg(err)
+	}
+
+	ret := handleContext(ctx, h, m)
+	if ret == nil {
+		return nil
+	}
+
+	switch ret.Type {
+	case cErrorType, cRejectType, cRequeueType:
+		return ret
+	}
+
+	resp := &RPCResponse{
+		Method:  req.Method,
+		Version: req.Version,
+		Payload: ret.Body,
+	}
+
+	out := resp.Msg()
+	out.ContentType = ret.ContentType
+
+	return out
+}
+
+// Find the handler for req, or the error to answer it with
+func (rs *RPCServer) handler(req *RPCRequest) (Handler, error) {
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+
+	versions, ok := rs.handlers[req.Method]
+	if !ok {
+		return nil, &ErrorReply{
+			Code:    RPCUnknownMethod,
+			Message: "unknown rpc method " + req.Method,
+			Details: map[string]string{"method": req.Method},
+		}
+	}
+
+	h, ok := versions[req.Version]
+	if !ok {
+		var have []int
+
+		for v := range versions {
+			have = append(have, v)
+		}
+
+		sort.Ints(have)
+
+		var list []string
+
+		for _, v := range have {
+			list = append(list, strconv.Itoa(v))
+		}
+
+		return nil, &ErrorReply{
+			Code:    RPCUnknownVersion,
+			Message: "rpc method " + req.Method + " has no version " + strconv.Itoa(req.Version),
+			Details: map[string]string{
+				"method":   req.Method,
+				"versions": strings.Join(list, ","),
+			},
+		}
+	}
+
+	return h, nil
+}
@@ -0,0 +1,111 @@
+package vega
+
+import (
+	"context"
+	"time"
+)
+
+// Makes requests one after another from a single goroutine, reusing one
+// reply mailbox for all of them. Each Do waits on the mailbox itself
+// rather than going through the client's shared reply dispatch, so
+// there's no per-request bookkeeping or goroutine.
+//
+// A RequestSession must not be used by several goroutines at once, use
+// one per goroutine or Request instead.
+type RequestSession struct {
+	fc      *FeatureClient
+	mailbox string
+	closed  bool
+}
+
+// Create a RequestSession with its own ephemeral reply mailbox
+func (fc *FeatureClient) NewRequestSession() (*RequestSession, error) {
+	name := RandomMailbox()
+
+	err := fc.EphemeralDeclare(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RequestSession{fc: fc, mailbox: name}, nil
+}
+
+// Send msg to the mailbox name and wait up to timeout for its reply,
+// returning ETimeout if it doesn't arrive in time. The timeout follows
+// the client's clock. msg is given the session's ReplyTo and, unless it
+// has one, a new CorrelationId. Error replies are returned as errors
+// like with Request, and replies to earlier requests that timed out are
+// dropped.
+func (rs *RequestSession) Do(name string, msg *Message, timeout time.Duration) (*Delivery, error) {
+	start := time.Now()
+
+	del, err := rs.do(name, msg, timeout)
+
+	rs.fc.metrics().ObserveRequest(name, time.Since(start), err)
+
+	return del, err
+}
+
+func (rs *RequestSession) do(name string, msg *Message, timeout time.Duration) (*Delivery, error) {
+	if rs.closed {
+		return nil, EClosed
+	}
+
+	err := rs.fc.prepareRequest(context.Background(), name, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := rs.fc.Clock().Now().Add(timeout)
+
+	msg.ReplyTo = rs.mailbox
+	msg.AddHeader(DeadlineHeader, deadline.UTC().Format(time.RFC3339Nano))
+
+	err = rs.fc.Push(name, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		left := deadline.Sub(rs.fc.Clock().Now())
+		if left <= 0 {
+			return nil, ETimeout
+		}
+
+		// The broker times the poll, so look at the client's clock again
+		// every poll interval
+		if left > rs.fc.pollInterval() {
+			left = rs.fc.pollInterval()
+		}
+
+		del, err := rs.fc.LongPoll(rs.mailbox, left)
+		if err != nil {
+			return nil, err
+		}
+
+		if del == nil {
+			continue
+		}
+
+		if del.Message.CorrelationId != msg.CorrelationId {
+			debugf("dropping reply %s nobody is waiting on\n", del.Message.CorrelationId)
+			rs.fc.logError("ack stray reply", del.Ack())
+			continue
+		}
+
+		pr := &pendingReply{del: del}
+
+		return pr.result()
+	}
+}
+
+// Abandon the session's reply mailbox. Do returns EClosed afterwards.
+func (rs *RequestSession) Close() error {
+	if rs.closed {
+		return nil
+	}
+
+	rs.closed = true
+
+	return rs.fc.Abandon(rs.mailbox)
+}
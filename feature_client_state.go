@@ -0,0 +1,89 @@
+package vega
+
+import "sync"
+
+// The state of a FeatureClient's connection to the broker, as reported
+// to a StateObserver
+type ConnState int
+
+const (
+	// Talking to the broker. Clients start out in this state.
+	Connected ConnState = iota
+
+	// The connection was lost and is being re-dialed, see WithReconnect
+	// and ReceiveOpts.AutoReconnect
+	Reconnecting
+
+	// The connection was lost and isn't being re-dialed, or re-dialing
+	// gave up. The next operation dials again.
+	Disconnected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Disconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// Called with the new state each time the connection changes state
+type StateObserver func(ConnState)
+
+// The state of a connection shared by a FeatureClient and its clones
+type connState struct {
+	lock  sync.Mutex
+	state ConnState
+}
+
+// Call fn each time the connection to the broker changes state, such as
+// to show it on a dashboard or hold producers back during an outage.
+// Transitions are noticed by operations as they succeed or fail, so a
+// client that's idle doesn't notice the broker going away until it's
+// next used. fn is called from the goroutine that noticed, one call at a
+// time, and mustn't block or use fc. Clones of fc inherit it. A nil fn
+// turns it off.
+func (fc *FeatureClient) SetStateObserver(fn StateObserver) {
+	fc.onState = fn
+}
+
+// Move the connection to state, telling the StateObserver if that's a
+// change
+func (fc *FeatureClient) setState(state ConnState) {
+	if fc.onState == nil {
+		return
+	}
+
+	cs := &fc.Client.connState
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if cs.state == state {
+		return
+	}
+
+	cs.state = state
+
+	fc.onState(state)
+}
+
+// Note what the outcome of an operation says about the connection:
+// a connection error leaves it in lost, anything else means the broker
+// answered
+func (fc *FeatureClient) noteOutcome(err error, lost ConnState) {
+	if fc.onState == nil {
+		return
+	}
+
+	if isConnectionError(err) {
+		fc.setState(lost)
+	} else {
+		fc.setState(Connected)
+	}
+}
@@ -0,0 +1,335 @@
+package vega
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Message type that ends a stream of replies
+const cStreamEndType = "stream/end"
+
+// A handler that answers a request with any number of replies. Each
+// message passed to send is delivered to the requester in order.
+// Returning nil ends the stream, returning an error ends it with the
+// error, which RequestStream reports as a *RemoteError.
+type StreamHandler interface {
+	HandleStream(ctx context.Context, req *Message, send func(*Message) error) error
+}
+
+type streamHandlerFunc func(context.Context, *Message, func(*Message) error) error
+
+func (f streamHandlerFunc) HandleStream(ctx context.Context, req *Message, send func(*Message) error) error {
+	return f(ctx, req, send)
+}
+
+// Adapt h into a StreamHandler
+func StreamHandlerFunc(h func(ctx context.Context, req *Message, send func(*Message) error) error) StreamHandler {
+	return streamHandlerFunc(h)
+}
+
+type streamReplies struct {
+	fc *FeatureClient
+	h  StreamHandler
+}
+
+func (s *streamReplies) HandleMessage(m *Message) *Message {
+	return s.HandleMessageContext(context.Background(), m)
+}
+
+func (s *streamReplies) HandleMessageContext(ctx context.Context, m *Message) *Message {
+	send := func(reply *Message) error {
+		cp := *reply
+		cp.CorrelationId = m.CorrelationId
+
+		return s.fc.Push(m.ReplyTo, &cp)
+	}
+
+	err := s.h.HandleStream(ctx, m, send)
+	if err != nil {
+		return ErrorMsg(err)
+	}
+
+	return &Message{Type: cStreamEndType}
+}
+
+// Return a Handler that serves h, for use with HandleRequestsWithOpts
+// or a MessageMux. The message ending the stream is sent as the
+// request's reply, so a request that's retried streams its replies
+// again from the start.
+func (fc *FeatureClient) StreamReplies(h StreamHandler) HandlerWithContext {
+	return &streamReplies{fc, h}
+}
+
+// Serve requests on the mailbox name with h, like HandleRequests
+func (fc *FeatureClient) HandleStreams(name string, h StreamHandler) error {
+	return fc.HandleRequests(name, fc.StreamReplies(h))
+}
+
+// Send msg to the mailbox name and receive the stream of replies a
+// StreamHandler sends back. The replies arrive on the Receiver's Channel
+// in order, already acked, and it's closed once the stream ends. If the
+// handler failed, Error is then a *RemoteError.
+//
+// The replies go to an ephemeral mailbox of their own, which is
+// abandoned once the stream ends or the Receiver is closed.
+func (fc *FeatureClient) RequestStream(name string, msg *Message) (*Receiver, error) {
+	mailbox := RandomMailboxPrefixed("stream.") + cEphemeral
+
+	err := fc.EphemeralDeclare(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = RandomID()
+	}
+
+	msg.ReplyTo = mailbox
+
+	err = fc.Push(name, msg)
+	if err != nil {
+		fc.logError("abandon stream mailbox", fc.Abandon(mailbox))
+		return nil, err
+	}
+
+	c := make(chan *Delivery)
+
+	rec := newReceiver(c)
+
+	go func() {
+		defer close(rec.finished)
+		defer close(c)
+		defer func() {
+			fc.logError("abandon stream mailbox", fc.Abandon(mailbox))
+		}()
+
+		for {
+			select {
+			case <-rec.shutdown:
+				return
+			default:
+			}
+
+			del, err := fc.LongPoll(mailbox, fc.pollInterval())
+			if err != nil {
+				rec.Error = err
+				return
+			}
+
+			if del == nil {
+				continue
+			}
+
+			fc.logError("ack stream reply", del.Ack())
+
+			if del.Message.CorrelationId != msg.CorrelationId {
+				debugf("dropping stream reply %s for another request\n", del.Message.CorrelationId)
+				continue
+			}
+
+			switch del.Message.Type {
+			case cStreamEndType:
+				return
+			case cErrorType:
+				rec.Error = DecodeErrorReply(del.Message)
+				return
+			}
+
+			select {
+			case c <- del:
+			case <-rec.shutdown:
+				return
+			}
+		}
+	}()
+
+	return rec, nil
+}
+
+// Message type that opens a stream of requests, see RequestClientStream
+const cStreamOpenType = "stream/open"
+
+// Header of a stream's opening message naming the mailbox the rest of
+// the stream is sent to
+const cStreamMailboxHeader = "stream-mailbox"
+
+// A handler that reads a stream of messages sent with a ClientStream
+// and answers them all with one reply. recv returns the messages in
+// order, then io.EOF once the sender calls CloseAndRecv. Returning an
+// error sends it back as an error reply, which CloseAndRecv reports as
+// a *RemoteError.
+type ClientStreamHandler interface {
+	HandleClientStream(ctx context.Context, recv func() (*Message, error)) (*Message, error)
+}
+
+type clientStreamHandlerFunc func(context.Context, func() (*Message, error)) (*Message, error)
+
+func (f clientStreamHandlerFunc) HandleClientStream(ctx context.Context, recv func() (*Message, error)) (*Message, error) {
+	return f(ctx, recv)
+}
+
+// Adapt h into a ClientStreamHandler
+func ClientStreamHandlerFunc(h func(ctx context.Context, recv func() (*Message, error)) (*Message, error)) ClientStreamHandler {
+	return clientStreamHandlerFunc(h)
+}
+
+type clientStreamReplies struct {
+	fc *FeatureClient
+	h  ClientStreamHandler
+}
+
+func (s *clientStreamReplies) HandleMessage(m *Message) *Message {
+	return s.HandleMessageContext(context.Background(), m)
+}
+
+func (s *clientStreamReplies) HandleMessageContext(ctx context.Context, m *Message) *Message {
+	mailbox, ok := m.HeaderString(cStreamMailboxHeader)
+	if m.Type != cStreamOpenType || !ok {
+		return ErrorMsg(fmt.Errorf("expected a client stream, got a %q message", m.Type))
+	}
+
+	ended := false
+
+	recv := func() (*Message, error) {
+		if ended {
+			return nil, io.EOF
+		}
+
+		del, err := s.fc.PollContext(ctx, mailbox)
+		if err != nil {
+			return nil, err
+		}
+
+		s.fc.logError("ack stream message", del.Ack())
+
+		if del.Message.Type == cStreamEndType {
+			ended = true
+			return nil, io.EOF
+		}
+
+		return del.Message, nil
+	}
+
+	reply, err := s.h.HandleClientStream(ctx, recv)
+	if err != nil {
+		return ErrorMsg(err)
+	}
+
+	// A nil reply would be taken as one way, leaving the sender waiting
+	if reply == nil {
+		reply = &Message{}
+	}
+
+	return reply
+}
+
+// Return a Handler that serves h, for use with HandleRequestsWithOpts
+// or a MessageMux
+func (fc *FeatureClient) ClientStreamReplies(h ClientStreamHandler) HandlerWithContext {
+	return &clientStreamReplies{fc, h}
+}
+
+// Serve client streams sent to the mailbox name with h, like
+// HandleRequests
+func (fc *FeatureClient) HandleClientStreams(name string, h ClientStreamHandler) error {
+	return fc.HandleRequests(name, fc.ClientStreamReplies(h))
+}
+
+// Sends a stream of messages that a ClientStreamHandler answers with a
+// single reply, such as the parts of a bulk upload. Not safe for use by
+// several goroutines at once.
+type ClientStream struct {
+	fc      *FeatureClient
+	mailbox string
+	id      string
+	reply   chan *pendingReply
+	closed  bool
+}
+
+// Open a ClientStream to the handler serving the mailbox name.
+//
+// The stream is started by a request to name, so all of it goes to the
+// one handler that takes the request even when several consumers share
+// name. The messages themselves are sent to an ephemeral mailbox of the
+// stream's own, followed by a "stream/end" message when CloseAndRecv is
+// called, which ends the handler's recv with io.EOF. The handler can
+// start reading before the stream is finished.
+func (fc *FeatureClient) RequestClientStream(name string) (*ClientStream, error) {
+	mailbox := RandomMailboxPrefixed("stream.") + cEphemeral
+
+	err := fc.EphemeralDeclare(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	open := &Message{
+		Type:          cStreamOpenType,
+		CorrelationId: RandomID(),
+	}
+
+	open.AddHeader(cStreamMailboxHeader, mailbox)
+
+	reply, err := fc.expectReply(open)
+	if err != nil {
+		fc.logError("abandon stream mailbox", fc.Abandon(mailbox))
+		return nil, err
+	}
+
+	err = fc.Push(name, open)
+	if err != nil {
+		fc.cancelReply(open.CorrelationId, reply)
+		fc.logError("abandon stream mailbox", fc.Abandon(mailbox))
+		return nil, err
+	}
+
+	return &ClientStream{
+		fc:      fc,
+		mailbox: mailbox,
+		id:      open.CorrelationId,
+		reply:   reply,
+	}, nil
+}
+
+// Send msg as the next message of the stream
+func (cs *ClientStream) Send(msg *Message) error {
+	if cs.closed {
+		return EClosed
+	}
+
+	return cs.fc.Push(cs.mailbox, msg)
+}
+
+// End the stream and wait for the handler's reply, which is left
+// unacked as with Request
+func (cs *ClientStream) CloseAndRecv() (*Delivery, error) {
+	return cs.CloseAndRecvContext(context.Background())
+}
+
+// Like CloseAndRecv, giving up with ctx.Err() if ctx is done before the
+// reply arrives. The stream's mailbox is abandoned either way.
+func (cs *ClientStream) CloseAndRecvContext(ctx context.Context) (*Delivery, error) {
+	if cs.closed {
+		return nil, EClosed
+	}
+
+	cs.closed = true
+
+	defer func() {
+		cs.fc.logError("abandon stream mailbox", cs.fc.Abandon(cs.mailbox))
+	}()
+
+	err := cs.fc.Push(cs.mailbox, &Message{Type: cStreamEndType})
+	if err != nil {
+		cs.fc.cancelReply(cs.id, cs.reply)
+		return nil, err
+	}
+
+	select {
+	case pr := <-cs.reply:
+		return pr.result()
+	case <-ctx.Done():
+		cs.fc.cancelReply(cs.id, cs.reply)
+		return nil, ctx.Err()
+	}
+}
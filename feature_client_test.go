@@ -2,13 +2,24 @@ package vega
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFeatureClientAutoEphemeralDeclare(t *testing.T) {
@@ -45,6 +56,178 @@ func TestFeatureClientAutoEphemeralDeclare(t *testing.T) {
 	assert.NotNil(t, err, "mailbox was not ephemeral")
 }
 
+func TestFeatureClientDialTLS(t *testing.T) {
+	serverCfg, clientCfg := testTLSConfigs()
+
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.AcceptTLS(serverCfg)
+
+	fc, err := DialTLS(cPort, clientCfg)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := DialTLS(cPort, clientCfg)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	fc.Declare("a")
+
+	go fc.HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		return Msg("hey!")
+	}))
+
+	resp, err := fc2.RequestTimeout("a", Msg("hello"), 1*time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hey!", string(resp.Message.Body))
+	}
+}
+
+func TestFeatureClientDialTimeout(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := DialTimeout(cPort, 1*time.Second)
+	if assert.NoError(t, err) {
+		defer fc.Close()
+
+		assert.NoError(t, fc.Declare("a"))
+	}
+}
+
+// Return an address nothing is listening on
+func deadAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	l.Close()
+
+	return l.Addr().String()
+}
+
+func TestFeatureClientDialAny(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := DialAny([]string{deadAddr(), cPort})
+	require.NoError(t, err)
+
+	defer fc.Close()
+
+	assert.NoError(t, fc.Declare("a"))
+
+	_, err = DialAny([]string{deadAddr(), deadAddr()})
+	assert.Error(t, err)
+
+	_, err = DialAny(nil)
+	assert.Equal(t, ENoAddrs, err)
+}
+
+func TestFeatureClientDialAnyFailover(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	serv2, err := NewMemService(cPort2)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv2.Close()
+	go serv2.Accept()
+
+	fc, err := DialAny([]string{cPort, cPort2}, WithReconnect(ReconnectPolicy{
+		MinBackoff: 10 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+
+	defer fc.Close()
+
+	err = fc.EphemeralDeclare("e")
+	require.NoError(t, err)
+
+	serv.Close()
+
+	c, err := NewClient(cPort2)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c.Close()
+
+	err = c.Declare("a")
+	require.NoError(t, err)
+
+	msg := Msg([]byte("hello"))
+
+	err = c.Push("a", msg)
+	require.NoError(t, err)
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, msg.Body, del.Message.Body)
+
+	err = fc.Push("e", msg)
+	assert.NoError(t, err, "ephemeral mailbox was not restored")
+}
+
+func TestFeatureClientDialTimeoutDuringHandshake(t *testing.T) {
+	_, clientCfg := testTLSConfigs()
+
+	l, err := net.Listen("tcp", cPort2)
+	if err != nil {
+		panic(err)
+	}
+
+	defer l.Close()
+
+	// Accept but never speak, so the handshake can't complete
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			defer c.Close()
+		}
+	}()
+
+	start := time.Now()
+
+	_, err = DialWithOptions(cPort2, WithTLS(clientCfg), WithDialTimeout(100*time.Millisecond))
+	assert.Equal(t, ETimeout, err)
+
+	assert.True(t, time.Since(start) < 1*time.Second, "dial did not time out")
+}
+
 func TestFeatureClientReceiveChannel(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
@@ -134,7 +317,7 @@ func TestFeatureClientReceiveChannelProvidesManyValues(t *testing.T) {
 	assert.Equal(t, len(messages), 3, "channel didn't get 3 messages")
 }
 
-func TestFeatureClientRequestReply(t *testing.T) {
+func TestFeatureClientReceiveSetsError(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -150,28 +333,27 @@ func TestFeatureClientRequestReply(t *testing.T) {
 
 	defer fc.Close()
 
-	fc2, err := Dial(cPort)
-	if err != nil {
-		panic(err)
-	}
+	rc := fc.Receive("missing")
+	defer rc.Close()
 
-	defer fc2.Close()
+	done := make(chan struct{})
 
-	fc.Declare("a")
+	go func() {
+		for range rc.Channel {
+		}
 
-	go fc.HandleRequests("a", HandlerFunc(func(req *Message) *Message {
-		return Msg("hey!")
-	}))
+		close(done)
+	}()
 
-	resp, err := fc2.Request("a", Msg("hello"))
-	if err != nil {
-		panic(err)
+	select {
+	case <-done:
+		assert.Error(t, rc.Error)
+	case <-time.Tick(1 * time.Second):
+		t.Fatal("channel wasn't closed on error")
 	}
-
-	assert.True(t, bytes.Equal(resp.Message.Body, []byte("hey!")), "wrong message")
 }
 
-func TestFeatureClientPipe(t *testing.T) {
+func TestFeatureClientReceiveAutoAck(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -187,37 +369,23 @@ func TestFeatureClientPipe(t *testing.T) {
 
 	defer fc.Close()
 
-	fc2, err := Dial(cPort)
-	if err != nil {
-		panic(err)
-	}
-
-	defer fc2.Close()
-
-	var wg sync.WaitGroup
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		conn.Write([]byte("hello"))
-		conn.Close()
-	}()
-
-	runtime.Gosched()
-
-	conn, err := fc.ConnectPipe("a")
-	assert.NoError(t, err)
+	fc.Declare("a")
 
-	data := make([]byte, 5)
+	fc.Push("a", Msg("hello"))
 
-	_, err = conn.Read(data)
-	assert.NoError(t, err)
+	rc := fc.ReceiveWithOpts("a", ReceiveOpts{AutoAck: true})
+	defer rc.Close()
 
-	assert.Equal(t, data, []byte("hello"))
+	select {
+	case got := <-rc.Channel:
+		assert.Equal(t, "hello", string(got.Message.Body))
+		assert.Error(t, got.Ack(), "delivery was not already acked")
+	case <-time.Tick(1 * time.Second):
+		t.Fatal("channel didn't provide a value")
+	}
 }
 
-func TestFeatureClientPipeMoreDataThanBuffer(t *testing.T) {
+func TestFeatureClientReceivePrefetch(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -233,47 +401,26 @@ func TestFeatureClientPipeMoreDataThanBuffer(t *testing.T) {
 
 	defer fc.Close()
 
-	fc2, err := Dial(cPort)
-	if err != nil {
-		panic(err)
-	}
-
-	defer fc2.Close()
-
-	var wg sync.WaitGroup
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		conn.Write([]byte("hello"))
-		conn.Close()
-	}()
-
-	runtime.Gosched()
-
-	conn, err := fc.ConnectPipe("a")
-	assert.NoError(t, err)
-
-	wg.Wait()
-
-	data := make([]byte, 2)
+	fc.Declare("a")
 
-	n, err := conn.Read(data)
-	assert.NoError(t, err)
-	assert.Equal(t, 2, n)
+	for i := 0; i < 3; i++ {
+		fc.Push("a", Msg("hello"))
+	}
 
-	assert.Equal(t, []byte("he"), data)
+	rc := fc.ReceiveWithOpts("a", ReceiveOpts{Prefetch: 3})
+	defer rc.Close()
 
-	d2 := make([]byte, 3)
+	time.Sleep(100 * time.Millisecond)
 
-	_, err = conn.Read(d2)
-	assert.NoError(t, err)
+	assert.Equal(t, 3, len(rc.Channel), "receiver did not pull ahead")
 
-	assert.Equal(t, []byte("llo"), d2)
+	for i := 0; i < 3; i++ {
+		del := <-rc.Channel
+		assert.NoError(t, del.Ack(), "prefetched delivery should still need acking")
+	}
 }
 
-func TestFeatureClientPipeDrainBuffer(t *testing.T) {
+func TestFeatureClientReceiveMaxInFlight(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -289,56 +436,53 @@ func TestFeatureClientPipeDrainBuffer(t *testing.T) {
 
 	defer fc.Close()
 
-	fc2, err := Dial(cPort)
-	if err != nil {
-		panic(err)
-	}
-
-	defer fc2.Close()
-
-	var wg sync.WaitGroup
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		conn.Write([]byte("hello"))
-		conn.Close()
-	}()
-
-	runtime.Gosched()
+	fc.Declare("a")
 
-	conn, err := fc.ConnectPipe("a")
-	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		fc.Push("a", Msg(strconv.Itoa(i)))
+	}
 
-	wg.Wait()
+	rc := fc.ReceiveWithOpts("a", ReceiveOpts{Prefetch: 4, MaxInFlight: 2})
+	defer rc.Close()
 
-	data := make([]byte, 2)
+	first := <-rc.Channel
+	second := <-rc.Channel
 
-	n, err := conn.Read(data)
-	assert.NoError(t, err)
-	assert.Equal(t, 2, n)
+	time.Sleep(100 * time.Millisecond)
 
-	assert.Equal(t, []byte("he"), data)
+	select {
+	case del := <-rc.Channel:
+		t.Fatalf("pulled %s with 2 in flight", del.Message.Body)
+	default:
+	}
 
-	d2 := make([]byte, 2)
+	stats, err := serv.Registry.(*Registry).Stats("a")
+	require.NoError(t, err)
 
-	n, err = conn.Read(d2)
-	assert.NoError(t, err)
-	assert.Equal(t, 2, n)
+	assert.Equal(t, 2, stats.Size, "a third message was taken from the mailbox")
 
-	assert.Equal(t, []byte("ll"), d2)
+	assert.NoError(t, first.Ack())
 
-	d3 := make([]byte, 1)
+	select {
+	case del := <-rc.Channel:
+		assert.Equal(t, "2", string(del.Message.Body))
+		assert.NoError(t, del.Ack())
+	case <-time.After(2 * time.Second):
+		t.Fatal("receiving didn't resume after an ack")
+	}
 
-	n, err = conn.Read(d3)
-	assert.NoError(t, err)
-	assert.Equal(t, 1, n)
+	// nacking settles a delivery too
+	assert.NoError(t, second.Nack())
 
-	assert.Equal(t, []byte("o"), d3)
+	select {
+	case del := <-rc.Channel:
+		assert.NoError(t, del.Ack())
+	case <-time.After(2 * time.Second):
+		t.Fatal("receiving didn't resume after a nack")
+	}
 }
 
-func TestFeatureClientPipePrependBufferInOneCall(t *testing.T) {
+func benchmarkReceivePrefetch(b *testing.B, prefetch int) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -354,57 +498,36 @@ func TestFeatureClientPipePrependBufferInOneCall(t *testing.T) {
 
 	defer fc.Close()
 
-	fc2, err := Dial(cPort)
-	if err != nil {
-		panic(err)
-	}
-
-	defer fc2.Close()
-
-	var wg sync.WaitGroup
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		conn.Write([]byte("hello"))
-		conn.Write([]byte("world"))
-		conn.Close()
-	}()
-
-	runtime.Gosched()
-
-	conn, err := fc.ConnectPipe("a")
-	assert.NoError(t, err)
-
-	wg.Wait()
-
-	data := make([]byte, 2)
-
-	n, err := conn.Read(data)
-	assert.NoError(t, err)
-	assert.Equal(t, 2, n)
+	fc.Declare("a")
 
-	assert.Equal(t, []byte("he"), data)
+	for i := 0; i < b.N; i++ {
+		fc.Push("a", Msg("hello"))
+	}
 
-	d2 := make([]byte, 2)
+	b.ResetTimer()
 
-	n, err = conn.Read(d2)
-	assert.NoError(t, err)
-	assert.Equal(t, 2, n)
+	rc := fc.ReceiveWithOpts("a", ReceiveOpts{AutoAck: true, Prefetch: prefetch})
+	defer rc.Close()
 
-	assert.Equal(t, []byte("ll"), d2)
+	for i := 0; i < b.N; i++ {
+		<-rc.Channel
 
-	d3 := make([]byte, 6)
+		// bursty consumer work
+		if i%32 == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
 
-	n, err = conn.Read(d3)
-	assert.NoError(t, err)
-	assert.Equal(t, 6, n)
+func BenchmarkFeatureClientReceivePrefetch1(b *testing.B) {
+	benchmarkReceivePrefetch(b, 1)
+}
 
-	assert.Equal(t, []byte("oworld"), d3)
+func BenchmarkFeatureClientReceivePrefetch32(b *testing.B) {
+	benchmarkReceivePrefetch(b, 32)
 }
 
-func TestFeatureClientPipeReadMultipleMessages(t *testing.T) {
+func TestFeatureClientRequestReply(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -427,39 +550,52 @@ func TestFeatureClientPipeReadMultipleMessages(t *testing.T) {
 
 	defer fc2.Close()
 
-	latch := make(chan bool)
+	fc.Declare("a")
 
-	var wg sync.WaitGroup
+	go fc.HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		return Msg("hey!")
+	}))
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		conn.Write([]byte("hello"))
-		conn.Write([]byte("world"))
-		<-latch
-		conn.Close()
-	}()
+	resp, err := fc2.Request("a", Msg("hello"))
+	if err != nil {
+		panic(err)
+	}
 
-	runtime.Gosched()
+	assert.True(t, bytes.Equal(resp.Message.Body, []byte("hey!")), "wrong message")
+}
 
-	conn, err := fc.ConnectPipe("a")
-	assert.NoError(t, err)
+func TestFeatureClientRequestContextCancel(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
 
-	data := make([]byte, 20)
+	defer serv.Close()
+	go serv.Accept()
 
-	n, err := conn.Read(data)
-	assert.NoError(t, err)
-	assert.Equal(t, 10, n)
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
 
-	assert.Equal(t, []byte("helloworld"), data[:n])
+	defer fc.Close()
 
-	latch <- true
+	fc.Declare("a")
 
-	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err = fc.RequestContext(ctx, "a", Msg("hello"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	assert.True(t, time.Since(start) < 5*time.Second, "request did not stop promptly")
+
+	assert.Equal(t, "", fc.localMailbox, "reply mailbox was not abandoned")
 }
 
-func TestFeatureClientPipeReadMultipleMessagesThenClose(t *testing.T) {
+func TestFeatureClientRequestTo(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -475,41 +611,40 @@ func TestFeatureClientPipeReadMultipleMessagesThenClose(t *testing.T) {
 
 	defer fc.Close()
 
-	fc2, err := Dial(cPort)
+	collector, err := Dial(cPort)
 	if err != nil {
 		panic(err)
 	}
 
-	defer fc2.Close()
-
-	var wg sync.WaitGroup
+	defer collector.Close()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		conn.Write([]byte("hello"))
-		conn.Write([]byte("world"))
-		conn.Close()
-	}()
+	for _, name := range []string{"a", "replies"} {
+		err = fc.Declare(name)
+		require.NoError(t, err)
+	}
 
-	runtime.Gosched()
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		return Msg("re: " + string(req.Body))
+	}))
 
-	conn, err := fc.ConnectPipe("a")
-	assert.NoError(t, err)
+	msg := Msg("hello")
 
-	wg.Wait()
+	err = fc.RequestTo("a", "replies", msg)
+	require.NoError(t, err)
 
-	data := make([]byte, 20)
+	assert.NotEmpty(t, msg.CorrelationId)
+	assert.Equal(t, "replies", msg.ReplyTo)
 
-	n, err := conn.Read(data)
-	assert.NoError(t, err)
-	assert.Equal(t, 10, n)
+	del, err := collector.LongPoll("replies", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, del)
 
-	assert.Equal(t, []byte("helloworld"), data[:n])
+	assert.Equal(t, "re: hello", string(del.Message.Body))
+	assert.Equal(t, msg.CorrelationId, del.Message.CorrelationId)
+	assert.NoError(t, del.Ack())
 }
 
-func TestFeatureClientPipeReadDeadline(t *testing.T) {
+func TestFeatureClientConcurrentUse(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -525,43 +660,47 @@ func TestFeatureClientPipeReadDeadline(t *testing.T) {
 
 	defer fc.Close()
 
-	fc2, err := Dial(cPort)
-	if err != nil {
-		panic(err)
+	for _, name := range []string{"a", "b"} {
+		err = fc.Declare(name)
+		require.NoError(t, err)
 	}
 
-	defer fc2.Close()
+	go fc.HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		return Msg(req.Body)
+	}))
 
 	var wg sync.WaitGroup
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		time.Sleep(100 * time.Millisecond)
-		conn.Write([]byte("1"))
-		conn.Close()
-	}()
-
-	runtime.Gosched()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
 
-	conn, err := fc.ConnectPipe("a")
-	defer conn.Close()
+			body := strconv.Itoa(i)
 
-	assert.NoError(t, err)
+			for j := 0; j < 10; j++ {
+				resp, err := fc.RequestAck("a", Msg(body))
+				if assert.NoError(t, err) {
+					assert.Equal(t, body, string(resp.Body))
+				}
 
-	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				assert.NoError(t, fc.Push("b", Msg(body)))
 
-	data := make([]byte, 1)
+				del, err := fc.Poll("b")
+				if assert.NoError(t, err) && del != nil {
+					assert.NoError(t, del.Ack())
+				}
 
-	n, err := conn.Read(data)
-	assert.Equal(t, 0, n)
-	assert.Equal(t, ETimeout, err)
+				_, err = fc.LocalMailboxE()
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
 
 	wg.Wait()
 }
 
-func TestFeatureClientPipeCloseAbandonsMailbox(t *testing.T) {
+func TestFeatureClientHandleRequestsN(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -584,31 +723,35 @@ func TestFeatureClientPipeCloseAbandonsMailbox(t *testing.T) {
 
 	defer fc2.Close()
 
-	var wg sync.WaitGroup
+	fc.Declare("a")
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		conn.Write([]byte("hello"))
-		conn.Write([]byte("world"))
-		conn.Close()
-	}()
+	go fc.HandleRequestsN("a", HandlerFunc(func(req *Message) *Message {
+		time.Sleep(200 * time.Millisecond)
+		return Msg(req.Body)
+	}), 5)
 
-	runtime.Gosched()
+	start := time.Now()
 
-	conn, err := fc.ConnectPipe("a")
-	assert.NoError(t, err)
+	var wg sync.WaitGroup
 
-	wg.Wait()
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(body string) {
+			defer wg.Done()
 
-	conn.Close()
+			resp, err := fc2.Request("a", Msg(body))
+			if assert.NoError(t, err) {
+				assert.Equal(t, body, string(resp.Message.Body))
+			}
+		}(RandomID())
+	}
 
-	err = fc.Push(conn.ownM, Msg("test"))
-	assert.Error(t, err)
+	wg.Wait()
+
+	assert.True(t, time.Since(start) < 600*time.Millisecond, "requests were not handled concurrently")
 }
 
-func TestFeatureClientPipeSendBulk(t *testing.T) {
+func TestFeatureClientHandleRequestsNStopsOnError(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -624,42 +767,24 @@ func TestFeatureClientPipeSendBulk(t *testing.T) {
 
 	defer fc.Close()
 
-	fc2, err := Dial(cPort)
-	if err != nil {
-		panic(err)
-	}
-
-	defer fc2.Close()
-
-	var wg sync.WaitGroup
+	done := make(chan error)
 
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		n, err := conn.SendBulk(bytes.NewReader([]byte("1")))
-		assert.NoError(t, err)
-		assert.Equal(t, 1, n)
-		conn.Close()
+		done <- fc.HandleRequestsN("missing", HandlerFunc(func(req *Message) *Message {
+			return nil
+		}), 3)
 	}()
 
-	runtime.Gosched()
-
-	conn, err := fc.ConnectPipe("a")
-	defer conn.Close()
-
-	assert.NoError(t, err)
-
-	data := make([]byte, 1)
-
-	n, err := conn.Read(data)
-	assert.Equal(t, 1, n)
-	assert.Equal(t, []byte("1"), data)
-
-	wg.Wait()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+		assert.NotEqual(t, context.Canceled, err)
+	case <-time.Tick(1 * time.Second):
+		t.Fatal("pool did not shut down")
+	}
 }
 
-func TestFeatureClientPipeSendBulkBuffered(t *testing.T) {
+func TestFeatureClientWorkerPool(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -675,46 +800,56 @@ func TestFeatureClientPipeSendBulkBuffered(t *testing.T) {
 
 	defer fc.Close()
 
-	fc2, err := Dial(cPort)
-	if err != nil {
-		panic(err)
-	}
+	var (
+		lock    sync.Mutex
+		handled = map[string]int{}
+	)
 
-	defer fc2.Close()
+	h := HandlerFunc(func(req *Message) *Message {
+		lock.Lock()
+		handled[string(req.Body)]++
+		lock.Unlock()
 
-	var wg sync.WaitGroup
+		return nil
+	})
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		conn.SendBulk(bytes.NewReader([]byte("hello")))
-		conn.Close()
-	}()
+	w1, err := fc.WorkerPool("a", h, 3)
+	require.NoError(t, err)
 
-	runtime.Gosched()
+	w2, err := fc.Clone().WorkerPool("a", h, 3)
+	require.NoError(t, err)
 
-	conn, err := fc.ConnectPipe("a")
-	defer conn.Close()
+	for i := 0; i < 30; i++ {
+		err = fc.Push("a", Msg(fmt.Sprintf("%d", i)))
+		require.NoError(t, err)
+	}
 
-	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		n := len(handled)
+		lock.Unlock()
 
-	data := make([]byte, 1)
+		if n == 30 {
+			break
+		}
 
-	n, err := conn.Read(data)
-	assert.Equal(t, 1, n)
-	assert.Equal(t, []byte("h"), data)
+		time.Sleep(10 * time.Millisecond)
+	}
 
-	d2 := make([]byte, 5)
+	assert.NoError(t, w1.Stop())
+	assert.NoError(t, w2.Stop())
 
-	n, err = conn.Read(d2)
-	assert.Equal(t, 4, n)
-	assert.Equal(t, []byte("ello"), d2[:n])
+	lock.Lock()
+	defer lock.Unlock()
 
-	wg.Wait()
+	assert.Equal(t, 30, len(handled))
+
+	for body, n := range handled {
+		assert.Equal(t, 1, n, "message %s was handled %d times", body, n)
+	}
 }
 
-func TestFeatureClientPipeSendBulkSwitchesBack(t *testing.T) {
+func TestFeatureClientWorkerPoolStopWaitsForHandlers(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -730,51 +865,110 @@ func TestFeatureClientPipeSendBulkSwitchesBack(t *testing.T) {
 
 	defer fc.Close()
 
-	fc2, err := Dial(cPort)
-	if err != nil {
-		panic(err)
-	}
+	started := make(chan struct{})
+	release := make(chan struct{})
 
-	defer fc2.Close()
+	w, err := fc.WorkerPool("a", HandlerFunc(func(req *Message) *Message {
+		close(started)
+		<-release
+		return nil
+	}), 2)
+	require.NoError(t, err)
 
-	var wg sync.WaitGroup
+	err = fc.Push("a", Msg("hello"))
+	require.NoError(t, err)
+
+	<-started
+
+	stopped := make(chan error)
 
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		conn.SendBulk(bytes.NewReader([]byte("hello")))
-		conn.Write([]byte("world"))
-		conn.Close()
+		stopped <- w.Stop()
 	}()
 
-	runtime.Gosched()
+	select {
+	case <-stopped:
+		t.Fatal("Stop didn't wait for the handler")
+	case <-time.After(100 * time.Millisecond):
+	}
 
-	conn, err := fc.ConnectPipe("a")
-	defer conn.Close()
+	close(release)
 
-	assert.NoError(t, err)
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop didn't return")
+	}
 
-	data := make([]byte, 1)
+	stats, err := serv.Registry.(*Registry).Stats("a")
+	require.NoError(t, err)
 
-	n, err := conn.Read(data)
-	assert.Equal(t, 1, n)
-	assert.Equal(t, []byte("h"), data)
+	assert.Equal(t, 0, stats.Size)
+	assert.Equal(t, 0, stats.InFlight)
+}
 
-	d2 := make([]byte, 5)
+func TestFeatureClientHandleRequestsSurvivesPanic(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
 
-	n, err = conn.Read(d2)
-	assert.Equal(t, 4, n)
-	assert.Equal(t, []byte("ello"), d2[:n])
+	defer serv.Close()
+	go serv.Accept()
 
-	n, err = conn.Read(d2)
-	assert.Equal(t, 5, n)
-	assert.Equal(t, []byte("world"), d2)
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
 
-	wg.Wait()
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	fc.Declare("a")
+	fc.Declare("dead")
+
+	panics := make(chan interface{}, 1)
+
+	opts := HandleRequestsOpts{
+		OnPanic:         func(m *Message, v interface{}) { panics <- v },
+		ReplyOnPanic:    true,
+		DeadLetterQueue: "dead",
+	}
+
+	go fc.HandleRequestsWithOpts(context.Background(), "a", HandlerFunc(func(req *Message) *Message {
+		if string(req.Body) == "boom" {
+			panic("kaboom")
+		}
+
+		return Msg("ok")
+	}), opts)
+
+	_, err = fc2.RequestTimeout("a", Msg("boom"), 1*time.Second)
+	if perr, ok := err.(*RemoteError); assert.True(t, ok, "panic was not replied to") {
+		assert.Equal(t, "handler panic: kaboom", perr.Message)
+	}
+
+	assert.Equal(t, "kaboom", <-panics)
+
+	dead, err := fc2.Poll("dead")
+	if assert.NoError(t, err) && assert.NotNil(t, dead) {
+		assert.Equal(t, "boom", string(dead.Message.Body))
+	}
+
+	resp, err := fc2.RequestTimeout("a", Msg("fine"), 1*time.Second)
+	if assert.NoError(t, err, "handler loop died") {
+		assert.Equal(t, "ok", string(resp.Message.Body))
+	}
 }
 
-func TestFeatureClientPipeSendBulkEncrypted(t *testing.T) {
+func TestFeatureClientRequestTimeout(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -790,6 +984,22 @@ func TestFeatureClientPipeSendBulkEncrypted(t *testing.T) {
 
 	defer fc.Close()
 
+	fc.Declare("a")
+
+	start := time.Now()
+
+	_, err = fc.RequestTimeout("a", Msg("hello"), 100*time.Millisecond)
+	assert.Equal(t, ETimeout, err)
+
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 100*time.Millisecond && elapsed < 1*time.Second, "returned far from the deadline")
+
+	assert.Equal(t, "", fc.localMailbox, "reply mailbox was not abandoned")
+
+	go fc.HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		return Msg("hey!")
+	}))
+
 	fc2, err := Dial(cPort)
 	if err != nil {
 		panic(err)
@@ -797,42 +1007,205 @@ func TestFeatureClientPipeSendBulkEncrypted(t *testing.T) {
 
 	defer fc2.Close()
 
-	var wg sync.WaitGroup
+	resp, err := fc2.RequestTimeout("a", Msg("hello"), 1*time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hey!", string(resp.Message.Body))
+	}
+}
+
+func TestFeatureClientRequestErrorReply(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	fc.Declare("a")
+
+	go fc.HandleRequests("a", HandleErrors(ErrorHandlerFunc(func(req *Message) (*Message, error) {
+		if string(req.Body) == "bad" {
+			return nil, fmt.Errorf("can't handle %s", req.Body)
+		}
+
+		return Msg("ok"), nil
+	})))
+
+	resp, err := fc2.Request("a", Msg("good"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ok", string(resp.Message.Body))
+	}
+
+	_, err = fc2.Request("a", Msg("bad"))
+	if rerr, ok := err.(*RemoteError); assert.True(t, ok, "not a RemoteError") {
+		assert.Equal(t, "can't handle bad", rerr.Message)
+	}
+}
+
+func TestFeatureClientHandleRequestsContextCancel(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	fc.Declare("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	handling := make(chan struct{})
+	done := make(chan error)
 
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
-		conn, _ := fc.ListenPipe("a")
-		n, err := conn.SendBulk(bytes.NewReader([]byte("hello")))
-		assert.NoError(t, err)
-		assert.Equal(t, 5, n)
-		conn.Close()
+		done <- fc.HandleRequestsContext(ctx, "a", HandlerFunc(func(req *Message) *Message {
+			close(handling)
+			time.Sleep(100 * time.Millisecond)
+			return Msg("hey!")
+		}))
 	}()
 
-	runtime.Gosched()
+	replies := make(chan *Delivery)
 
-	conn, err := fc2.ConnectPipe("a")
-	defer conn.Close()
+	go func() {
+		resp, _ := fc2.Request("a", Msg("hello"))
+		replies <- resp
+	}()
 
-	assert.NoError(t, err)
+	<-handling
+	cancel()
 
-	data := make([]byte, 1)
+	select {
+	case resp := <-replies:
+		assert.True(t, bytes.Equal(resp.Message.Body, []byte("hey!")), "wrong message")
+	case <-time.Tick(5 * time.Second):
+		t.Fatal("in-flight request was not finished")
+	}
 
-	n, err := conn.Read(data)
-	assert.Equal(t, 1, n)
-	assert.Equal(t, []byte("h"), data)
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.Tick(5 * time.Second):
+		t.Fatal("handler loop did not stop")
+	}
+}
 
-	d2 := make([]byte, 4)
+func TestFeatureClientHandleRequestsContextStopsWhilePolling(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
 
-	n, err = conn.bulk.(*streamWrapper).Conn.Read(d2)
-	assert.Equal(t, 4, n)
-	assert.NotEqual(t, []byte("ello"), d2)
-	assert.NotEqual(t, d2[1], d2[2])
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.Declare("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+
+	go func() {
+		done <- fc.HandleRequestsContext(ctx, "a", HandlerFunc(func(req *Message) *Message {
+			return Msg("hey!")
+		}))
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.Tick(5 * time.Second):
+		t.Fatal("handler loop blocked on long poll")
+	}
+}
+
+func TestFeatureClientConcurrentRequestsGetOwnReply(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	fc.Declare("a")
+
+	go fc.HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		return Msg(req.Body)
+	}))
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(body string) {
+			defer wg.Done()
+
+			resp, err := fc2.Request("a", Msg(body))
+			if assert.NoError(t, err) {
+				assert.Equal(t, body, string(resp.Message.Body), "got another request's reply")
+			}
+		}(RandomID())
+	}
 
 	wg.Wait()
 }
 
-func TestFeatureClientPipeDetectsClosure(t *testing.T) {
+func TestFeatureClientPipe(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
 		panic(err)
@@ -860,14 +1233,14 @@ func TestFeatureClientPipeDetectsClosure(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		lp, _ := fc.ListenPipe("a")
-		lp.Write([]byte("hello"))
-		fc.Client.conn.Close()
+		conn, _ := fc.ListenPipe("a")
+		conn.Write([]byte("hello"))
+		conn.Close()
 	}()
 
 	runtime.Gosched()
 
-	conn, err := fc2.ConnectPipe("a")
+	conn, err := fc.ConnectPipe("a")
 	assert.NoError(t, err)
 
 	data := make([]byte, 5)
@@ -875,18 +1248,6819 @@ func TestFeatureClientPipeDetectsClosure(t *testing.T) {
 	_, err = conn.Read(data)
 	assert.NoError(t, err)
 
-	done := make(chan error)
+	assert.Equal(t, data, []byte("hello"))
+}
 
-	go func() {
-		debugf("read after closed\n")
-		_, err := conn.Read(data)
-		done <- err
-	}()
+func TestFeatureClientPipeTimeouts(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
 
-	select {
-	case <-time.Tick(1 * time.Second):
-		t.Fatal("read did not detect closure of other side")
-	case err = <-done:
-		assert.Equal(t, err, io.EOF)
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
 	}
+
+	defer fc.Close()
+
+	start := time.Now()
+
+	_, err = fc.ListenPipeTimeout("a", 100*time.Millisecond)
+	assert.Equal(t, ETimeout, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// a listener went away without consuming the connection attempt
+	err = fc.Declare("pipe:a")
+	require.NoError(t, err)
+
+	start = time.Now()
+
+	_, err = fc.ConnectPipeTimeout("a", 100*time.Millisecond)
+	assert.Equal(t, ETimeout, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// the expired attempt is skipped by the next listener
+	_, err = fc.ListenPipeTimeout("a", 200*time.Millisecond)
+	assert.Equal(t, ETimeout, err)
+}
+
+func TestFeatureClientPipeConcurrentConnectors(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	const connectors = 5
+
+	err = fc.Declare("pipe:a")
+	require.NoError(t, err)
+
+	go func() {
+		lfc := fc.Clone()
+
+		for i := 0; i < connectors; i++ {
+			conn, err := lfc.ListenPipe("a")
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				buf := make([]byte, 1)
+
+				_, err := io.ReadFull(conn, buf)
+				if err != nil {
+					return
+				}
+
+				conn.Write(buf)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, connectors)
+
+	for i := 0; i < connectors; i++ {
+		wg.Add(1)
+
+		go func(id byte) {
+			defer wg.Done()
+
+			conn, err := fc.Clone().ConnectPipeTimeout("a", 5*time.Second)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			defer conn.Close()
+
+			_, err = conn.Write([]byte{id})
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			buf := make([]byte, 1)
+
+			_, err = io.ReadFull(conn, buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if buf[0] != id {
+				errs <- fmt.Errorf("connector %d was paired with %d", id, buf[0])
+			}
+		}(byte(i))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+// Return how many mailboxes serv has declared
+func mailboxCount(serv *Service) int {
+	reg := serv.Registry.(*Registry)
+
+	reg.Lock()
+	defer reg.Unlock()
+
+	return len(reg.mailboxes)
+}
+
+func TestFeatureClientPipeHandshakeFailuresCleanUp(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	before := mailboxCount(serv)
+
+	// something other than a connection attempt arrives
+	err = fc.Declare("pipe:a")
+	require.NoError(t, err)
+
+	err = fc.Push("pipe:a", &Message{Type: "bogus"})
+	require.NoError(t, err)
+
+	_, err = fc.ListenPipe("a")
+	assert.Equal(t, EProtocolError, err)
+
+	// Only the shared listening mailbox is left
+	assert.Equal(t, before+1, mailboxCount(serv), "listen leaked a mailbox on a bad message")
+
+	// the connector's mailbox is already gone
+	err = fc.Push("pipe:a", &Message{Type: "pipe/initconnect", ReplyTo: "missing"})
+	require.NoError(t, err)
+
+	_, err = fc.ListenPipe("a")
+	assert.Error(t, err)
+	assert.Equal(t, before+1, mailboxCount(serv), "listen leaked a mailbox on a failed setup")
+
+	// the listener answers with something other than a setup
+	go func() {
+		lfc := fc.Clone()
+
+		del, err := lfc.LongPoll("pipe:a", 5*time.Second)
+		if err != nil || del == nil {
+			return
+		}
+
+		del.Ack()
+
+		lfc.Push(del.Message.ReplyTo, &Message{Type: "bogus"})
+	}()
+
+	_, err = fc.ConnectPipeTimeout("a", 5*time.Second)
+	assert.Equal(t, EProtocolError, err)
+	assert.Equal(t, before+1, mailboxCount(serv), "connect leaked a mailbox on a bad reply")
+
+	// nobody answers in time
+	_, err = fc.ConnectPipeTimeout("a", 50*time.Millisecond)
+	assert.Equal(t, ETimeout, err)
+	assert.Equal(t, before+1, mailboxCount(serv), "connect leaked a mailbox on a timeout")
+}
+
+func TestFeatureClientPipeListenTimeoutLeavesOtherListeners(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	listened := make(chan *PipeConn, 1)
+
+	go func() {
+		lp, err := fc.Clone().ListenPipeTimeout("a", 5*time.Second)
+		if err != nil {
+			t.Error(err)
+		}
+
+		listened <- lp
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = fc.ListenPipeTimeout("a", 50*time.Millisecond)
+	assert.Equal(t, ETimeout, err)
+
+	conn, err := fc.ConnectPipeTimeout("a", 5*time.Second)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	lp := <-listened
+	require.NotNil(t, lp)
+
+	defer lp.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	data := make([]byte, 5)
+
+	_, err = io.ReadFull(lp, data)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestFeatureClientPipeMoreDataThanBuffer(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	assert.NoError(t, err)
+
+	wg.Wait()
+
+	data := make([]byte, 2)
+
+	n, err := conn.Read(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.Equal(t, []byte("he"), data)
+
+	d2 := make([]byte, 3)
+
+	_, err = conn.Read(d2)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []byte("llo"), d2)
+}
+
+func TestFeatureClientPipeDrainBuffer(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	assert.NoError(t, err)
+
+	wg.Wait()
+
+	data := make([]byte, 2)
+
+	n, err := conn.Read(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.Equal(t, []byte("he"), data)
+
+	d2 := make([]byte, 2)
+
+	n, err = conn.Read(d2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.Equal(t, []byte("ll"), d2)
+
+	d3 := make([]byte, 1)
+
+	n, err = conn.Read(d3)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	assert.Equal(t, []byte("o"), d3)
+}
+
+func TestFeatureClientPipeCopy(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+
+	errs := make(chan error, 1)
+
+	go func() {
+		conn, err := fc.Clone().ListenPipe("a")
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		defer conn.Close()
+
+		// a partial read leaves some of the message buffered for WriteTo
+		small := make([]byte, 3)
+
+		_, err = io.ReadFull(conn, small)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		var buf bytes.Buffer
+
+		buf.Write(small)
+
+		_, err = io.Copy(&buf, conn)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		_, err = io.Copy(conn, &buf)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		errs <- conn.CloseWrite()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipeTimeout("a", 5*time.Second)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	n, err := io.Copy(conn, bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	err = conn.CloseWrite()
+	require.NoError(t, err)
+
+	var echoed bytes.Buffer
+
+	_, err = io.Copy(&echoed, conn)
+	require.NoError(t, err)
+
+	assert.NoError(t, <-errs)
+	assert.Equal(t, data, echoed.Bytes())
+}
+
+func TestFeatureClientPipePrependBufferInOneCall(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		conn.Write([]byte("hello"))
+		conn.Write([]byte("world"))
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	assert.NoError(t, err)
+
+	wg.Wait()
+
+	data := make([]byte, 2)
+
+	n, err := conn.Read(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.Equal(t, []byte("he"), data)
+
+	d2 := make([]byte, 2)
+
+	n, err = conn.Read(d2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.Equal(t, []byte("ll"), d2)
+
+	d3 := make([]byte, 6)
+
+	n, err = conn.Read(d3)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+
+	assert.Equal(t, []byte("oworld"), d3)
+}
+
+func TestFeatureClientPipeReadMultipleMessages(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	latch := make(chan bool)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		conn.Write([]byte("hello"))
+		conn.Write([]byte("world"))
+		<-latch
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	assert.NoError(t, err)
+
+	data := make([]byte, 20)
+
+	n, err := conn.Read(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+
+	assert.Equal(t, []byte("helloworld"), data[:n])
+
+	latch <- true
+
+	wg.Wait()
+}
+
+func TestFeatureClientPipeReadMultipleMessagesThenClose(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		conn.Write([]byte("hello"))
+		conn.Write([]byte("world"))
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	assert.NoError(t, err)
+
+	wg.Wait()
+
+	data := make([]byte, 20)
+
+	n, err := conn.Read(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+
+	assert.Equal(t, []byte("helloworld"), data[:n])
+
+	// The close that followed them is reported next
+	n, err = conn.Read(data)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestFeatureClientPipeReadDeadline(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		time.Sleep(100 * time.Millisecond)
+		conn.Write([]byte("1"))
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	defer conn.Close()
+
+	assert.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	data := make([]byte, 1)
+
+	n, err := conn.Read(data)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ETimeout, err)
+
+	wg.Wait()
+}
+
+func TestFeatureClientPipeReadDeadlineIsNetTimeout(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		conn.Write([]byte("hello"))
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc2.ConnectPipe("a")
+	defer conn.Close()
+
+	assert.NoError(t, err)
+
+	data := make([]byte, 2)
+
+	n, err := conn.Read(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	conn.SetDeadline(time.Now().Add(-1 * time.Second))
+
+	n, err = conn.Read(data)
+	assert.NoError(t, err, "buffered data was not returned")
+	assert.Equal(t, 2, n)
+
+	n, err = conn.Read(data)
+	assert.NoError(t, err, "buffered data was not returned")
+	assert.Equal(t, 1, n)
+
+	done := make(chan error)
+
+	go func() {
+		_, err := conn.Read(data)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if nerr, ok := err.(net.Error); assert.True(t, ok, "not a net.Error") {
+			assert.True(t, nerr.Timeout())
+		}
+	case <-time.Tick(1 * time.Second):
+		t.Fatal("read ignored expired deadline")
+	}
+
+	wg.Wait()
+}
+
+// Storage whose pushes hang while stalled, like a broker that has
+// stopped keeping up
+type stallingStorage struct {
+	Storage
+
+	lock  sync.Mutex
+	stall chan struct{}
+}
+
+func (s *stallingStorage) Push(name string, msg *Message) error {
+	s.lock.Lock()
+	stall := s.stall
+	s.lock.Unlock()
+
+	if stall != nil {
+		<-stall
+	}
+
+	return s.Storage.Push(name, msg)
+}
+
+func (s *stallingStorage) setStalled(stalled bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if stalled && s.stall == nil {
+		s.stall = make(chan struct{})
+	} else if !stalled && s.stall != nil {
+		close(s.stall)
+		s.stall = nil
+	}
+}
+
+func TestFeatureClientPipeWriteDeadline(t *testing.T) {
+	st := &stallingStorage{Storage: NewMemRegistry()}
+
+	serv, err := NewService(cPort, st)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	listened := make(chan *PipeConn)
+
+	go func() {
+		conn, _ := fc.ListenPipe("a")
+		listened <- conn
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc2.ConnectPipe("a")
+	require.NoError(t, err)
+
+	other := <-listened
+	require.NotNil(t, other)
+
+	st.setStalled(true)
+
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+
+	start := time.Now()
+
+	n, err := conn.Write([]byte("hello"))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ETimeout, err)
+
+	ne, ok := err.(net.Error)
+	if assert.True(t, ok) {
+		assert.True(t, ne.Timeout())
+	}
+
+	assert.True(t, time.Since(start) < 2*time.Second, "write wasn't bounded by the deadline")
+
+	// once passed, the deadline fails writes without trying the broker
+	n, err = conn.Write([]byte("hello"))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ETimeout, err)
+
+	st.setStalled(false)
+
+	conn.SetDeadline(time.Time{})
+
+	n, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	conn.Close()
+	other.Close()
+}
+
+func TestFeatureClientPipeReadMismatchedBufferSizes(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	payload := make([]byte, 10000)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+
+	for _, size := range []int{1, 333, 700, 4096, 20000} {
+		var wg sync.WaitGroup
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _ := fc.ListenPipe("a")
+
+			for i := 0; i < len(payload); i += 700 {
+				end := i + 700
+				if end > len(payload) {
+					end = len(payload)
+				}
+
+				conn.Write(payload[i:end])
+			}
+
+			conn.Close()
+		}()
+
+		runtime.Gosched()
+
+		conn, err := fc2.ConnectPipe("a")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		var got []byte
+
+		buf := make([]byte, size)
+
+		for {
+			n, err := conn.Read(buf)
+			got = append(got, buf[:n]...)
+
+			if err == io.EOF {
+				break
+			}
+
+			if !assert.NoError(t, err) {
+				break
+			}
+		}
+
+		assert.True(t, bytes.Equal(payload, got), "stream corrupted with buffer size %d", size)
+
+		conn.Close()
+		wg.Wait()
+	}
+}
+
+func TestFeatureClientPipeCloseAbandonsMailbox(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		conn.Write([]byte("hello"))
+		conn.Write([]byte("world"))
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	assert.NoError(t, err)
+
+	wg.Wait()
+
+	conn.Close()
+
+	err = fc.Push(conn.ownM, Msg("test"))
+	assert.Error(t, err)
+}
+
+func TestFeatureClientPipeCloseAfterWrites(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var expected []byte
+
+	for i := 0; i < 50; i++ {
+		expected = append(expected, []byte(fmt.Sprintf("chunk %d;", i))...)
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		conn.MaxMessageSize = 8
+		conn.Write(expected)
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc2.ConnectPipe("a")
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	wg.Wait()
+
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, data)
+}
+
+func TestFeatureClientPipeLinger(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	listened := make(chan *PipeConn)
+
+	go func() {
+		conn, _ := fc.ListenPipe("a")
+		listened <- conn
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc2.ConnectPipe("a")
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	other := <-listened
+	require.NotNil(t, other)
+
+	other.Linger = 5 * time.Second
+
+	_, err = other.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	closed := make(chan struct{})
+
+	go func() {
+		other.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close didn't wait for the peer to read")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close kept lingering after the peer read")
+	}
+
+	// A peer that never reads only holds Close up for Linger
+
+	go func() {
+		conn, _ := fc.ListenPipe("b")
+		listened <- conn
+	}()
+
+	runtime.Gosched()
+
+	conn2, err := fc2.ConnectPipe("b")
+	require.NoError(t, err)
+
+	defer conn2.Close()
+
+	other = <-listened
+	require.NotNil(t, other)
+
+	other.Linger = 100 * time.Millisecond
+
+	_, err = other.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	other.Close()
+
+	assert.True(t, time.Since(start) < 2*time.Second, "Close lingered past Linger")
+}
+
+func TestFeatureClientPipeSendBulk(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		n, err := conn.SendBulk(bytes.NewReader([]byte("1")))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	defer conn.Close()
+
+	assert.NoError(t, err)
+
+	data := make([]byte, 1)
+
+	n, err := conn.Read(data)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []byte("1"), data)
+
+	wg.Wait()
+}
+
+func TestFeatureClientPipeSendBulkBuffered(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		conn.SendBulk(bytes.NewReader([]byte("hello")))
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	defer conn.Close()
+
+	assert.NoError(t, err)
+
+	data := make([]byte, 1)
+
+	n, err := conn.Read(data)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []byte("h"), data)
+
+	d2 := make([]byte, 5)
+
+	n, err = conn.Read(d2)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("ello"), d2[:n])
+
+	wg.Wait()
+}
+
+func TestFeatureClientPipeSendBulkSwitchesBack(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		conn.SendBulk(bytes.NewReader([]byte("hello")))
+		conn.Write([]byte("world"))
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	defer conn.Close()
+
+	assert.NoError(t, err)
+
+	data := make([]byte, 1)
+
+	n, err := conn.Read(data)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []byte("h"), data)
+
+	d2 := make([]byte, 5)
+
+	n, err = conn.Read(d2)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("ello"), d2[:n])
+
+	n, err = conn.Read(d2)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("world"), d2)
+
+	wg.Wait()
+}
+
+func TestFeatureClientPipeSendBulkEncrypted(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.ListenPipe("a")
+		n, err := conn.SendBulk(bytes.NewReader([]byte("hello")))
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+		conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc2.ConnectPipe("a")
+	defer conn.Close()
+
+	assert.NoError(t, err)
+
+	data := make([]byte, 1)
+
+	n, err := conn.Read(data)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []byte("h"), data)
+
+	d2 := make([]byte, 4)
+
+	n, err = conn.bulk.(*streamWrapper).Conn.Read(d2)
+	assert.Equal(t, 4, n)
+	assert.NotEqual(t, []byte("ello"), d2)
+	assert.NotEqual(t, d2[1], d2[2])
+
+	wg.Wait()
+}
+
+func TestFeatureClientPipeDetectsClosure(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		lp, _ := fc.ListenPipe("a")
+		lp.Write([]byte("hello"))
+		fc.Client.conn.Close()
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc2.ConnectPipe("a")
+	assert.NoError(t, err)
+
+	data := make([]byte, 5)
+
+	_, err = conn.Read(data)
+	assert.NoError(t, err)
+
+	done := make(chan error)
+
+	go func() {
+		debugf("read after closed\n")
+		_, err := conn.Read(data)
+		done <- err
+	}()
+
+	select {
+	case <-time.Tick(1 * time.Second):
+		t.Fatal("read did not detect closure of other side")
+	case err = <-done:
+		assert.Equal(t, err, io.EOF)
+	}
+}
+
+func TestFeatureClientPipeListenerServesHTTP(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	l, err := NewPipeListener(fc, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	served := make(chan error)
+
+	go func() {
+		served <- http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("hello " + req.URL.Path))
+		}))
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return fc2.ConnectPipe("web")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	for _, path := range []string{"/a", "/b"} {
+		resp, err := client.Get("http://web" + path)
+		if !assert.NoError(t, err) {
+			break
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.NoError(t, err)
+		assert.Equal(t, "hello "+path, string(body))
+	}
+
+	l.Close()
+
+	select {
+	case err := <-served:
+		assert.Error(t, err)
+	case <-time.Tick(1 * time.Second):
+		t.Fatal("Close did not stop Accept")
+	}
+}
+
+func TestFeatureClientPipeListenerCloseAll(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	l, err := NewPipeListener(fc, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	accepted := make(chan net.Conn, 3)
+	acceptErr := make(chan error, 1)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	var peers []*PipeConn
+
+	for i := 0; i < 3; i++ {
+		conn, err := fc2.ConnectPipe("web")
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		peers = append(peers, conn)
+	}
+
+	var served []net.Conn
+
+	for i := 0; i < 3; i++ {
+		served = append(served, <-accepted)
+	}
+
+	// one closed by its server is no longer tracked
+	served[0].Close()
+
+	l.lock.Lock()
+	assert.Equal(t, 2, len(l.conns))
+	l.lock.Unlock()
+
+	assert.NoError(t, l.CloseAll())
+
+	select {
+	case err := <-acceptErr:
+		assert.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("CloseAll did not stop Accept")
+	}
+
+	for _, peer := range peers {
+		peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		_, err := peer.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	}
+
+	l.lock.Lock()
+	assert.Equal(t, 0, len(l.conns))
+	l.lock.Unlock()
+}
+
+func TestFeatureClientPipeTransport(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	l, err := NewPipeListener(fc, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	defer l.Close()
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	var (
+		lock    sync.Mutex
+		remotes = map[string]bool{}
+	)
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		remotes[req.RemoteAddr] = true
+		lock.Unlock()
+
+		if req.URL.Path == "/stuck" {
+			select {
+			case <-stuck:
+			case <-req.Context().Done():
+			}
+
+			return
+		}
+
+		w.Write([]byte("hello " + req.URL.Path))
+	}))
+
+	pt := NewPipeTransport(fc2, "")
+	defer pt.CloseIdleConnections()
+
+	client := &http.Client{Transport: pt}
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		resp, err := client.Get("http://web" + path)
+		if !assert.NoError(t, err) {
+			break
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.NoError(t, err)
+		assert.Equal(t, "hello "+path, string(body))
+	}
+
+	lock.Lock()
+	assert.Equal(t, 1, len(remotes), "connection was not reused")
+	lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", "http://web/stuck", nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	_, err = client.Do(req.WithContext(ctx))
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "request ignored its context")
+}
+
+func TestFeatureClientReconnect(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	fc, err := DialWithOptions(cPort, WithReconnect(ReconnectPolicy{
+		MinBackoff: 10 * time.Millisecond,
+	}))
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.EphemeralDeclare("e")
+	require.NoError(t, err)
+
+	serv.Close()
+
+	serv, err = NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c.Close()
+
+	err = c.Declare("a")
+	require.NoError(t, err)
+
+	msg := Msg([]byte("hello"))
+
+	err = c.Push("a", msg)
+	require.NoError(t, err)
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, msg.Body, del.Message.Body)
+
+	err = fc.Push("e", msg)
+	assert.NoError(t, err, "ephemeral mailbox was not restored")
+}
+
+func TestFeatureClientReconnectIgnoresTimeouts(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := DialWithOptions(cPort, WithReconnect(ReconnectPolicy{
+		MinBackoff: 10 * time.Millisecond,
+	}))
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	gen := fc.Client.currentGeneration()
+	calls := 0
+
+	err = fc.withReconnect(func() error {
+		calls++
+		return ETimeout
+	})
+
+	assert.Equal(t, ETimeout, err)
+	assert.Equal(t, 1, calls, "timeout was retried")
+	assert.Equal(t, gen, fc.Client.currentGeneration(), "timeout caused a redial")
+}
+
+func TestFeatureClientReconnectCanceled(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	fc, err := DialWithOptions(cPort, WithReconnect(ReconnectPolicy{
+		MinBackoff: time.Minute,
+	}))
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	serv.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(done)
+	}()
+
+	start := time.Now()
+
+	del, err := fc.LongPollCancelable("a", time.Minute, done)
+	assert.NoError(t, err)
+	assert.Nil(t, del)
+	assert.True(t, time.Since(start) < 5*time.Second, "cancel waited out the backoff")
+}
+
+func TestFeatureClientPing(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Ping(time.Second)
+	require.NoError(t, err)
+
+	reg := serv.Registry.(*Registry)
+
+	reg.Lock()
+	left := len(reg.mailboxes)
+	reg.Unlock()
+
+	assert.Equal(t, 0, left, "ping left a mailbox behind")
+
+	serv.Close()
+
+	err = fc.Ping(time.Second)
+	assert.Error(t, err)
+}
+
+type testJSONReq struct {
+	A, B int
+}
+
+type testJSONResp struct {
+	Sum int
+}
+
+func TestFeatureClientRequestJSON(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", JSONHandler(func(req *testJSONReq) (*testJSONResp, error) {
+		if req.A < 0 {
+			return nil, fmt.Errorf("negative")
+		}
+
+		return &testJSONResp{Sum: req.A + req.B}, nil
+	}))
+
+	var resp testJSONResp
+
+	err = fc.RequestJSON("a", &testJSONReq{A: 1, B: 2}, &resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, resp.Sum)
+
+	err = fc.RequestJSON("a", &testJSONReq{A: -1}, &resp)
+	assert.Equal(t, &RemoteError{"negative"}, err)
+
+	stats, err := fc.Client.Stats()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.InFlight, "replies were left unacked")
+
+	_, err = fc.Request("a", Msg([]byte("not json")))
+	require.Error(t, err)
+
+	assert.Contains(t, err.Error(), "unable to decode body")
+}
+
+func TestFeatureClientRequestJSONDecodeError(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		return Msg([]byte("not json"))
+	}))
+
+	var resp testJSONResp
+
+	err = fc.RequestJSON("a", &testJSONReq{A: 1, B: 2}, &resp)
+
+	_, ok := err.(*DecodeError)
+	assert.True(t, ok, "error was not a DecodeError")
+}
+
+func TestFeatureClientRequestTypedUsesCodec(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.SetCodec(GobCodec)
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	var contentType string
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		contentType = msg.ContentType
+		return TypedHandler(GobCodec, func(req testJSONReq) (testJSONResp, error) {
+			return testJSONResp{Sum: req.A + req.B}, nil
+		}).HandleMessage(msg)
+	}))
+
+	var resp testJSONResp
+
+	err = fc.RequestTyped("a", &testJSONReq{A: 1, B: 2}, &resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, resp.Sum)
+	assert.Equal(t, "application/x-gob", contentType)
+
+	stats, err := fc.Client.Stats()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.InFlight, "reply was left unacked")
+}
+
+func TestFeatureClientPublishSubscribe(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	var recs []*Receiver
+
+	for i := 0; i < 3; i++ {
+		sub, err := Dial(cPort)
+		if err != nil {
+			panic(err)
+		}
+
+		defer sub.Close()
+
+		rec, err := sub.Subscribe("events/+")
+		require.NoError(t, err)
+
+		defer rec.Close()
+
+		recs = append(recs, rec)
+	}
+
+	gone, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = gone.Subscribe("events/+")
+	require.NoError(t, err)
+
+	gone.Close()
+
+	err = fc.Publish("events/start", Msg([]byte("hello")))
+	require.NoError(t, err)
+
+	for _, rec := range recs {
+		select {
+		case del := <-rec.Channel:
+			assert.Equal(t, []byte("hello"), del.Message.Body)
+			del.Ack()
+		case <-time.After(time.Second):
+			t.Fatal("subscriber did not get the message")
+		}
+	}
+
+	reg := serv.Registry.(*Registry)
+
+	reg.Lock()
+	subs := len(reg.subscriptions)
+	reg.Unlock()
+
+	assert.Equal(t, 3, subs)
+}
+
+func TestFeatureClientRequestPassesHeaders(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		trace, _ := msg.HeaderString("trace-id")
+
+		ret := Msg([]byte("ok"))
+		ret.AddHeader("trace-id", trace)
+
+		return ret
+	}))
+
+	msg := Msg([]byte("hello"))
+	msg.AddHeader("trace-id", "abc123")
+
+	del, err := fc.Request("a", msg)
+	require.NoError(t, err)
+
+	trace, ok := del.Message.HeaderString("trace-id")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", trace)
+}
+
+func TestFeatureClientRequestAll(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		err = fc.Declare(name)
+		require.NoError(t, err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		reply := []byte("from " + name)
+
+		go fc.Clone().HandleRequests(name, HandlerFunc(func(msg *Message) *Message {
+			return Msg(reply)
+		}))
+	}
+
+	dels, err := fc.RequestAll([]string{"a", "b"}, Msg("hello"), time.Second)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(dels))
+
+	assert.Equal(t, []byte("from a"), dels[0].Message.Body)
+	assert.Equal(t, []byte("from b"), dels[1].Message.Body)
+
+	dels, err = fc.RequestAll([]string{"a", "b", "c"}, Msg("hello"), 100*time.Millisecond)
+	require.Error(t, err)
+
+	assert.Equal(t, 2, len(dels))
+
+	perr, ok := err.(*PartialError)
+	require.True(t, ok, "error was not a PartialError")
+
+	assert.Equal(t, map[string]error{"c": ETimeout}, perr.Errors)
+
+	fc.lock.Lock()
+	local := fc.localMailbox
+	fc.lock.Unlock()
+
+	assert.Equal(t, "", local, "reply mailbox was not cleaned up")
+}
+
+func TestFeatureClientRequestAsync(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		return Msg(append([]byte("re: "), msg.Body...))
+	}))
+
+	var futures []*RequestFuture
+
+	for i := 0; i < 5; i++ {
+		f, err := fc.RequestAsync("a", Msg(fmt.Sprintf("%d", i)))
+		require.NoError(t, err)
+
+		futures = append(futures, f)
+	}
+
+	for i, f := range futures {
+		del, err := f.Wait(context.Background())
+		require.NoError(t, err)
+
+		assert.Equal(t, fmt.Sprintf("re: %d", i), string(del.Message.Body))
+
+		again, err := f.Wait(context.Background())
+		require.NoError(t, err)
+
+		assert.Equal(t, del, again)
+	}
+
+	// Already expired, so it isn't sent
+	past := time.Now().Add(-time.Second)
+
+	_, err = fc.RequestAsync("a", &Message{Body: []byte("late"), Expiry: &past})
+	assert.Equal(t, EExpired, err)
+}
+
+func TestFeatureClientRequestAsyncCancel(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	f, err := fc.RequestAsync("a", Msg("hello"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = f.Wait(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	f.Cancel()
+
+	_, err = f.Wait(context.Background())
+	assert.Equal(t, context.Canceled, err)
+
+	fc.lock.Lock()
+	local := fc.localMailbox
+	fc.lock.Unlock()
+
+	assert.Equal(t, "", local, "reply mailbox was not cleaned up")
+}
+
+func TestFeatureClientPipeCloseWrite(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	var _ CloseWriter = &PipeConn{}
+
+	go func() {
+		lp, err := fc.ListenPipe("a")
+		if err != nil {
+			return
+		}
+
+		defer lp.Close()
+
+		req, _ := ioutil.ReadAll(lp)
+		lp.Write(append([]byte("re: "), req...))
+	}()
+
+	conn, err := fc2.ConnectPipe("a")
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	err = conn.CloseWrite()
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("more"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	data := make([]byte, 9)
+
+	_, err = io.ReadFull(conn, data)
+	require.NoError(t, err)
+
+	assert.Equal(t, "re: hello", string(data))
+}
+
+func TestFeatureClientPipeWriteChunksLargeWrites(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	payload := make([]byte, 4*1024*1024)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+
+	go func() {
+		lp, err := fc.ListenPipe("a")
+		if err != nil {
+			return
+		}
+
+		lp.Write(payload)
+		lp.CloseWrite()
+	}()
+
+	conn, err := fc2.ConnectPipe("a")
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	got, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+
+	assert.True(t, bytes.Equal(payload, got), "payload was corrupted")
+}
+
+func TestFeatureClientPipeWriteHonorsMaxMessageSize(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("peer")
+	require.NoError(t, err)
+
+	pc := &PipeConn{fc: fc, pairM: "peer", MaxMessageSize: 4}
+
+	n, err := pc.Write([]byte("hello world"))
+	require.NoError(t, err)
+
+	assert.Equal(t, 11, n)
+
+	var bodies []string
+
+	for {
+		del, err := fc.Poll("peer")
+		require.NoError(t, err)
+
+		if del == nil {
+			break
+		}
+
+		bodies = append(bodies, string(del.Message.Body))
+		del.Ack()
+	}
+
+	assert.Equal(t, []string{"hell", "o wo", "rld"}, bodies)
+}
+
+func TestFeatureClientPipeReadReordersFrames(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("own")
+	require.NoError(t, err)
+
+	frame := func(seq uint64, typ, body string) {
+		msg := &Message{Type: typ, Body: []byte(body)}
+		msg.AddHeader(cPipeSeqHeader, seq)
+
+		err := fc.Push("own", msg)
+		require.NoError(t, err)
+	}
+
+	frame(2, "", "world")
+	frame(1, "", "hello ")
+	frame(1, "", "hello ")
+	frame(4, "pipe/shutdown-write", "")
+	frame(3, "", "!")
+	frame(2, "", "world")
+
+	pc := &PipeConn{fc: fc, ownM: "own"}
+
+	got, err := ioutil.ReadAll(pc)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello world!", string(got))
+}
+
+func TestFeatureClientPipeKeepalive(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	listened := make(chan *PipeConn, 1)
+
+	go func() {
+		lp, err := fc.ListenPipe("a")
+		if err != nil {
+			return
+		}
+
+		listened <- lp
+	}()
+
+	conn, err := fc2.ConnectPipe("a")
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	lp := <-listened
+
+	lp.SetKeepalive(20 * time.Millisecond)
+	conn.SetKeepalive(20 * time.Millisecond)
+
+	// Neither side reads, but pings are still answered
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	data := make([]byte, 5)
+
+	_, err = io.ReadFull(lp, data)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello", string(data))
+
+	// Stop the listening side answering pings without closing the pipe
+	lp.SetKeepalive(0)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Equal(t, EPipeDead, err)
+
+	_, err = conn.Read(data)
+	assert.Equal(t, EPipeDead, err)
+}
+
+func TestFeatureClientPipeWriteBuffer(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("peer")
+	require.NoError(t, err)
+
+	bodies := func() []string {
+		var out []string
+
+		for {
+			del, err := fc.Poll("peer")
+			require.NoError(t, err)
+
+			if del == nil {
+				return out
+			}
+
+			out = append(out, del.Message.Type+":"+string(del.Message.Body))
+			del.Ack()
+		}
+	}
+
+	pc := &PipeConn{fc: fc, pairM: "peer", ownM: "own", WriteBuffer: 8}
+
+	for _, s := range []string{"a", "b", "c"} {
+		n, err := pc.Write([]byte(s))
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+
+	assert.Equal(t, 0, len(bodies()), "writes were not buffered")
+
+	err = pc.Flush()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{":abc"}, bodies())
+
+	_, err = pc.Write([]byte("0123456789"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{":0123456789"}, bodies(), "full buffer was not flushed")
+
+	pc.FlushDelay = 10 * time.Millisecond
+
+	_, err = pc.Write([]byte("later"))
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, []string{":later"}, bodies(), "FlushDelay did not flush")
+
+	_, err = pc.Write([]byte("bye"))
+	require.NoError(t, err)
+
+	pc.Close()
+
+	assert.Equal(t, []string{":bye", "pipe/close:"}, bodies(), "Close did not flush first")
+}
+
+func TestFeatureClientRequestReturnsLocalMailboxError(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	serv.Close()
+
+	_, err = fc.LocalMailboxE()
+	assert.Error(t, err)
+
+	_, err = fc.Request("a", Msg("hello"))
+	assert.Error(t, err)
+}
+
+func TestFeatureClientReceiveReject(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	for _, name := range []string{"a", "dlq"} {
+		err = fc.Declare(name)
+		require.NoError(t, err)
+	}
+
+	err = fc.Push("a", Msg("first"))
+	require.NoError(t, err)
+
+	rec := fc.ReceiveWithOpts("a", ReceiveOpts{DeadLetterQueue: "dlq"})
+	defer rec.Close()
+
+	next := func() *Delivery {
+		select {
+		case del := <-rec.Channel:
+			return del
+		case <-time.After(time.Second):
+			t.Fatal("no delivery")
+			return nil
+		}
+	}
+
+	del := next()
+	assert.Equal(t, "first", string(del.Message.Body))
+
+	// requeued messages are delivered again
+	err = del.Reject(true)
+	require.NoError(t, err)
+
+	del = next()
+	assert.Equal(t, "first", string(del.Message.Body))
+
+	// rejected ones go to the dead letter queue instead
+	err = del.Reject(false)
+	require.NoError(t, err)
+
+	select {
+	case <-rec.Channel:
+		t.Fatal("rejected message was delivered again")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	dead, err := fc.Poll("dlq")
+	require.NoError(t, err)
+	require.NotNil(t, dead)
+
+	assert.Equal(t, "first", string(dead.Message.Body))
+}
+
+func TestFeatureClientHandleRequestsReject(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	for _, name := range []string{"a", "dlq"} {
+		err = fc.Declare(name)
+		require.NoError(t, err)
+	}
+
+	var (
+		lock     sync.Mutex
+		attempts int
+	)
+
+	h := HandleErrors(ErrorHandlerFunc(func(msg *Message) (*Message, error) {
+		if string(msg.Body) == "poison" {
+			return nil, &RejectError{Err: fmt.Errorf("can't handle")}
+		}
+
+		lock.Lock()
+		attempts++
+		n := attempts
+		lock.Unlock()
+
+		if n == 1 {
+			return RejectMsg(true), nil
+		}
+
+		return Msg("done"), nil
+	}))
+
+	go fc.Clone().HandleRequestsWithOpts(context.Background(), "a", h,
+		HandleRequestsOpts{DeadLetterQueue: "dlq"})
+
+	del, err := fc.RequestTimeout("a", Msg("hello"), time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "done", string(del.Message.Body))
+	assert.Equal(t, 2, attempts)
+
+	_, err = fc.RequestTimeout("a", Msg("poison"), 100*time.Millisecond)
+	assert.Equal(t, ETimeout, err)
+
+	dead, err := fc.Poll("dlq")
+	require.NoError(t, err)
+	require.NotNil(t, dead)
+
+	assert.Equal(t, "poison", string(dead.Message.Body))
+}
+
+func TestFeatureClientHandleRequestsMaxAttempts(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	for _, name := range []string{"a", "dlq"} {
+		err = fc.Declare(name)
+		require.NoError(t, err)
+	}
+
+	var (
+		lock     sync.Mutex
+		attempts int
+	)
+
+	h := HandleErrors(ErrorHandlerFunc(func(msg *Message) (*Message, error) {
+		lock.Lock()
+		attempts++
+		lock.Unlock()
+
+		return nil, fmt.Errorf("poison")
+	}))
+
+	go fc.Clone().HandleRequestsWithOpts(context.Background(), "a", h,
+		HandleRequestsOpts{DeadLetterQueue: "dlq", MaxAttempts: 3})
+
+	_, err = fc.RequestTimeout("a", Msg("hello"), time.Second)
+	assert.Equal(t, &RemoteError{"poison"}, err)
+
+	lock.Lock()
+	assert.Equal(t, 3, attempts)
+	lock.Unlock()
+
+	dead, err := fc.Poll("dlq")
+	require.NoError(t, err)
+	require.NotNil(t, dead)
+
+	assert.Equal(t, "hello", string(dead.Message.Body))
+
+	n, ok := dead.Message.headerUint(AttemptsHeader)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), n)
+
+	more, err := fc.Poll("dlq")
+	require.NoError(t, err)
+	assert.Nil(t, more)
+}
+
+func TestFeatureClientDeliveryCount(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	err = fc.Push("a", Msg("hello"))
+	require.NoError(t, err)
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, 1, del.DeliveryCount)
+	assert.False(t, del.Redelivered())
+
+	err = del.Nack()
+	require.NoError(t, err)
+
+	del, err = fc.LongPoll("a", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, 2, del.DeliveryCount)
+	assert.True(t, del.Redelivered())
+}
+
+func TestFeatureClientHandleRequestsMaxAttemptsCountsRedeliveries(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	for _, name := range []string{"a", "dlq"} {
+		err = fc.Declare(name)
+		require.NoError(t, err)
+	}
+
+	err = fc.Push("a", Msg("hello"))
+	require.NoError(t, err)
+
+	// two consumers that took the message and gave it back
+	for i := 0; i < 2; i++ {
+		del, err := fc.Poll("a")
+		require.NoError(t, err)
+		require.NotNil(t, del)
+
+		err = del.Nack()
+		require.NoError(t, err)
+	}
+
+	var (
+		lock     sync.Mutex
+		attempts int
+	)
+
+	h := HandleErrors(ErrorHandlerFunc(func(msg *Message) (*Message, error) {
+		lock.Lock()
+		attempts++
+		lock.Unlock()
+
+		return nil, fmt.Errorf("poison")
+	}))
+
+	go fc.Clone().HandleRequestsWithOpts(context.Background(), "a", h,
+		HandleRequestsOpts{DeadLetterQueue: "dlq", MaxAttempts: 3})
+
+	dead, err := fc.LongPoll("dlq", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, dead)
+
+	n, ok := dead.Message.headerUint(AttemptsHeader)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), n)
+
+	lock.Lock()
+	assert.Equal(t, 1, attempts)
+	lock.Unlock()
+}
+
+func TestFeatureClientRequestStream(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleStreams("a", StreamHandlerFunc(func(ctx context.Context, req *Message, send func(*Message) error) error {
+		n, err := strconv.Atoi(string(req.Body))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			err := send(Msg(strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+		}
+
+		if n == 1 {
+			return errors.New("only one")
+		}
+
+		return nil
+	}))
+
+	rec, err := fc.RequestStream("a", Msg("3"))
+	require.NoError(t, err)
+
+	var got []string
+
+	for del := range rec.Channel {
+		got = append(got, string(del.Message.Body))
+	}
+
+	assert.NoError(t, rec.Error)
+	assert.Equal(t, []string{"0", "1", "2"}, got)
+
+	rec, err = fc.RequestStream("a", Msg("1"))
+	require.NoError(t, err)
+
+	got = nil
+
+	for del := range rec.Channel {
+		got = append(got, string(del.Message.Body))
+	}
+
+	assert.Equal(t, &RemoteError{"only one"}, rec.Error)
+	assert.Equal(t, []string{"0"}, got)
+}
+
+func TestFeatureClientRequestClientStream(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	h := ClientStreamHandlerFunc(func(ctx context.Context, recv func() (*Message, error)) (*Message, error) {
+		var parts []string
+
+		for {
+			msg, err := recv()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			if string(msg.Body) == "bad" {
+				return nil, errors.New("bad part")
+			}
+
+			parts = append(parts, string(msg.Body))
+		}
+
+		return Msg(strings.Join(parts, ",")), nil
+	})
+
+	// competing handlers, each stream must still go to just one
+	for i := 0; i < 3; i++ {
+		go fc.Clone().HandleClientStreams("a", h)
+	}
+
+	cs, err := fc.RequestClientStream("a")
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		err = cs.Send(Msg(strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+
+	del, err := cs.CloseAndRecv()
+	require.NoError(t, err)
+
+	assert.Equal(t, "0,1,2,3,4", string(del.Message.Body))
+	assert.NoError(t, del.Ack())
+
+	assert.Equal(t, EClosed, cs.Send(Msg("late")))
+
+	cs, err = fc.RequestClientStream("a")
+	require.NoError(t, err)
+
+	err = cs.Send(Msg("bad"))
+	require.NoError(t, err)
+
+	_, err = cs.CloseAndRecv()
+	assert.Equal(t, &RemoteError{"bad part"}, err)
+}
+
+func TestFeatureClientMerge(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.PollInterval = 100 * time.Millisecond
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	err = fc.Declare("b")
+	require.NoError(t, err)
+
+	fc.Push("a", Msg("from a"))
+	fc.Push("b", Msg("from b"))
+
+	rec := Merge(fc.Clone().Receive("a"), fc.Clone().Receive("b"))
+
+	var got []string
+
+	for i := 0; i < 2; i++ {
+		select {
+		case del := <-rec.Channel:
+			got = append(got, string(del.Message.Body))
+			del.Ack()
+		case <-time.After(time.Second):
+			t.Fatal("merged receiver didn't deliver")
+		}
+	}
+
+	sort.Strings(got)
+	assert.Equal(t, []string{"from a", "from b"}, got)
+
+	rec.Close()
+	rec.Wait()
+
+	_, ok := <-rec.Channel
+	assert.False(t, ok)
+	assert.NoError(t, rec.Error)
+
+	err = fc.Declare("c")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleStreams("c", StreamHandlerFunc(func(ctx context.Context, req *Message, send func(*Message) error) error {
+		return errors.New("broken")
+	}))
+
+	stream, err := fc.RequestStream("c", Msg("hello"))
+	require.NoError(t, err)
+
+	rec = Merge(fc.Clone().Receive("a"), stream)
+
+	for range rec.Channel {
+	}
+
+	assert.Equal(t, &RemoteError{"broken"}, rec.Error)
+}
+
+func TestFeatureClientCompression(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.SetCompression(GzipCompressor, 100)
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	large := bytes.Repeat([]byte("compress me "), 100)
+
+	err = fc.Push("a", &Message{Body: large})
+	require.NoError(t, err)
+
+	// what's on the wire, as an old client would see it
+	raw, err := fc.Client.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, raw)
+
+	assert.Equal(t, "gzip", raw.Message.ContentEncoding)
+	assert.True(t, len(raw.Message.Body) < len(large))
+
+	raw.Nack()
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, "", del.Message.ContentEncoding)
+	assert.Equal(t, large, del.Message.Body)
+
+	del.Ack()
+
+	err = fc.Push("a", Msg("small"))
+	require.NoError(t, err)
+
+	raw, err = fc.Client.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, raw)
+
+	assert.Equal(t, "", raw.Message.ContentEncoding)
+	assert.Equal(t, "small", string(raw.Message.Body))
+
+	raw.Ack()
+
+	// messages from clients that don't compress are untouched
+	err = fc.Client.Push("a", &Message{Body: large})
+	require.NoError(t, err)
+
+	del, err = fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, large, del.Message.Body)
+
+	del.Ack()
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		return &Message{Body: append(msg.Body, msg.Body...)}
+	}))
+
+	reply, err := fc.Request("a", &Message{Body: large})
+	require.NoError(t, err)
+
+	assert.Equal(t, append(large, large...), reply.Message.Body)
+}
+
+type signingTransformer struct{}
+
+func (signingTransformer) Encode(body []byte) ([]byte, error) {
+	return append([]byte("signed:"), body...), nil
+}
+
+func (signingTransformer) Decode(body []byte) ([]byte, error) {
+	if !bytes.HasPrefix(body, []byte("signed:")) {
+		return nil, errors.New("bad signature")
+	}
+
+	return body[len("signed:"):], nil
+}
+
+func TestFeatureClientTransformer(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	var log testLogger
+
+	fc.SetLogger(&log)
+	fc.SetTransformer("sign", signingTransformer{})
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	err = fc.Push("a", Msg("hello"))
+	require.NoError(t, err)
+
+	raw, err := fc.Client.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, raw)
+
+	assert.Equal(t, "signed:hello", string(raw.Message.Body))
+
+	name, ok := raw.Message.HeaderString(TransformHeader)
+	assert.True(t, ok)
+	assert.Equal(t, "sign", name)
+
+	raw.Nack()
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, "hello", string(del.Message.Body))
+
+	_, ok = del.Message.GetHeader(TransformHeader)
+	assert.False(t, ok)
+
+	del.Ack()
+
+	// unmarked messages from clients without the transformer pass through
+	err = fc.Client.Push("a", Msg("plain"))
+	require.NoError(t, err)
+
+	del, err = fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, "plain", string(del.Message.Body))
+
+	del.Ack()
+
+	forged := Msg("forged")
+	forged.AddHeader(TransformHeader, "sign")
+
+	err = fc.Client.Push("a", forged)
+	require.NoError(t, err)
+
+	del, err = fc.Poll("a")
+	require.NoError(t, err)
+	assert.Nil(t, del)
+
+	del, err = fc.Client.Poll("a")
+	require.NoError(t, err)
+	assert.Nil(t, del, "undecodable message was not dropped")
+
+	log.lock.Lock()
+	assert.NotEmpty(t, log.lines)
+	log.lock.Unlock()
+}
+
+func TestFeatureClientRequestSession(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	echo := HandlerFunc(func(msg *Message) *Message {
+		return Msg(string(msg.Body))
+	})
+
+	go fc.Clone().HandleRequests("a", echo)
+
+	rs, err := fc.NewRequestSession()
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		del, err := rs.Do("a", Msg(strconv.Itoa(i)), 5*time.Second)
+		require.NoError(t, err)
+
+		assert.Equal(t, strconv.Itoa(i), string(del.Message.Body))
+
+		del.Ack()
+	}
+
+	err = fc.Declare("b")
+	require.NoError(t, err)
+
+	// nobody is handling b yet
+	_, err = rs.Do("b", Msg("stale"), 50*time.Millisecond)
+	assert.Equal(t, ETimeout, err)
+
+	go fc.Clone().HandleRequests("b", HandlerFunc(func(msg *Message) *Message {
+		return Msg(string(msg.Body))
+	}))
+
+	del, err := rs.Do("b", Msg("fresh"), 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "fresh", string(del.Message.Body))
+
+	err = rs.Close()
+	require.NoError(t, err)
+
+	_, err = rs.Do("a", Msg("closed"), time.Second)
+	assert.Equal(t, EClosed, err)
+}
+
+func TestFeatureClientRequestSessionPreparesRequest(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.PollInterval = 50 * time.Millisecond
+
+	clock := newFakeClock()
+	fc.SetClock(clock)
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		return Msg(msg.CorrelationId)
+	}))
+
+	rs, err := fc.NewRequestSession()
+	require.NoError(t, err)
+
+	defer rs.Close()
+
+	del, err := rs.Do("a", &Message{CorrelationId: "mine"}, 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "mine", string(del.Message.Body))
+
+	del.Ack()
+
+	past := clock.Now().Add(-time.Second)
+
+	_, err = rs.Do("a", &Message{Expiry: &past}, 5*time.Second)
+	assert.Equal(t, EExpired, err)
+
+	err = fc.Declare("b")
+	require.NoError(t, err)
+
+	// nobody is handling b, so only the client's clock ends the wait
+	res := make(chan error, 1)
+
+	go func() {
+		_, err := rs.Do("b", Msg("hello"), time.Hour)
+		res <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	clock.Advance(time.Hour)
+
+	select {
+	case err := <-res:
+		assert.Equal(t, ETimeout, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("session request didn't time out")
+	}
+}
+
+func TestFeatureClientHandleRequestsOneWay(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	var log testLogger
+
+	fc.SetLogger(&log)
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	handled := make(chan string, 10)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		handled <- string(msg.Body)
+
+		if string(msg.Body) == "nil" {
+			return nil
+		}
+
+		return Msg("reply")
+	}))
+
+	// no ReplyTo, so nowhere to send the reply
+	err = fc.Push("a", Msg("oneway"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "oneway", <-handled)
+
+	// the handler has nothing to reply with
+	_, err = fc.RequestTimeout("a", Msg("nil"), 100*time.Millisecond)
+	assert.Equal(t, ETimeout, err)
+
+	assert.Equal(t, "nil", <-handled)
+
+	// the loop is still serving requests
+	del, err := fc.RequestTimeout("a", Msg("hello"), 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "reply", string(del.Message.Body))
+	assert.Equal(t, "hello", <-handled)
+
+	left, err := fc.Poll("a")
+	require.NoError(t, err)
+	assert.Nil(t, left, "one way messages were not acked")
+
+	log.lock.Lock()
+	assert.Empty(t, log.lines)
+	log.lock.Unlock()
+}
+
+func TestFeatureClientRequestAck(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		return Msg("reply")
+	}))
+
+	for i := 0; i < 10; i++ {
+		reply, err := fc.RequestAck("a", Msg("hello"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "reply", string(reply.Body))
+	}
+
+	stats, err := fc.Client.Stats()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.InFlight, "replies were left unacked")
+
+	for i := 0; i < 3; i++ {
+		_, err := fc.Request("a", Msg("hello"))
+		require.NoError(t, err)
+	}
+
+	stats, err = fc.Client.Stats()
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, stats.InFlight)
+}
+
+func TestFeatureClientRequestFreshReplyMailbox(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	err = fc.Declare("b")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		return Msg("reply")
+	}))
+
+	before := mailboxCount(serv)
+
+	opts := RequestOpts{FreshReplyMailbox: true}
+
+	del, err := fc.RequestWithOpts(context.Background(), "a", Msg("hello"), opts)
+	require.NoError(t, err)
+
+	assert.Equal(t, "reply", string(del.Message.Body))
+	assert.NoError(t, del.Ack())
+
+	assert.Equal(t, before, mailboxCount(serv), "reply mailbox was not abandoned")
+
+	// nobody is handling b
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = fc.RequestWithOpts(ctx, "b", Msg("hello"), opts)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	assert.Equal(t, before, mailboxCount(serv), "reply mailbox was not abandoned")
+
+	msg := Msg("hello")
+
+	expiry := time.Now().Add(50 * time.Millisecond)
+	msg.Expiry = &expiry
+
+	_, err = fc.RequestWithOpts(context.Background(), "b", msg, opts)
+	assert.Equal(t, EExpired, err)
+}
+
+func TestFeatureClientQueueStats(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	info, err := fc.QueueStats("a")
+	require.NoError(t, err)
+	assert.Equal(t, QueueInfo{}, info)
+
+	fc.Push("a", Msg("first"))
+	fc.Push("a", Msg("second"))
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	info, err = fc.QueueStats("a")
+	require.NoError(t, err)
+	assert.Equal(t, QueueInfo{Pending: 1, InFlight: 1}, info)
+
+	err = fc.Declare("b")
+	require.NoError(t, err)
+
+	go fc.Clone().LongPoll("b", 5*time.Second)
+
+	for i := 0; i < 100; i++ {
+		info, err = fc.QueueStats("b")
+		require.NoError(t, err)
+
+		if info.Consumers == 1 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, 1, info.Consumers)
+
+	fc.Push("b", Msg("wake"))
+
+	_, err = fc.QueueStats("c")
+	assert.Error(t, err)
+}
+
+func TestFeatureClientQueueStatsNotSupported(t *testing.T) {
+	serv, err := NewService(cPort, NullStorage)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	_, err = fc.QueueStats("a")
+	assert.Equal(t, ENotSupported, err)
+}
+
+func TestFeatureClientRequestExpiry(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	msg := Msg("hello")
+
+	expiry := time.Now().Add(50 * time.Millisecond)
+	msg.Expiry = &expiry
+
+	// nobody is handling requests yet, so it goes stale in the mailbox
+	_, err = fc.Request("a", msg)
+	assert.Equal(t, EExpired, err)
+
+	var (
+		lock    sync.Mutex
+		handled []string
+	)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		lock.Lock()
+		handled = append(handled, string(msg.Body))
+		lock.Unlock()
+
+		return Msg("ok")
+	}))
+
+	fresh := Msg("fresh")
+
+	later := time.Now().Add(time.Second)
+	fresh.Expiry = &later
+
+	del, err := fc.Request("a", fresh)
+	require.NoError(t, err)
+
+	assert.Equal(t, "ok", string(del.Message.Body))
+
+	lock.Lock()
+	assert.Equal(t, []string{"fresh"}, handled, "expired request was handled")
+	lock.Unlock()
+}
+
+func TestFeatureClientPushBatch(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	var msgs []*Message
+
+	for i := 0; i < 200; i++ {
+		msgs = append(msgs, Msg(fmt.Sprintf("%d", i)))
+	}
+
+	err = fc.PushBatch("a", msgs)
+	require.NoError(t, err)
+
+	for i := 0; i < 200; i++ {
+		del, err := fc.Poll("a")
+		require.NoError(t, err)
+		require.NotNil(t, del)
+
+		assert.Equal(t, fmt.Sprintf("%d", i), string(del.Message.Body))
+		del.Ack()
+	}
+
+	err = fc.PushBatch("b", msgs[:2])
+	require.Error(t, err)
+
+	batch, ok := err.(*BatchError)
+	require.True(t, ok, "error is not a BatchError")
+
+	assert.Equal(t, 2, len(batch.Errors))
+	assert.Contains(t, batch.Errors[0].Error(), ENoMailbox.Error())
+}
+
+func benchmarkPush(b *testing.B, batch bool) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.Declare("a")
+
+	msgs := make([]*Message, b.N)
+
+	for i := range msgs {
+		msgs[i] = Msg("hello")
+	}
+
+	b.ResetTimer()
+
+	if batch {
+		err = fc.PushBatch("a", msgs)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		return
+	}
+
+	for _, msg := range msgs {
+		err = fc.Push("a", msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFeatureClientPush(b *testing.B) {
+	benchmarkPush(b, false)
+}
+
+func BenchmarkFeatureClientPushBatch(b *testing.B) {
+	benchmarkPush(b, true)
+}
+
+// Hides PipeConn's ReadFrom and WriteTo so io.Copy goes through
+// Read and Write
+type plainConn struct {
+	io.Reader
+	io.Writer
+}
+
+func benchmarkPipeCopy(b *testing.B, plain bool) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	data := make([]byte, 1024*1024)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		conn, err := fc.Clone().ListenPipe("a")
+		if err != nil {
+			panic(err)
+		}
+
+		defer conn.Close()
+
+		var src io.Reader = conn
+		if plain {
+			src = plainConn{conn, nil}
+		}
+
+		io.Copy(ioutil.Discard, src)
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("a")
+	if err != nil {
+		panic(err)
+	}
+
+	var dst io.Writer = conn
+	if plain {
+		dst = plainConn{nil, conn}
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := io.Copy(dst, bytes.NewReader(data))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	conn.CloseWrite()
+	<-done
+
+	b.StopTimer()
+
+	conn.Close()
+}
+
+func BenchmarkFeatureClientPipeCopy(b *testing.B) {
+	benchmarkPipeCopy(b, false)
+}
+
+func BenchmarkFeatureClientPipeCopyPlain(b *testing.B) {
+	benchmarkPipeCopy(b, true)
+}
+
+func TestFeatureClientDrainQueue(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		err = fc.Push("a", Msg(fmt.Sprintf("%d", i)))
+		require.NoError(t, err)
+	}
+
+	dels, err := fc.DrainQueue("a", 3)
+	require.NoError(t, err)
+
+	require.Equal(t, 3, len(dels))
+	assert.Equal(t, "0", string(dels[0].Message.Body))
+
+	start := time.Now()
+
+	dels, err = fc.DrainQueue("a", 0)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(dels))
+	assert.Equal(t, "3", string(dels[0].Message.Body))
+	assert.Equal(t, "4", string(dels[1].Message.Body))
+
+	assert.True(t, time.Since(start) < time.Second, "drain blocked on an empty queue")
+
+	stats, err := fc.Stats()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.InFlight, "drained messages were not acked")
+}
+
+func TestFeatureClientPeek(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	msg, err := fc.Peek("a")
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+
+	fc.Push("a", Msg("first"))
+	fc.Push("a", Msg("second"))
+
+	for i := 0; i < 3; i++ {
+		msg, err = fc.Peek("a")
+		require.NoError(t, err)
+		require.NotNil(t, msg)
+
+		assert.Equal(t, "first", string(msg.Body))
+	}
+
+	dels, err := fc.DrainQueue("a", 0)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(dels))
+	assert.Equal(t, "first", string(dels[0].Message.Body))
+	assert.Equal(t, "second", string(dels[1].Message.Body))
+}
+
+type testObserver struct {
+	NopObserver
+
+	lock      sync.Mutex
+	requests  []error
+	handled   []error
+	polls     int
+	received  int
+	pipeSent  int
+	pipeRead  int
+	lastName  string
+	longestRq time.Duration
+}
+
+func (o *testObserver) ObserveRequest(name string, d time.Duration, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.lastName = name
+	o.requests = append(o.requests, err)
+
+	if d > o.longestRq {
+		o.longestRq = d
+	}
+}
+
+func (o *testObserver) ObserveHandle(name string, d time.Duration, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.handled = append(o.handled, err)
+}
+
+func (o *testObserver) ObservePoll(name string, got bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if got {
+		o.polls++
+	}
+}
+
+func (o *testObserver) ObserveReceive(name string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.received++
+}
+
+func (o *testObserver) ObservePipe(n int, sent bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if sent {
+		o.pipeSent += n
+	} else {
+		o.pipeRead += n
+	}
+}
+
+func TestFeatureClientObserver(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	var obs testObserver
+
+	fc.SetObserver(&obs)
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandleErrors(ErrorHandlerFunc(func(msg *Message) (*Message, error) {
+		if string(msg.Body) == "fail" {
+			return nil, fmt.Errorf("failed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		return Msg("ok"), nil
+	})))
+
+	_, err = fc.Request("a", Msg("hello"))
+	require.NoError(t, err)
+
+	_, err = fc.Request("a", Msg("fail"))
+	require.Error(t, err)
+
+	err = fc.Declare("b")
+	require.NoError(t, err)
+
+	fc.Push("b", Msg("one"))
+
+	rc := fc.Receive("b")
+
+	<-rc.Channel
+	rc.Close()
+
+	obs.lock.Lock()
+	assert.Equal(t, []error{nil, &RemoteError{"failed"}}, obs.requests)
+	assert.Equal(t, []error{nil, &RemoteError{"failed"}}, obs.handled)
+	assert.Equal(t, "a", obs.lastName)
+	assert.True(t, obs.longestRq >= 10*time.Millisecond, "request latency not observed")
+	assert.True(t, obs.polls >= 3, "polls not observed")
+	obs.lock.Unlock()
+
+	// ObserveReceive is called once the delivery has been sent
+	time.Sleep(10 * time.Millisecond)
+
+	obs.lock.Lock()
+	assert.Equal(t, 1, obs.received)
+	obs.lock.Unlock()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, _ := fc.Clone().ListenPipe("pipe")
+		conn.Write([]byte("hello"))
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc.ConnectPipe("pipe")
+	require.NoError(t, err)
+
+	data := make([]byte, 5)
+
+	_, err = io.ReadFull(conn, data)
+	require.NoError(t, err)
+
+	wg.Wait()
+
+	obs.lock.Lock()
+	assert.Equal(t, 5, obs.pipeSent)
+	assert.Equal(t, 5, obs.pipeRead)
+	obs.lock.Unlock()
+}
+
+type testLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestFeatureClientLoggerReportsDroppedErrors(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	var logger testLogger
+
+	fc.SetLogger(&logger)
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		return Msg("ok")
+	}))
+
+	err = fc.Push("a", &Message{ReplyTo: "missing", Body: []byte("hello")})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	require.Equal(t, 1, len(logger.lines))
+	assert.Contains(t, logger.lines[0], "send reply to missing")
+	assert.Contains(t, logger.lines[0], ENoMailbox.Error())
+}
+
+type testTraceKey struct{}
+
+type testPropagator struct{}
+
+func (testPropagator) Inject(ctx context.Context, carrier TraceCarrier) {
+	if id, ok := ctx.Value(testTraceKey{}).(string); ok {
+		carrier.Set("trace-id", id)
+	}
+}
+
+func (testPropagator) Extract(ctx context.Context, carrier TraceCarrier) context.Context {
+	if id := carrier.Get("trace-id"); id != "" {
+		return context.WithValue(ctx, testTraceKey{}, id)
+	}
+
+	return ctx
+}
+
+func TestFeatureClientTracePropagation(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.SetPropagator(testPropagator{})
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", ContextHandlerFunc(func(ctx context.Context, msg *Message) *Message {
+		id, _ := ctx.Value(testTraceKey{}).(string)
+		return Msg(id)
+	}))
+
+	ctx := context.WithValue(context.Background(), testTraceKey{}, "trace-1")
+
+	del, err := fc.RequestContext(ctx, "a", Msg("hello"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "trace-1", string(del.Message.Body))
+
+	// without a trace in the context nothing is propagated
+	del, err = fc.Request("a", Msg("hello"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "", string(del.Message.Body))
+}
+
+func TestFeatureClientHandlerContextDeadline(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", ContextHandlerFunc(func(ctx context.Context, msg *Message) *Message {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return Msg("none")
+		}
+
+		return Msg(deadline.Format(time.RFC3339Nano))
+	}))
+
+	del, err := fc.Request("a", Msg("hello"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "none", string(del.Message.Body))
+
+	msg := Msg("hello")
+
+	expiry := time.Now().Add(time.Minute)
+	msg.Expiry = &expiry
+
+	del, err = fc.Request("a", msg)
+	require.NoError(t, err)
+
+	deadline, err := time.Parse(time.RFC3339Nano, string(del.Message.Body))
+	require.NoError(t, err)
+
+	assert.True(t, deadline.Equal(expiry), "handler deadline was not the request's expiry")
+}
+
+func TestFeatureClientRequestDeadlineHeader(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", ContextHandlerFunc(func(ctx context.Context, msg *Message) *Message {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return Msg("none")
+		}
+
+		return Msg(deadline.Format(time.RFC3339Nano))
+	}))
+
+	before := time.Now()
+
+	del, err := fc.RequestTimeout("a", Msg("hello"), 5*time.Second)
+	require.NoError(t, err)
+
+	deadline, err := time.Parse(time.RFC3339Nano, string(del.Message.Body))
+	require.NoError(t, err)
+
+	assert.False(t, deadline.Before(before.Add(5*time.Second)))
+	assert.True(t, deadline.Before(time.Now().Add(5*time.Second)))
+}
+
+func TestFeatureClientHandleRequestsSkipsPastDeadline(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	// the requester gave up before anyone got to it
+	stale := Msg("stale")
+	stale.ReplyTo = fc.LocalMailbox()
+	stale.CorrelationId = RandomID()
+	stale.AddHeader(DeadlineHeader, time.Now().Add(-time.Second).Format(time.RFC3339Nano))
+
+	err = fc.Push("a", stale)
+	require.NoError(t, err)
+
+	var (
+		lock    sync.Mutex
+		handled []string
+	)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		lock.Lock()
+		handled = append(handled, string(msg.Body))
+		lock.Unlock()
+
+		return Msg("ok")
+	}))
+
+	del, err := fc.RequestTimeout("a", Msg("fresh"), 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "ok", string(del.Message.Body))
+
+	lock.Lock()
+	assert.Equal(t, []string{"fresh"}, handled, "request past its deadline was handled")
+	lock.Unlock()
+
+	left, err := fc.Poll("a")
+	require.NoError(t, err)
+	assert.Nil(t, left, "request past its deadline was not acked")
+}
+
+func TestFeatureClientCloseClone(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		return Msg("ok")
+	}))
+
+	reg := serv.Registry.(*Registry)
+
+	mailboxes := func() int {
+		reg.Lock()
+		defer reg.Unlock()
+
+		return len(reg.mailboxes)
+	}
+
+	before := mailboxes()
+
+	clone := fc.Clone()
+
+	_, err = clone.Request("a", Msg("hello"))
+	require.NoError(t, err)
+
+	assert.Equal(t, before+1, mailboxes())
+
+	err = clone.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, before, mailboxes(), "clone left its local mailbox behind")
+
+	// the shared connection is still open
+	_, err = fc.Request("a", Msg("hello"))
+	require.NoError(t, err)
+}
+
+func TestFeatureClientReceiveFunc(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	var logger testLogger
+
+	fc.SetLogger(&logger)
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	got := make(chan string, 3)
+
+	rec, err := fc.ReceiveFunc("a", func(del *Delivery) {
+		if string(del.Message.Body) == "boom" {
+			panic("boom")
+		}
+
+		got <- string(del.Message.Body)
+		del.Ack()
+	})
+	require.NoError(t, err)
+
+	fc.Push("a", Msg("one"))
+	fc.Push("a", Msg("boom"))
+	fc.Push("a", Msg("two"))
+
+	assert.Equal(t, "one", <-got)
+	assert.Equal(t, "two", <-got)
+
+	defer rec.Close()
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	require.Equal(t, 1, len(logger.lines))
+	assert.Contains(t, logger.lines[0], "handler panic: boom")
+
+	stats, err := fc.Stats()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.InFlight, "panicking delivery was left unacked")
+
+	// Closing it again, or through a Merge, stops it just once
+	merged := Merge(rec)
+
+	rec.Close()
+	merged.Close()
+	merged.Wait()
+
+	_, ok := <-rec.Channel
+	assert.False(t, ok)
+	assert.NoError(t, rec.Error)
+}
+
+func TestFeatureClientPollContext(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	// longer than the test should take, so only ctx can end the polls
+	fc.PollInterval = 10 * time.Second
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		fc.Push("a", Msg("hello"))
+	}()
+
+	del, err := fc.PollContext(context.Background(), "a")
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello", string(del.Message.Body))
+	assert.NoError(t, del.Ack())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	del, err = fc.PollContext(ctx, "a")
+	assert.Nil(t, del)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "poll ignored its context")
+
+	_, err = fc.PollContext(context.Background(), "missing")
+	assert.Error(t, err)
+
+	// Receivers are built on it, so closing one doesn't wait out a poll
+	rec := fc.Receive("a")
+
+	time.Sleep(50 * time.Millisecond)
+
+	start = time.Now()
+
+	rec.Close()
+	rec.Wait()
+
+	assert.True(t, time.Since(start) < 2*time.Second, "Close waited for the poll to time out")
+	assert.NoError(t, rec.Error)
+}
+
+func TestFeatureClientPollInterval(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.PollInterval = 50 * time.Millisecond
+
+	assert.Equal(t, fc.PollInterval, fc.Clone().PollInterval)
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	rec := fc.Receive("a")
+
+	rec.Close()
+
+	select {
+	case <-rec.Channel:
+	case <-time.After(time.Second):
+		t.Fatal("receiver didn't notice the close within the poll interval")
+	}
+}
+
+func TestFeatureClientRequestRetry(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	var calls int32
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		atomic.AddInt32(&calls, 1)
+		return ErrorMsg(fmt.Errorf("nope"))
+	}))
+
+	policy := RetryPolicy{MaxAttempts: 3, MinBackoff: 20 * time.Millisecond}
+
+	// application errors aren't retried
+	_, err = fc.RequestRetry("a", Msg("hello"), policy)
+	assert.Equal(t, &RemoteError{"nope"}, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	serv.Close()
+
+	var obs testObserver
+
+	fc.SetObserver(&obs)
+
+	start := time.Now()
+
+	_, err = fc.RequestRetry("a", Msg("hello"), policy)
+	require.Error(t, err)
+
+	assert.True(t, time.Since(start) >= 60*time.Millisecond, "request wasn't retried with backoff")
+
+	obs.lock.Lock()
+	assert.Equal(t, 3, len(obs.requests))
+	obs.lock.Unlock()
+}
+
+func TestIsTemporary(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	err = fc.Push("b", Msg("hello"))
+	require.Error(t, err)
+
+	assert.False(t, IsTemporary(err), "missing mailbox reported as temporary")
+
+	serv.Close()
+
+	err = fc.Push("a", Msg("hello"))
+	require.Error(t, err)
+
+	_, ok := err.(*TemporaryError)
+	assert.True(t, ok, "connection error not wrapped as temporary")
+	assert.True(t, IsTemporary(err))
+
+	_, err = fc.Poll("a")
+	assert.True(t, IsTemporary(err))
+
+	assert.True(t, IsTemporary(ETimeout))
+	assert.Equal(t, ETimeout, temporary(ETimeout), "timeout wrapped as a lost connection")
+	assert.False(t, IsTemporary(EProtocolError))
+	assert.False(t, IsTemporary(&DecodeError{io.ErrUnexpectedEOF}))
+	assert.False(t, IsTemporary(&RemoteError{"nope"}))
+}
+
+func TestFeatureClientReceiverWait(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.PollInterval = 50 * time.Millisecond
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	fc.Push("a", Msg("one"))
+	fc.Push("a", Msg("two"))
+
+	rec := fc.Receive("a")
+
+	got := <-rec.Channel
+	assert.Equal(t, "one", string(got.Message.Body))
+	got.Ack()
+
+	// "two" is pulled but never taken
+	time.Sleep(50 * time.Millisecond)
+
+	rec.Close()
+	rec.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		rec.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return after Close")
+	}
+
+	_, ok := <-rec.Channel
+	assert.False(t, ok, "channel not closed after Wait")
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del, "untaken delivery was not put back")
+
+	assert.Equal(t, "two", string(del.Message.Body))
+}
+
+func TestFeatureClientReceiveCloseWithStalledConsumer(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	for _, opts := range []ReceiveOpts{{}, {AutoAck: true, Prefetch: 1}} {
+		fc.Push("a", Msg("one"))
+		fc.Push("a", Msg("two"))
+
+		// nothing ever reads from the channel, and the default
+		// PollInterval would hold up a Close that waited for a poll
+		rec := fc.Clone().ReceiveWithOpts("a", opts)
+
+		// wait for the loop to be stuck sending, with the prefetch
+		// buffer full
+		pending := 1 - opts.Prefetch
+
+		for i := 0; i < 100; i++ {
+			info, err := fc.QueueStats("a")
+			require.NoError(t, err)
+
+			if info.Pending == pending {
+				break
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		start := time.Now()
+
+		rec.Close()
+		rec.Wait()
+
+		assert.True(t, time.Since(start) < time.Second, "Close waited on the stalled consumer")
+
+		var left []string
+
+		for del := range rec.Channel {
+			left = append(left, string(del.Message.Body))
+		}
+
+		dels, err := fc.DrainQueue("a", 0)
+		require.NoError(t, err)
+
+		for _, del := range dels {
+			left = append(left, string(del.Message.Body))
+		}
+
+		sort.Strings(left)
+		assert.Equal(t, []string{"one", "two"}, left, "deliveries were lost with %+v", opts)
+	}
+}
+
+func TestFeatureClientRequestChan(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	err = fc.Declare("slow")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		return Msg("hello " + string(msg.Body))
+	}))
+
+	reg := serv.Registry.(*Registry)
+
+	mailboxes := func() int {
+		reg.Lock()
+		defer reg.Unlock()
+
+		return len(reg.mailboxes)
+	}
+
+	before := mailboxes()
+
+	c, done, err := fc.RequestChan("a", Msg("evan"))
+	require.NoError(t, err)
+
+	select {
+	case del := <-c:
+		require.NotNil(t, del)
+		assert.Equal(t, "hello evan", string(del.Message.Body))
+	case <-time.After(time.Second):
+		t.Fatal("no reply")
+	}
+
+	done()
+
+	assert.Equal(t, before, mailboxes(), "reply mailbox was not abandoned")
+
+	// nobody answers "slow", and cleaning up closes the channel
+	c, done, err = fc.RequestChan("slow", Msg("evan"))
+	require.NoError(t, err)
+
+	done()
+
+	select {
+	case del, ok := <-c:
+		assert.False(t, ok)
+		assert.Nil(t, del)
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed by cleanup")
+	}
+}
+
+func TestFeatureClientPublishCount(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	n, err := fc.PublishCount("events/start", Msg("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	for i := 0; i < 2; i++ {
+		rec, err := fc.Subscribe("events/+")
+		require.NoError(t, err)
+
+		defer rec.Close()
+	}
+
+	gone, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = gone.Subscribe("events/#")
+	require.NoError(t, err)
+
+	gone.Close()
+
+	n, err = fc.PublishCount("events/start", Msg("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestFeatureClientPublishDottedTopics(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	created, err := fc.Subscribe("orders.*.created")
+	require.NoError(t, err)
+
+	defer created.Close()
+
+	all, err := fc.Subscribe("orders.#")
+	require.NoError(t, err)
+
+	defer all.Close()
+
+	n, err := fc.PublishCount("orders.us.created", Msg("one"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = fc.PublishCount("orders.us.deleted", Msg("two"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	for _, body := range []string{"one", "two"} {
+		select {
+		case del := <-all.Channel:
+			assert.Equal(t, body, string(del.Message.Body))
+			del.Ack()
+		case <-time.After(time.Second):
+			t.Fatal("orders.# did not get the message")
+		}
+	}
+
+	select {
+	case del := <-created.Channel:
+		assert.Equal(t, "one", string(del.Message.Body))
+		del.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("orders.*.created did not get the message")
+	}
+}
+
+func TestDeliveryDecode(t *testing.T) {
+	for _, c := range []Codec{JSONCodec, GobCodec} {
+		msg, err := EncodeMsg(c, &testJSONReq{A: 1, B: 2})
+		require.NoError(t, err)
+
+		var req testJSONReq
+
+		err = (&Delivery{Message: msg}).Decode(&req)
+		require.NoError(t, err)
+
+		assert.Equal(t, testJSONReq{A: 1, B: 2}, req)
+	}
+
+	var req testJSONReq
+
+	err := (&Delivery{Message: Msg("hello")}).Decode(&req)
+	assert.Equal(t, &UnknownContentTypeError{""}, err)
+
+	msg := Msg("hello")
+	msg.ContentType = "text/x-unknown"
+
+	err = (&Delivery{Message: msg}).Decode(&req)
+	assert.Equal(t, &UnknownContentTypeError{"text/x-unknown"}, err)
+	assert.Contains(t, err.Error(), "text/x-unknown")
+
+	msg.ContentType = JSONCodec.ContentType()
+
+	err = (&Delivery{Message: msg}).Decode(&req)
+
+	_, ok := err.(*DecodeError)
+	assert.True(t, ok, "error was not a DecodeError")
+}
+
+func TestFeatureClientRequestDropsDuplicateReplies(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	handler := fc.Clone()
+
+	go handler.HandleRequests("a", HandlerFunc(func(msg *Message) *Message {
+		// a redelivered reply arriving ahead of the real one
+		dup := Msg("dup " + string(msg.Body))
+		dup.CorrelationId = msg.CorrelationId
+
+		handler.Push(msg.ReplyTo, dup)
+		handler.Push(msg.ReplyTo, dup)
+
+		return Msg("reply " + string(msg.Body))
+	}))
+
+	for _, body := range []string{"one", "two", "three"} {
+		del, err := fc.Request("a", Msg(body))
+		require.NoError(t, err)
+
+		assert.Equal(t, "dup "+body, string(del.Message.Body), "reply from an earlier request")
+		del.Ack()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	stats, err := fc.Stats()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.InFlight, "duplicate replies were left unacked")
+}
+
+func TestFeatureClientPushDelay(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	type handled struct {
+		body string
+		at   time.Time
+	}
+
+	got := make(chan handled, 2)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		got <- handled{string(req.Body), time.Now()}
+		return nil
+	}))
+
+	start := time.Now()
+
+	err = fc.PushDelay("a", Msg("later"), 200*time.Millisecond)
+	require.NoError(t, err)
+
+	err = fc.PushDelay("a", Msg("now"), 0)
+	require.NoError(t, err)
+
+	first := <-got
+	assert.Equal(t, "now", first.body)
+	assert.True(t, first.at.Sub(start) < 200*time.Millisecond)
+
+	select {
+	case second := <-got:
+		assert.Equal(t, "later", second.body)
+		assert.True(t, second.at.Sub(start) >= 200*time.Millisecond)
+	case <-time.After(5 * time.Second):
+		t.Fatal("delayed message was never handled")
+	}
+}
+
+func TestFeatureClientReceiveHoldsDelayed(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	err = fc.PushDelay("a", Msg("later"), 200*time.Millisecond)
+	require.NoError(t, err)
+
+	rec := fc.Receive("a")
+	defer rec.Close()
+
+	select {
+	case del := <-rec.Channel:
+		assert.Equal(t, "later", string(del.Message.Body))
+		assert.True(t, time.Since(start) >= 200*time.Millisecond)
+		require.NoError(t, del.Ack())
+	case <-time.After(5 * time.Second):
+		t.Fatal("delayed message was never received")
+	}
+}
+
+func TestFeatureClientPriorityReceiver(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	for _, name := range []string{"high", "low", "urgent", "bulk"} {
+		err = fc.Declare(name)
+		require.NoError(t, err)
+	}
+
+	fill := func(high, low string) {
+		for i := 0; i < 6; i++ {
+			err := fc.Push(high, Msg("h"))
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 3; i++ {
+			err := fc.Push(low, Msg("l"))
+			require.NoError(t, err)
+		}
+	}
+
+	take := func(rec *Receiver, n int) string {
+		var order string
+
+		for i := 0; i < n; i++ {
+			select {
+			case del := <-rec.Channel:
+				order += string(del.Message.Body)
+				require.NoError(t, del.Ack())
+			case <-time.After(5 * time.Second):
+				t.Fatalf("only got %q", order)
+			}
+		}
+
+		return order
+	}
+
+	fill("high", "low")
+
+	rec := fc.PriorityReceiver([]string{"high", "low"}, PriorityOpts{})
+
+	assert.Equal(t, "hhhhhhlll", take(rec, 9))
+
+	rec.Close()
+	rec.Wait()
+
+	fill("urgent", "bulk")
+
+	rec = fc.PriorityReceiver([]string{"urgent", "bulk"}, PriorityOpts{Fairness: 2})
+	defer rec.Close()
+
+	assert.Equal(t, "hhlhhlhhl", take(rec, 9))
+
+	// A message arriving on a lower queue is picked up while idle
+	err = fc.Push("bulk", Msg("l"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "l", take(rec, 1))
+}
+
+func TestFeatureClientDeliveryReply(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go func() {
+		del, err := fc.Clone().LongPoll("a", 5*time.Second)
+		if err != nil || del == nil {
+			return
+		}
+
+		fc.logError("reply", del.Reply(Msg("re: "+string(del.Message.Body))))
+	}()
+
+	resp, err := fc.Request("a", Msg("hello"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "re: hello", string(resp.Message.Body))
+
+	// The reply is sent before the request is acked
+	for i := 0; i < 100; i++ {
+		stats, err := serv.Registry.(*Registry).Stats("a")
+		require.NoError(t, err)
+
+		if stats.InFlight == 0 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("request was never acked")
+}
+
+func TestFeatureClientReceiveAutoReconnect(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	fc.PollInterval = 100 * time.Millisecond
+
+	rec := fc.ReceiveWithOpts("a", ReceiveOpts{AutoReconnect: true})
+	defer rec.Close()
+
+	receive := func() string {
+		select {
+		case del, ok := <-rec.Channel:
+			if !ok {
+				t.Fatalf("receiver stopped: %v", rec.Error)
+			}
+
+			return string(del.Message.Body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing received")
+		}
+
+		return ""
+	}
+
+	err = fc.Push("a", Msg("before"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "before", receive())
+
+	serv.Close()
+
+	serv, err = NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c.Close()
+
+	// The receiver declares "a" again on the new broker once it's back,
+	// pushing before then would fail
+	for i := 0; ; i++ {
+		err = c.Push("a", Msg("after"))
+		if err == nil {
+			break
+		}
+
+		if i == 250 {
+			t.Fatalf("mailbox was never declared again: %s", err)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	assert.Equal(t, "after", receive())
+}
+
+func TestFeatureClientDeliveryAge(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	msg := Msg("hello")
+
+	err = fc.Push("a", msg)
+	require.NoError(t, err)
+
+	assert.Nil(t, msg.Timestamp, "the caller's message was changed")
+
+	time.Sleep(50 * time.Millisecond)
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	require.NotNil(t, del.Message.Timestamp)
+	assert.True(t, del.Age() >= 50*time.Millisecond, "age was %s", del.Age())
+
+	// A Timestamp that's already set is kept
+	earlier := time.Now().Add(-time.Hour)
+	msg.Timestamp = &earlier
+
+	err = fc.PushBatch("a", []*Message{msg})
+	require.NoError(t, err)
+
+	del, err = fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.True(t, del.Age() >= time.Hour, "age was %s", del.Age())
+
+	assert.Equal(t, time.Duration(0), (&Delivery{Message: Msg("hello")}).Age())
+}
+
+// Storage whose Abandon fails for mailboxes it doesn't have, as some
+// brokers' do
+type strictAbandonStorage struct {
+	*Registry
+}
+
+func (s *strictAbandonStorage) Abandon(name string) error {
+	if _, err := s.Stats(name); err != nil {
+		return err
+	}
+
+	return s.Registry.Abandon(name)
+}
+
+func TestFeatureClientAbandonTwice(t *testing.T) {
+	serv, err := NewService(cPort, &strictAbandonStorage{NewMemRegistry()})
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.EphemeralDeclare("e")
+	require.NoError(t, err)
+
+	err = fc.Abandon("e")
+	require.NoError(t, err)
+
+	err = fc.Abandon("e")
+	assert.NoError(t, err)
+
+	err = fc.Abandon("never-declared")
+	assert.NoError(t, err)
+
+	// The broker does still report it to a plain Client
+	err = fc.Client.Abandon("e")
+	assert.Equal(t, ENoMailbox, err)
+}
+
+func TestFeatureClientPipeFrames(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	listened := make(chan *PipeConn, 1)
+
+	go func() {
+		conn, err := fc.ListenPipe("a")
+		if err != nil {
+			panic(err)
+		}
+
+		listened <- conn
+	}()
+
+	runtime.Gosched()
+
+	conn, err := fc2.ConnectPipe("a")
+	require.NoError(t, err)
+
+	// Frames aren't split, however small MaxMessageSize is
+	conn.MaxMessageSize = 2
+
+	recv, send, stop := conn.Frames()
+
+	peerRecv, peerSend, peerStop := (<-listened).Frames()
+
+	frames := []string{"hello", "a", "framed world"}
+
+	go func() {
+		for _, f := range frames {
+			send <- []byte(f)
+		}
+
+		close(send)
+	}()
+
+	var got []string
+
+	for frame := range peerRecv {
+		got = append(got, string(frame))
+	}
+
+	assert.Equal(t, frames, got)
+
+	peerSend <- []byte("reply")
+
+	select {
+	case frame := <-recv:
+		assert.Equal(t, "reply", string(frame))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply frame")
+	}
+
+	assert.NoError(t, peerStop())
+
+	// The peer closing ends the stream
+	select {
+	case _, ok := <-recv:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive channel was never closed")
+	}
+
+	assert.NoError(t, stop())
+}
+
+func TestFeatureClientCancelRequest(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	handler, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer handler.Close()
+
+	started := make(chan struct{}, 1)
+	stopped := make(chan error, 1)
+
+	w, err := handler.WorkerPool("a", ContextHandlerFunc(func(ctx context.Context, req *Message) *Message {
+		started <- struct{}{}
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return Msg("too late")
+	}), 2)
+	require.NoError(t, err)
+
+	defer w.Stop()
+
+	rf, err := fc.RequestAsync("a", Msg("slow"))
+	require.NoError(t, err)
+
+	<-started
+
+	err = rf.CancelRequest()
+	require.NoError(t, err)
+
+	select {
+	case err := <-stopped:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was never canceled")
+	}
+
+	_, err = rf.Wait(context.Background())
+	assert.Equal(t, context.Canceled, err)
+
+	// The cancel was taken by the pool, not left waiting
+	stats, err := serv.Registry.(*Registry).Stats("a")
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.Size)
+}
+
+func TestFeatureClientCancelBeforeRequestTaken(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	err = fc.Push("a", &Message{Type: RequestCancelType, CorrelationId: "1"})
+	require.NoError(t, err)
+
+	canceled := Msg("canceled")
+	canceled.CorrelationId = "1"
+
+	err = fc.Push("a", canceled)
+	require.NoError(t, err)
+
+	err = fc.Push("a", Msg("wanted"))
+	require.NoError(t, err)
+
+	got := make(chan string, 2)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		got <- string(req.Body)
+		return nil
+	}))
+
+	select {
+	case body := <-got:
+		assert.Equal(t, "wanted", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing handled")
+	}
+
+	stats, err := serv.Registry.(*Registry).Stats("a")
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.Size)
+}
+
+func TestFeatureClientStateObserver(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	fc, err := DialWithOptions(cPort, WithReconnect(ReconnectPolicy{
+		MinBackoff: 10 * time.Millisecond,
+	}))
+	if err != nil {
+		panic(err)
+	}
+
+	var (
+		lock   sync.Mutex
+		states []ConnState
+	)
+
+	fc.SetStateObserver(func(s ConnState) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		states = append(states, s)
+	})
+
+	seen := func() []ConnState {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return append([]ConnState(nil), states...)
+	}
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	assert.Empty(t, seen())
+
+	serv.Close()
+
+	restarted := make(chan *Service)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		serv, err := NewMemService(cPort)
+		if err != nil {
+			panic(err)
+		}
+
+		go serv.Accept()
+
+		restarted <- serv
+	}()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	serv = <-restarted
+	defer serv.Close()
+
+	assert.Equal(t, []ConnState{Reconnecting, Connected}, seen())
+
+	fc.Close()
+
+	assert.Equal(t, []ConnState{Reconnecting, Connected, Disconnected}, seen())
+	assert.Equal(t, "disconnected", Disconnected.String())
+}
+
+func TestFeatureClientLeaseExpires(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := DialWithOptions(cPort, WithLease(100*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	other, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer other.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	err = fc.Push("a", Msg("hello"))
+	require.NoError(t, err)
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	// Taken back once the lease runs out, without fc going away
+	again, err := other.LongPoll("a", 5*time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, again)
+
+	assert.Equal(t, "hello", string(again.Message.Body))
+	assert.Equal(t, 2, again.DeliveryCount)
+
+	require.NoError(t, again.Ack())
+
+	assert.Equal(t, EUnknownMessage, del.Extend(time.Second))
+	assert.Error(t, del.Ack())
+}
+
+func TestFeatureClientDeliveryExtend(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := DialWithOptions(cPort, WithLease(100*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	other, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer other.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	err = fc.Push("a", Msg("hello"))
+	require.NoError(t, err)
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	stop := make(chan struct{})
+	extended := make(chan error, 1)
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				extended <- nil
+				return
+			case <-time.After(30 * time.Millisecond):
+				err := del.Extend(100 * time.Millisecond)
+				if err != nil {
+					extended <- err
+					return
+				}
+			}
+		}
+	}()
+
+	// Held well past the original lease
+	stolen, err := other.LongPoll("a", 400*time.Millisecond)
+	require.NoError(t, err)
+	assert.Nil(t, stolen)
+
+	close(stop)
+	require.NoError(t, <-extended)
+
+	assert.NoError(t, del.Ack())
+
+	// Deliveries that don't come from a broker connection can't be
+	r := NewMemRegistry()
+	r.Declare("a")
+	r.Push("a", Msg("hello"))
+
+	local, _ := r.Poll("a")
+	assert.Equal(t, ENotSupported, local.Extend(time.Second))
+}
+
+func TestFeatureClientHandleRequestsExtendsLease(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := DialWithOptions(cPort, WithLease(100*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	other, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer other.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	handled := make(chan struct{}, 2)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		time.Sleep(400 * time.Millisecond)
+		handled <- struct{}{}
+		return nil
+	}))
+
+	err = other.Push("a", Msg("slow"))
+	require.NoError(t, err)
+
+	// The message isn't handed to another consumer while the handler
+	// runs past its lease
+	stolen, err := other.LongPoll("a", 300*time.Millisecond)
+	require.NoError(t, err)
+	assert.Nil(t, stolen)
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was never handled")
+	}
+
+	stats, err := serv.Registry.(*Registry).Stats("a")
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.Size)
+}
+
+func TestErrorMsgErrorReply(t *testing.T) {
+	msg := ErrorMsg(&ErrorReply{
+		Code:    "not_found",
+		Message: "no such user",
+		Details: map[string]string{"id": "42"},
+	})
+
+	assert.Equal(t, ErrorReplyContentType, msg.ContentType)
+	assert.JSONEq(t,
+		`{"code":"not_found","message":"no such user","details":{"id":"42"}}`,
+		string(msg.Body))
+
+	err := DecodeErrorReply(msg)
+
+	cerr, ok := err.(*CodedError)
+	require.True(t, ok)
+
+	assert.Equal(t, "not_found", cerr.Code())
+	assert.Equal(t, "no such user", cerr.Error())
+	assert.Equal(t, map[string]string{"id": "42"}, cerr.Details())
+
+	// Passed on as it was
+	assert.Equal(t, msg, ErrorMsg(cerr))
+
+	// Errors without a code stay plain text
+	msg = ErrorMsg(fmt.Errorf("broken"))
+
+	assert.Equal(t, "", msg.ContentType)
+	assert.Equal(t, &RemoteError{"broken"}, DecodeErrorReply(msg))
+
+	// As do replies from handlers that didn't use the format
+	msg = &Message{Type: "error", ContentType: ErrorReplyContentType, Body: []byte("oops")}
+	assert.Equal(t, &RemoteError{"oops"}, DecodeErrorReply(msg))
+}
+
+func TestFeatureClientRequestCodedError(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	go fc.Clone().HandleRequests("a", HandleErrors(ErrorHandlerFunc(func(req *Message) (*Message, error) {
+		return nil, &ErrorReply{
+			Code:    "quota_exceeded",
+			Message: "too many requests",
+			Details: map[string]string{"limit": "10"},
+		}
+	})))
+
+	_, err = fc.Request("a", Msg("hello"))
+	require.Error(t, err)
+
+	cerr, ok := err.(*CodedError)
+	require.True(t, ok)
+
+	assert.Equal(t, "quota_exceeded", cerr.Code())
+	assert.Equal(t, "too many requests", cerr.Error())
+	assert.Equal(t, "10", cerr.Details()["limit"])
+}
+
+func TestFeatureClientRequestHedged(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	workers, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer workers.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	var calls int32
+
+	// The first request taken is stuck behind something slow, every
+	// other one is answered straight away
+	h := HandlerFunc(func(req *Message) *Message {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			time.Sleep(time.Second)
+			return Msg("slow")
+		}
+
+		return Msg("fast")
+	})
+
+	go workers.Clone().HandleRequests("a", h)
+	go workers.Clone().HandleRequests("a", h)
+
+	start := time.Now()
+
+	del, err := fc.RequestHedged("a", Msg("read"), 50*time.Millisecond, 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "fast", string(del.Message.Body))
+	assert.True(t, time.Since(start) < 900*time.Millisecond)
+
+	require.NoError(t, del.Ack())
+
+	// Answered in time, so it isn't sent twice
+	del, err = fc.RequestHedged("a", Msg("read"), time.Second, 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "fast", string(del.Message.Body))
+	require.NoError(t, del.Ack())
+
+	// The slow copy's reply doesn't reach later requests
+	time.Sleep(time.Second)
+
+	del, err = fc.RequestHedged("a", Msg("read"), time.Second, 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "fast", string(del.Message.Body))
+	require.NoError(t, del.Ack())
+
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
+
+func TestFeatureClientPushStringRequestString(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	err = fc.PushString("a", "héllo")
+	require.NoError(t, err)
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("héllo"), del.Message.Body)
+	assert.Equal(t, "", del.Message.ContentType)
+
+	require.NoError(t, del.Ack())
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		return Msg(strings.ToUpper(string(req.Body)))
+	}))
+
+	reply, err := fc.RequestStringTimeout("a", "ping", 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "PING", reply)
+
+	err = fc.Declare("b")
+	require.NoError(t, err)
+
+	_, err = fc.RequestStringTimeout("b", "ping", 100*time.Millisecond)
+	assert.Equal(t, ETimeout, err)
+}
+
+func TestFeatureClientEmptyQueueName(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	assert.Equal(t, EInvalidQueue, fc.Declare(""))
+	assert.Equal(t, EInvalidQueue, fc.EphemeralDeclare(""))
+	assert.Equal(t, EInvalidQueue, fc.Push("", Msg("hello")))
+	assert.Equal(t, EInvalidQueue, fc.PushBatch("", []*Message{Msg("hello")}))
+	assert.Equal(t, EInvalidQueue, fc.PushString("", "hello"))
+
+	_, err = fc.Poll("")
+	assert.Equal(t, EInvalidQueue, err)
+
+	_, err = fc.LongPoll("", time.Second)
+	assert.Equal(t, EInvalidQueue, err)
+
+	_, err = fc.Request("", Msg("hello"))
+	assert.Equal(t, EInvalidQueue, err)
+
+	_, err = fc.RequestTimeout("", Msg("hello"), time.Second)
+	assert.Equal(t, EInvalidQueue, err)
+
+	_, err = fc.RequestWithOpts(context.Background(), "", Msg("hello"),
+		RequestOpts{FreshReplyMailbox: true})
+	assert.Equal(t, EInvalidQueue, err)
+
+	assert.Equal(t, EInvalidQueue, fc.RequestTo("", "replies", Msg("hello")))
+	assert.Equal(t, EInvalidQueue, fc.RequestTo("a", "", Msg("hello")))
+
+	_, err = fc.RequestAsync("", Msg("hello"))
+	assert.Equal(t, EInvalidQueue, err)
+
+	_, err = fc.ReceiveFunc("", func(*Delivery) {})
+	assert.Equal(t, EInvalidQueue, err)
+	assert.Equal(t, EInvalidQueue, fc.Client.PushBatch("", []*Message{Msg("hello")}))
+
+	// Not "pipe:", which would be a mailbox like any other
+	_, err = fc.ListenPipe("")
+	assert.Equal(t, EInvalidQueue, err)
+
+	_, err = fc.ConnectPipe("")
+	assert.Equal(t, EInvalidQueue, err)
+
+	_, err = NewPipeListener(fc, "")
+	assert.Equal(t, EInvalidQueue, err)
+
+	// Nothing reached the broker, not even a reply mailbox
+	assert.Equal(t, "", fc.localMailbox)
+}
+
+// A Clock that only moves when told to
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	c := make(chan time.Time, 1)
+
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+
+	f.waiters = append(f.waiters, fakeWaiter{f.now.Add(d), c})
+
+	return c
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = f.now.Add(d)
+
+	var left []fakeWaiter
+
+	for _, w := range f.waiters {
+		if w.at.After(f.now) {
+			left = append(left, w)
+		} else {
+			w.c <- f.now
+		}
+	}
+
+	f.waiters = left
+}
+
+// Wait for something to be waiting on the clock
+func (f *fakeClock) waitForWaiter(t *testing.T) {
+	for i := 0; i < 500; i++ {
+		f.lock.Lock()
+		n := len(f.waiters)
+		f.lock.Unlock()
+
+		if n > 0 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("nothing waited on the clock")
+}
+
+func TestFeatureClientClockPushDelay(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	clock := newFakeClock()
+	fc.SetClock(clock)
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	handled := make(chan string, 1)
+
+	go fc.Clone().HandleRequests("a", HandlerFunc(func(req *Message) *Message {
+		handled <- string(req.Body)
+		return nil
+	}))
+
+	err = fc.PushDelay("a", Msg("later"), time.Hour)
+	require.NoError(t, err)
+
+	clock.waitForWaiter(t)
+
+	select {
+	case <-handled:
+		t.Fatal("delayed message handled before it was due")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Hour)
+
+	select {
+	case body := <-handled:
+		assert.Equal(t, "later", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("delayed message wasn't handled once due")
+	}
+}
+
+func TestFeatureClientClockRequestExpiry(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	clock := newFakeClock()
+	fc.SetClock(clock)
+
+	assert.Equal(t, RealClock, (&FeatureClient{}).Clock())
+	assert.Equal(t, Clock(clock), fc.Clone().Clock())
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	expiry := clock.Now().Add(time.Hour)
+
+	res := make(chan error, 1)
+
+	go func() {
+		_, err := fc.Request("a", &Message{Body: []byte("hello"), Expiry: &expiry})
+		res <- err
+	}()
+
+	clock.waitForWaiter(t)
+	clock.Advance(time.Hour)
+
+	select {
+	case err := <-res:
+		assert.Equal(t, EExpired, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request didn't expire")
+	}
+
+	// Already expired by the client's clock, so it isn't sent
+	_, err = fc.Request("a", &Message{Body: []byte("hello"), Expiry: &expiry})
+	assert.Equal(t, EExpired, err)
+}
+
+func TestFeatureClientClockFreshRequestExpiry(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	clock := newFakeClock()
+	fc.SetClock(clock)
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	expiry := clock.Now().Add(time.Hour)
+
+	res := make(chan error, 1)
+
+	go func() {
+		_, err := fc.RequestWithOpts(context.Background(), "a",
+			&Message{Body: []byte("hello"), Expiry: &expiry},
+			RequestOpts{FreshReplyMailbox: true})
+		res <- err
+	}()
+
+	clock.waitForWaiter(t)
+	clock.Advance(time.Hour)
+
+	select {
+	case err := <-res:
+		assert.Equal(t, EExpired, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request didn't expire")
+	}
+}
+
+func TestRPCRequestMsg(t *testing.T) {
+	rr := &RPCRequest{Method: "math.Add", Version: 2, Payload: []byte("{}")}
+
+	msg := rr.Msg()
+
+	assert.Equal(t, RPCRequestType, msg.Type)
+	assert.Equal(t, []byte("{}"), msg.Body)
+
+	back, err := ParseRPCRequest(msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, rr, back)
+
+	// Not a response
+	_, err = ParseRPCResponse(msg)
+	assert.Equal(t, ENotRPC, err)
+
+	_, err = ParseRPCRequest(Msg("hello"))
+	assert.Equal(t, ENotRPC, err)
+
+	// No version means the default one
+	msg = &Message{Type: RPCRequestType}
+	msg.AddHeader(RPCMethodHeader, "math.Add")
+
+	back, err = ParseRPCRequest(msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, DefaultRPCVersion, back.Version)
+}
+
+func TestFeatureClientDoRPC(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("math")
+	require.NoError(t, err)
+
+	rs := NewRPCServer()
+
+	rs.Handle("math.Add", 1, JSONHandler(func(req *testJSONReq) (*testJSONResp, error) {
+		return &testJSONResp{Sum: req.A + req.B}, nil
+	}))
+
+	// Version 2 doubles the sum, served alongside version 1
+	rs.Handle("math.Add", 2, JSONHandler(func(req *testJSONReq) (*testJSONResp, error) {
+		if req.A < 0 {
+			return nil, fmt.Errorf("negative")
+		}
+
+		return &testJSONResp{Sum: 2 * (req.A + req.B)}, nil
+	}))
+
+	go fc.Clone().HandleRequests("math", rs)
+
+	var resp testJSONResp
+
+	err = fc.DoRPC("math.Add", &testJSONReq{A: 1, B: 2}, &resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, resp.Sum)
+
+	err = fc.DoRPCVersion("math.Add", 2, &testJSONReq{A: 1, B: 2}, &resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, 6, resp.Sum)
+
+	err = fc.DoRPCVersion("math.Add", 2, &testJSONReq{A: -1}, &resp)
+	assert.Equal(t, &RemoteError{"negative"}, err)
+
+	err = fc.DoRPCVersion("math.Add", 3, &testJSONReq{}, &resp)
+	require.Error(t, err)
+
+	cerr, ok := err.(*CodedError)
+	require.True(t, ok)
+
+	assert.Equal(t, RPCUnknownVersion, cerr.Code())
+	assert.Equal(t, "1,2", cerr.Details()["versions"])
+
+	err = fc.DoRPC("math.Sub", &testJSONReq{}, &resp)
+	require.Error(t, err)
+
+	cerr, ok = err.(*CodedError)
+	require.True(t, ok)
+
+	assert.Equal(t, RPCUnknownMethod, cerr.Code())
+
+	assert.Equal(t, EBadRPCMethod, fc.DoRPC("Add", &testJSONReq{}, &resp))
+	assert.Equal(t, EBadRPCMethod, fc.DoRPC("math.", &testJSONReq{}, &resp))
+}
+
+func TestFeatureClientPollContextCancelStopsBrokerPoll(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	res := make(chan error, 1)
+
+	go func() {
+		_, err := fc.PollContext(ctx, "a")
+		res <- err
+	}()
+
+	waitForWaiting(t, fc, "a", 1)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-res)
+
+	// The broker's poll ended with the stream
+	waitForWaiting(t, fc, "a", 0)
+
+	err = fc.Push("a", Msg("hello"))
+	require.NoError(t, err)
+
+	info, err := fc.QueueStats("a")
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, info.Pending)
+	assert.Equal(t, 0, info.InFlight)
+
+	del, err := fc.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, "hello", string(del.Message.Body))
+}
+
+func TestFeatureClientReceiverCloseStopsBrokerPoll(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	err = fc.Declare("a")
+	require.NoError(t, err)
+
+	rec := fc.Receive("a")
+
+	waitForWaiting(t, fc, "a", 1)
+
+	rec.Close()
+	rec.Wait()
+
+	waitForWaiting(t, fc, "a", 0)
+
+	err = fc.Push("a", Msg("hello"))
+	require.NoError(t, err)
+
+	info, err := fc.QueueStats("a")
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, info.Pending)
+	assert.Equal(t, 0, info.InFlight)
+}
+
+// Wait for n consumers to be long polling the queue name
+func waitForWaiting(t *testing.T, fc *FeatureClient, name string, n int) {
+	for i := 0; i < 500; i++ {
+		info, err := fc.QueueStats(name)
+		require.NoError(t, err)
+
+		if info.Consumers == n {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("never saw %d consumers waiting on %s", n, name)
+}
+
+// Connect a pipe between two new clients, returning the listening end,
+// the connecting end and a func closing the clients
+func testPipePair(t *testing.T, name string) (*PipeConn, *PipeConn, func()) {
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	listened := make(chan *PipeConn, 1)
+
+	go func() {
+		lp, err := fc.ListenPipe(name)
+		if err != nil {
+			listened <- nil
+			return
+		}
+
+		listened <- lp
+	}()
+
+	conn, err := fc2.ConnectPipe(name)
+	require.NoError(t, err)
+
+	lp := <-listened
+	require.NotNil(t, lp)
+
+	return lp, conn, func() {
+		fc.Close()
+		fc2.Close()
+	}
+}
+
+func TestFeatureClientPipeKeepaliveCloseWakesRead(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	lp, conn, done := testPipePair(t, "a")
+
+	defer done()
+
+	defer conn.Close()
+
+	lp.SetKeepalive(time.Second)
+
+	res := make(chan error, 1)
+
+	go func() {
+		_, err := lp.Read(make([]byte, 10))
+		res <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	lp.Close()
+
+	select {
+	case err := <-res:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read didn't return after Close")
+	}
+}
+
+func TestFeatureClientPipeKeepaliveTurnedOffKeepsData(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	lp, conn, done := testPipePair(t, "a")
+
+	defer done()
+
+	defer lp.Close()
+	defer conn.Close()
+
+	lp.SetKeepalive(time.Second)
+
+	time.Sleep(50 * time.Millisecond)
+
+	// The pump's poll ends with it, rather than taking the next frame
+	lp.SetKeepalive(0)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	data := make([]byte, 5)
+
+	lp.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = io.ReadFull(lp, data)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestFeatureClientPipeReadDeadlineWakesRead(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	lp, conn, done := testPipePair(t, "a")
+
+	defer done()
+	defer lp.Close()
+	defer conn.Close()
+
+	for _, keepalive := range []time.Duration{0, time.Second} {
+		lp.SetKeepalive(keepalive)
+		lp.SetReadDeadline(time.Time{})
+
+		res := make(chan error, 1)
+
+		go func() {
+			_, err := lp.Read(make([]byte, 10))
+			res <- err
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+
+		// As http.Server does to abort a pending read
+		lp.SetReadDeadline(time.Now())
+
+		select {
+		case err := <-res:
+			assert.Equal(t, ETimeout, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Read didn't notice the deadline move")
+		}
+	}
+
+	lp.SetKeepalive(0)
+	lp.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Nothing was lost to the abandoned reads
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	data := make([]byte, 5)
+
+	_, err = io.ReadFull(lp, data)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestFeatureClientPipeDeadlinesConcurrent(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	lp, conn, done := testPipePair(t, "a")
+
+	defer done()
+	defer lp.Close()
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 10; i++ {
+			conn.Write([]byte("x"))
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		buf := make([]byte, 10)
+
+		for read := 0; read < 10; {
+			n, _ := lp.Read(buf)
+			read += n
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		lp.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		time.Sleep(time.Millisecond)
+	}
+
+	wg.Wait()
+}
+
+func TestFeatureClientPublishCountTransformed(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.SetTransformer("sign", signingTransformer{})
+
+	name := "sub.raw" + cEphemeral
+
+	err = fc.EphemeralDeclare(name)
+	require.NoError(t, err)
+
+	err = fc.Client.Push(":subscribe", &Message{ReplyTo: name, CorrelationId: "events/#"})
+	require.NoError(t, err)
+
+	n, err := fc.PublishCount("events/start", Msg("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Sent as Publish would send it
+	raw, err := fc.Client.Poll(name)
+	require.NoError(t, err)
+	require.NotNil(t, raw)
+
+	assert.Equal(t, "signed:hello", string(raw.Message.Body))
+
+	raw.Nack()
+
+	del, err := fc.Poll(name)
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, "hello", string(del.Message.Body))
+}
+
+func TestFeatureClientPipeFailedWriteKeepsSequence(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	lp, conn, done := testPipePair(t, "a")
+
+	defer done()
+	defer lp.Close()
+
+	_, err = conn.Write([]byte("a"))
+	require.NoError(t, err)
+
+	data := make([]byte, 1)
+
+	_, err = io.ReadFull(lp, data)
+	require.NoError(t, err)
+
+	// Make the next push fail, then let pushes through again
+	require.NoError(t, serv.Registry.Abandon(conn.pairM))
+
+	_, err = conn.Write([]byte("b"))
+	require.Error(t, err)
+
+	require.NoError(t, serv.Registry.Declare(conn.pairM))
+
+	_, err = conn.Write([]byte("c"))
+	require.NoError(t, err)
+
+	conn.Close()
+
+	// Neither the next write nor the close is stuck behind the failed
+	// one
+	lp.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = io.ReadFull(lp, data)
+	require.NoError(t, err)
+
+	assert.Equal(t, "c", string(data))
+
+	_, err = lp.Read(data)
+	assert.Equal(t, io.EOF, err)
 }
@@ -0,0 +1,99 @@
+package vega
+
+import "context"
+
+// Carries trace context between a requester and the handler of its
+// request. Request calls Inject with the request's context and
+// HandleRequests calls Extract to build the context the handler gets.
+//
+// This has the same shape as OpenTelemetry's TextMapPropagator, which
+// can be adapted by converting the carrier argument.
+type Propagator interface {
+	Inject(ctx context.Context, carrier TraceCarrier)
+	Extract(ctx context.Context, carrier TraceCarrier) context.Context
+}
+
+// String key/value storage that a Propagator reads and writes
+type TraceCarrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// A TraceCarrier stored in the headers of Msg
+type HeaderCarrier struct {
+	Msg *Message
+}
+
+func (h HeaderCarrier) Get(key string) string {
+	v, _ := h.Msg.HeaderString(key)
+	return v
+}
+
+func (h HeaderCarrier) Set(key, value string) {
+	h.Msg.AddHeader(key, value)
+}
+
+func (h HeaderCarrier) Keys() []string {
+	var keys []string
+
+	for k := range h.Msg.Headers {
+		if _, ok := h.Msg.HeaderString(k); ok {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// Propagate trace context with p through requests made by fc and into
+// handlers run by fc's HandleRequests. Clones of fc use p too.
+func (fc *FeatureClient) SetPropagator(p Propagator) {
+	fc.propagator = p
+}
+
+// A Handler that also wants a context. When run by HandleRequests, ctx
+// carries the trace extracted from the request, has the request's
+// Deadline as its deadline, and is cancelled when HandleRequestsContext's
+// context is. MessageMux and the middleware in this package pass ctx
+// through to the handlers they wrap.
+type HandlerWithContext interface {
+	Handler
+	HandleMessageContext(ctx context.Context, m *Message) *Message
+}
+
+type contextHandlerFunc func(context.Context, *Message) *Message
+
+func (f contextHandlerFunc) HandleMessage(m *Message) *Message {
+	return f(context.Background(), m)
+}
+
+func (f contextHandlerFunc) HandleMessageContext(ctx context.Context, m *Message) *Message {
+	return f(ctx, m)
+}
+
+// Adapt h into a HandlerWithContext
+func ContextHandlerFunc(h func(context.Context, *Message) *Message) HandlerWithContext {
+	return contextHandlerFunc(h)
+}
+
+// Return h as a HandlerWithContext. A plain Handler is wrapped to
+// ignore the context.
+func ContextHandler(h Handler) HandlerWithContext {
+	if ch, ok := h.(HandlerWithContext); ok {
+		return ch
+	}
+
+	return ContextHandlerFunc(func(_ context.Context, m *Message) *Message {
+		return h.HandleMessage(m)
+	})
+}
+
+// Run h on m, giving it ctx if it wants one
+func handleContext(ctx context.Context, h Handler, m *Message) *Message {
+	if ch, ok := h.(HandlerWithContext); ok {
+		return ch.HandleMessageContext(ctx, m)
+	}
+
+	return h.HandleMessage(m)
+}
@@ -0,0 +1,80 @@
+package vega
+
+// Transforms message bodies end to end, such as encrypting or signing
+// them. Decode must undo Encode.
+type MessageTransformer interface {
+	Encode(body []byte) ([]byte, error)
+	Decode(body []byte) ([]byte, error)
+}
+
+// Header naming the MessageTransformer a message's body was encoded with
+const TransformHeader = "transform"
+
+// Encode the bodies of messages fc pushes with t, marking them with name
+// in TransformHeader. Received messages marked with name are decoded.
+// Unmarked ones are passed through as they are, so clients with and
+// without the transformer can run side by side during a rollout. A nil
+// t turns it off. Clones of fc inherit it.
+//
+// If a received message marked with name fails to decode, it's logged,
+// acked and dropped rather than delivered, and the poll returns no
+// message.
+func (fc *FeatureClient) SetTransformer(name string, t MessageTransformer) {
+	fc.transformName = name
+	fc.transformer = t
+}
+
+// Return msg as it should be sent, compressed and then transformed as
+// fc is set up to
+func (fc *FeatureClient) outgoing(msg *Message) (*Message, error) {
+	msg = fc.compress(msg)
+
+	if fc.transformer == nil {
+		return msg, nil
+	}
+
+	body, err := fc.transformer.Encode(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := *msg
+	cp.Body = body
+
+	cp.Headers = make(map[string]interface{}, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		cp.Headers[k] = v
+	}
+
+	cp.Headers[TransformHeader] = fc.transformName
+
+	return &cp, nil
+}
+
+// Undo what outgoing did to del's message, in place. Returns nil if the
+// delivery was dropped because it couldn't be decoded.
+func (fc *FeatureClient) incoming(del *Delivery) *Delivery {
+	if del == nil {
+		return nil
+	}
+
+	if fc.transformer != nil {
+		if name, ok := del.Message.HeaderString(TransformHeader); ok && name == fc.transformName {
+			body, err := fc.transformer.Decode(del.Message.Body)
+			if err != nil {
+				fc.logError("decode "+name+" body", err)
+				fc.logError("ack undecodable message", del.Ack())
+				return nil
+			}
+
+			del.Message.Body = body
+			delete(del.Message.Headers, TransformHeader)
+		}
+	}
+
+	fc.decompress(del)
+
+	del.replier = fc
+
+	return del
+}
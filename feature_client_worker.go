@@ -0,0 +1,81 @@
+package vega
+
+import (
+	"context"
+	"sync"
+)
+
+// A pool of consumers competing for the messages on one mailbox, so
+// each message is handled by exactly one of them, unlike a Subscribe
+// where every subscriber gets a copy. Run several pools on the same
+// mailbox, in one process or many, to spread the work further.
+type Worker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lock sync.Mutex
+	err  error
+}
+
+// Declare the mailbox name and start concurrency workers handling its
+// messages with h, as HandleRequests does. If a worker fails the rest
+// are stopped, and Wait or Stop return its error.
+func (fc *FeatureClient) WorkerPool(name string, h Handler, concurrency int) (*Worker, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	err := fc.Declare(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &Worker{cancel: cancel}
+
+	w.wg.Add(concurrency)
+
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer w.wg.Done()
+
+			err := fc.HandleRequestsContext(ctx, name, h)
+			if err != nil && ctx.Err() == nil {
+				w.fail(err)
+			}
+		}()
+	}
+
+	return w, nil
+}
+
+func (w *Worker) fail(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+
+	w.cancel()
+}
+
+// Wait for the workers to stop, returning the error that stopped them
+// or nil if it was Stop
+func (w *Worker) Wait() error {
+	w.wg.Wait()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.err
+}
+
+// Stop taking new messages and wait for the ones being handled to be
+// replied to and acked. Messages not yet taken stay in the mailbox for
+// other consumers.
+func (w *Worker) Stop() error {
+	w.cancel()
+	return w.Wait()
+}
@@ -9,6 +9,9 @@ import "time"
 type MailboxStats struct {
 	Size     int
 	InFlight int
+
+	// Pollers currently waiting on the mailbox for a message
+	Watchers int
 }
 
 var EUnknownMessage = errors.New("Unknown message id")
@@ -46,6 +49,135 @@ type Delivery struct {
 	Message *Message
 	Ack     Acker
 	Nack    Nacker
+
+	// How many times the broker has handed out the message, counting
+	// this one, so 1 the first time and more once it's been nacked or
+	// its consumer went away without acking. 0 means it isn't known,
+	// because the mailbox doesn't count deliveries (see DeliveryCounter)
+	// or the broker is too old to report them.
+	DeliveryCount int
+
+	// where Reject(false) sends the message, if anywhere
+	deadLetter func(*Message) error
+
+	// what Reply pushes the reply with
+	replier Pusher
+
+	// the lease the broker was asked for and how to renew it, if the
+	// delivery came from a Client
+	lease  time.Duration
+	extend func(time.Duration) error
+}
+
+// Renew the delivery's lease so the broker holds on to it for d from
+// now rather than taking it back for another consumer, for processing
+// that takes longer than the lease asked for with WithLease. Returns
+// EUnknownMessage once the lease has run out and the message was taken
+// back, and ENotSupported for deliveries that don't come from a broker
+// connection or from brokers that predate leases.
+func (d *Delivery) Extend(dur time.Duration) error {
+	if d.extend == nil {
+		return ENotSupported
+	}
+
+	return d.extend(dur)
+}
+
+// Settle the delivery as failed. With requeue, it's nacked so the
+// message goes back to the head of its mailbox and is delivered again,
+// to this consumer or another. Without, it's acked so it isn't
+// delivered again, after being pushed to the dead-letter mailbox
+// configured by ReceiveOpts or HandleRequestsOpts if there is one.
+func (d *Delivery) Reject(requeue bool) error {
+	if requeue {
+		return d.Nack()
+	}
+
+	if d.deadLetter != nil {
+		dead := *d.Message
+		dead.MessageId = ""
+
+		err := d.deadLetter(&dead)
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.Ack()
+}
+
+// Returned by Reply for a message that has no ReplyTo
+var ENoReplyTo = errors.New("message has no ReplyTo")
+
+// Returned by Reply for a delivery that didn't come from a FeatureClient
+// or Registry, so there's nothing to push the reply with
+var ENoReplier = errors.New("delivery has no way to reply")
+
+// Returned by Reply when one of its steps failed. Replied says which:
+// when false the reply wasn't sent and the delivery is still unsettled,
+// so it can be nacked or replied to again. When true the reply was sent
+// but the ack failed, so the message may be delivered again and the
+// requester may get a second reply.
+type ReplyError struct {
+	Replied bool
+	Err     error
+}
+
+func (e *ReplyError) Error() string {
+	if e.Replied {
+		return "reply sent but ack failed: " + e.Err.Error()
+	}
+
+	return "sending reply failed: " + e.Err.Error()
+}
+
+// Send msg to the message's ReplyTo as its reply, then ack the
+// delivery, for handling requests by hand rather than with
+// HandleRequests. The reply is always sent first, so a failure never
+// loses the request: at worst it's answered twice. Returns a
+// *ReplyError if either step fails.
+func (d *Delivery) Reply(msg *Message) error {
+	if d.Message.ReplyTo == "" {
+		return ENoReplyTo
+	}
+
+	if d.replier == nil {
+		return ENoReplier
+	}
+
+	msg.CorrelationId = d.Message.CorrelationId
+
+	err := d.replier.Push(d.Message.ReplyTo, msg)
+	if err != nil {
+		return &ReplyError{Err: err}
+	}
+
+	err = d.Ack()
+	if err != nil {
+		return &ReplyError{Replied: true, Err: err}
+	}
+
+	return nil
+}
+
+// Return how long ago the message was first pushed, such as to measure
+// how long messages wait in a mailbox. Push stamps the message's
+// Timestamp if it has none, so a message pushed again keeps its first
+// Timestamp. That's by the pusher's clock, not the broker's, so the Age
+// is off by however far the two machines' clocks disagree. 0 if the
+// message has no Timestamp.
+func (d *Delivery) Age() time.Duration {
+	if d.Message.Timestamp == nil {
+		return 0
+	}
+
+	return time.Since(*d.Message.Timestamp)
+}
+
+// Report whether the message has been delivered before. False when
+// that isn't known.
+func (d *Delivery) Redelivered() bool {
+	return d.DeliveryCount > 1
 }
 
 func NewDelivery(m Mailbox, msg *Message) *Delivery {
@@ -65,6 +197,24 @@ type Storage interface {
 	LongPollCancelable(string, time.Duration, chan struct{}) (*Delivery, error)
 }
 
+// Implemented by Storage that can report how many subscribers a
+// published message was delivered to. The topic is in the message's
+// CorrelationId, as with a push to ":publish".
+type CountingPublisher interface {
+	PublishCount(*Message) (int, error)
+}
+
+// Implemented by Mailboxes that count how many times each message in
+// flight has been handed out, for Delivery.DeliveryCount
+type DeliveryCounter interface {
+	DeliveryCount(MessageId) int
+}
+
+// Implemented by Storage that can report the stats of a mailbox
+type StatsReporter interface {
+	Stats(string) (*MailboxStats, error)
+}
+
 type Pusher interface {
 	Push(string, *Message) error
 }
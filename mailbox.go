@@ -5,15 +5,23 @@ type MemMailbox struct {
 	values   []*Message
 	inflight map[MessageId]*Message
 	watchers []*watchChannel
+
+	// times each message not yet acked has been handed out
+	deliveries map[MessageId]int
 }
 
 func NewMemMailbox(name string) Mailbox {
-	return &MemMailbox{name, nil, make(map[MessageId]*Message), nil}
+	return &MemMailbox{
+		name:       name,
+		inflight:   make(map[MessageId]*Message),
+		deliveries: make(map[MessageId]int),
+	}
 }
 
 func (mm *MemMailbox) Ack(id MessageId) error {
 	if _, ok := mm.inflight[id]; ok {
 		delete(mm.inflight, id)
+		delete(mm.deliveries, id)
 		return nil
 	}
 
@@ -23,6 +31,12 @@ func (mm *MemMailbox) Ack(id MessageId) error {
 func (mm *MemMailbox) Nack(id MessageId) error {
 	if c, ok := mm.inflight[id]; ok {
 		delete(mm.inflight, id)
+
+		// Hand it straight to a waiting poller if there is one
+		if len(mm.watchers) > 0 {
+			return mm.Push(c)
+		}
+
 		mm.values = append([]*Message{c}, mm.values...)
 		return nil
 	}
@@ -32,6 +46,7 @@ func (mm *MemMailbox) Nack(id MessageId) error {
 
 func (mm *MemMailbox) Abandon() error {
 	mm.values = nil
+	mm.deliveries = make(map[MessageId]int)
 	for _, w := range mm.watchers {
 		w.indicator <- nil
 	}
@@ -49,6 +64,7 @@ func (mm *MemMailbox) Poll() (*Message, error) {
 		}
 
 		mm.inflight[val.MessageId] = val
+		mm.deliveries[val.MessageId]++
 		return val, nil
 	}
 
@@ -76,6 +92,7 @@ RETRY:
 		}
 
 		mm.inflight[value.MessageId] = value
+		mm.deliveries[value.MessageId]++
 
 		watch.indicator <- value
 		close(watch.indicator)
@@ -88,6 +105,12 @@ RETRY:
 	return nil
 }
 
+// Return how many times the message id has been handed out since it
+// was pushed, or 0 if it's been acked
+func (mm *MemMailbox) DeliveryCount(id MessageId) int {
+	return mm.deliveries[id]
+}
+
 type watchChannel struct {
 	indicator chan *Message
 	done      chan struct{}
@@ -110,8 +133,23 @@ func (mm *MemMailbox) AddWatcherCancelable(done chan struct{}) <-chan *Message {
 }
 
 func (mm *MemMailbox) Stats() *MailboxStats {
+	watchers := 0
+
+	for _, w := range mm.watchers {
+		if w.done != nil {
+			select {
+			case <-w.done:
+				continue
+			default:
+			}
+		}
+
+		watchers++
+	}
+
 	return &MailboxStats{
 		Size:     len(mm.values),
 		InFlight: len(mm.inflight),
+		Watchers: watchers,
 	}
 }
@@ -44,6 +44,32 @@ func TestMailboxAck(t *testing.T) {
 	assert.Equal(t, 0, stats.InFlight)
 }
 
+func TestMailboxDeliveryCount(t *testing.T) {
+	m := NewMemMailbox("")
+
+	dc := m.(DeliveryCounter)
+
+	m.Push(Msg([]byte("hello")))
+
+	out, _ := m.Poll()
+	assert.Equal(t, 1, dc.DeliveryCount(out.MessageId))
+
+	err := m.Nack(out.MessageId)
+	if err != nil {
+		panic(err)
+	}
+
+	out, _ = m.Poll()
+	assert.Equal(t, 2, dc.DeliveryCount(out.MessageId))
+
+	err = m.Ack(out.MessageId)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, 0, dc.DeliveryCount(out.MessageId))
+}
+
 func TestMailboxNack(t *testing.T) {
 	m := NewMemMailbox("")
 
@@ -172,3 +198,23 @@ func TestMailboxWatcherIsCancelable(t *testing.T) {
 
 	assert.True(t, msg.Equal(out))
 }
+
+func TestMailboxNackWakesWatcher(t *testing.T) {
+	m := NewMemMailbox("")
+
+	m.Push(Msg("hello"))
+
+	msg, _ := m.Poll()
+
+	indicator := m.AddWatcher()
+
+	err := m.Nack(msg.MessageId)
+	assert.NoError(t, err)
+
+	select {
+	case got := <-indicator:
+		assert.True(t, msg.Equal(got))
+	default:
+		t.Fatal("nacked message was not handed to the watcher")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -25,7 +26,8 @@ type Message struct {
 	CorrelationId   string     `codec:"correlation_id,omitempty" json:"correlation_id,omitempty"`     // correlation identifier
 	ReplyTo         string     `codec:"reply_to,omitempty" json:"reply_to,omitempty"`                 // address to to reply to
 	MessageId       MessageId  `codec:"message_id,omitempty" json:"message_id,omitempty"`             // message identifier
-	Timestamp       *time.Time `codec:"timestamp,omitempty" json:"timestamp,omitempty"`               // message timestamp
+	Timestamp       *time.Time `codec:"timestamp,omitempty" json:"timestamp,omitempty"`               // when it was pushed, by the pusher's clock
+	Expiry          *time.Time `codec:"expiry,omitempty" json:"expiry,omitempty"`                     // when the message goes stale
 	Type            string     `codec:"type,omitempty" json:"type,omitempty"`                         // message type name
 	UserId          string     `codec:"user_id,omitempty" json:"user_id,omitempty"`                   // creating user id
 	AppId           string     `codec:"app_id,omitempty" json:"app_id,omitempty"`                     // creating application id
@@ -48,6 +50,120 @@ func (m *Message) GetHeader(name string) (interface{}, bool) {
 	return v, ok
 }
 
+// Retreive an application header as a string. Strings come back as
+// []byte once a message has crossed the wire, so both are accepted.
+// Values of any other type report false.
+func (m *Message) HeaderString(name string) (string, bool) {
+	switch v := m.Headers[name].(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	default:
+		return "", false
+	}
+}
+
+// Retreive a numeric application header. The codec may decode numbers
+// as any integer type, so all of them are accepted.
+func (m *Message) headerUint(name string) (uint64, bool) {
+	switch v := m.Headers[name].(type) {
+	case uint64:
+		return v, true
+	case int64:
+		return uint64(v), v >= 0
+	case uint:
+		return uint64(v), true
+	case int:
+		return uint64(v), v >= 0
+	case uint32:
+		return uint64(v), true
+	case int32:
+		return uint64(v), v >= 0
+	case uint16:
+		return uint64(v), true
+	case int16:
+		return uint64(v), v >= 0
+	case uint8:
+		return uint64(v), true
+	case int8:
+		return uint64(v), v >= 0
+	default:
+		return 0, false
+	}
+}
+
+// Indicates the message has an Expiry and it has passed
+func (m *Message) Expired() bool {
+	return m.Expiry != nil && !time.Now().Before(*m.Expiry)
+}
+
+// Header carrying the requester's deadline, formatted as RFC3339Nano
+const DeadlineHeader = "deadline"
+
+// Return the earliest of the message's Expiry and DeadlineHeader,
+// if either is set
+func (m *Message) Deadline() (time.Time, bool) {
+	var (
+		d  time.Time
+		ok bool
+	)
+
+	if m.Expiry != nil {
+		d, ok = *m.Expiry, true
+	}
+
+	if str, has := m.HeaderString(DeadlineHeader); has {
+		if hd, err := time.Parse(time.RFC3339Nano, str); err == nil {
+			if !ok || hd.Before(d) {
+				d, ok = hd, true
+			}
+		}
+	}
+
+	return d, ok
+}
+
+// Return msg with its Timestamp set to now if it has none, as a copy so
+// the caller's message isn't changed. Messages pushed to control names
+// like :lwt aren't stamped, as they're kept to be sent later, apart from
+// :publish.
+func stamped(name string, msg *Message) *Message {
+	if msg.Timestamp != nil {
+		return msg
+	}
+
+	if strings.HasPrefix(name, ":") && name != ":publish" {
+		return msg
+	}
+
+	now := time.Now()
+
+	cp := *msg
+	cp.Timestamp = &now
+
+	return &cp
+}
+
+// Header holding a message back until the time it carries, formatted
+// as RFC3339Nano. Set by PushDelay.
+const DeliverAfterHeader = "deliver-after"
+
+// Return when the message is due to be handled, if it was delayed
+func (m *Message) DeliverAfter() (time.Time, bool) {
+	str, ok := m.HeaderString(DeliverAfterHeader)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
 // Create a message with a body
 func Msg(body interface{}) *Message {
 	var bytes []byte
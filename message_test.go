@@ -2,6 +2,7 @@ package vega
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,3 +26,71 @@ func TestMailboxGetEmpty(t *testing.T) {
 	_, ok := m.GetHeader("age")
 	assert.False(t, ok)
 }
+
+func TestMessageHeaderString(t *testing.T) {
+	m := &Message{}
+
+	m.AddHeader("a", "hello")
+	m.AddHeader("b", []byte("world"))
+	m.AddHeader("c", 34)
+
+	v, ok := m.HeaderString("a")
+	assert.True(t, ok)
+	assert.Equal(t, "hello", v)
+
+	v, ok = m.HeaderString("b")
+	assert.True(t, ok)
+	assert.Equal(t, "world", v)
+
+	_, ok = m.HeaderString("c")
+	assert.False(t, ok)
+
+	_, ok = m.HeaderString("d")
+	assert.False(t, ok)
+}
+
+func TestMessageDeliverAfter(t *testing.T) {
+	m := &Message{}
+
+	_, ok := m.DeliverAfter()
+	assert.False(t, ok)
+
+	due := time.Now().Add(time.Minute)
+	m.AddHeader(DeliverAfterHeader, []byte(due.Format(time.RFC3339Nano)))
+
+	d, ok := m.DeliverAfter()
+	assert.True(t, ok)
+	assert.True(t, d.Equal(due))
+
+	m.AddHeader(DeliverAfterHeader, "garbage")
+
+	_, ok = m.DeliverAfter()
+	assert.False(t, ok)
+}
+
+func TestMessageDeadline(t *testing.T) {
+	m := &Message{}
+
+	_, ok := m.Deadline()
+	assert.False(t, ok)
+
+	expiry := time.Now().Add(time.Minute)
+	m.Expiry = &expiry
+
+	d, ok := m.Deadline()
+	assert.True(t, ok)
+	assert.True(t, d.Equal(expiry))
+
+	sooner := time.Now().Add(time.Second)
+	m.AddHeader(DeadlineHeader, []byte(sooner.Format(time.RFC3339Nano)))
+
+	d, ok = m.Deadline()
+	assert.True(t, ok)
+	assert.True(t, d.Equal(sooner))
+
+	m.AddHeader(DeadlineHeader, "garbage")
+
+	d, ok = m.Deadline()
+	assert.True(t, ok)
+	assert.True(t, d.Equal(expiry))
+}
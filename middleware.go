@@ -0,0 +1,104 @@
+package vega
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Wraps a Handler to add behavior around it
+type Middleware func(Handler) Handler
+
+// Wrap h in mw, with the first middleware outermost so it sees each
+// message first and each reply last.
+func Chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+
+	return h
+}
+
+// Log each message handled, how long it took and whether the reply was
+// an error. If logger is nil, the standard logger is used.
+func LoggingMiddleware(logger *log.Logger) Middleware {
+	printf := log.Printf
+	if logger != nil {
+		printf = logger.Printf
+	}
+
+	return func(h Handler) Handler {
+		return ContextHandlerFunc(func(ctx context.Context, msg *Message) *Message {
+			start := time.Now()
+
+			ret := handleContext(ctx, h, msg)
+
+			status := "ok"
+			if ret != nil && ret.Type == cErrorType {
+				status = "error: " + string(ret.Body)
+			}
+
+			printf("handled message type=%q correlation=%q in %s, %s",
+				msg.Type, msg.CorrelationId, time.Since(start), status)
+
+			return ret
+		})
+	}
+}
+
+// Recover from a panic in the handler, replying with ErrorMsg of a
+// *PanicError instead.
+func RecoverMiddleware(h Handler) Handler {
+	return ContextHandlerFunc(func(ctx context.Context, msg *Message) *Message {
+		ret, perr := callHandler(ctx, h, msg)
+		if perr != nil {
+			return ErrorMsg(perr)
+		}
+
+		return ret
+	})
+}
+
+// Handle each request carrying an IdempotencyKeyHeader only once
+// within ttl. The reply is stored in store, and a repeat of the request
+// gets the stored reply without the handler seeing it again. Error
+// replies aren't stored, so a failed request can be retried. Requests
+// without the header are always handled.
+//
+// Repeats that arrive while the first is still being handled aren't
+// caught, both are handled.
+func DedupMiddleware(store DedupStore, ttl time.Duration) Middleware {
+	return func(h Handler) Handler {
+		return ContextHandlerFunc(func(ctx context.Context, msg *Message) *Message {
+			key, ok := msg.HeaderString(IdempotencyKeyHeader)
+			if !ok || key == "" {
+				return handleContext(ctx, h, msg)
+			}
+
+			reply, seen, err := store.Get(key)
+			if err != nil {
+				return ErrorMsg(err)
+			}
+
+			if seen {
+				debugf("replaying reply for idempotency key %s\n", key)
+				return reply
+			}
+
+			ret := handleContext(ctx, h, msg)
+
+			if ret != nil {
+				switch ret.Type {
+				case cErrorType, cRejectType, cRequeueType:
+					return ret
+				}
+			}
+
+			// The handler has run, so there's nothing better to do with
+			// a failure to store the reply than send it anyway
+			store.Set(key, ret, ttl)
+
+			return ret
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package vega
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+
+	mark := func(name string) Middleware {
+		return func(h Handler) Handler {
+			return HandlerFunc(func(msg *Message) *Message {
+				order = append(order, name)
+				return h.HandleMessage(msg)
+			})
+		}
+	}
+
+	h := Chain(HandlerFunc(func(msg *Message) *Message {
+		order = append(order, "handler")
+		return msg
+	}), mark("a"), mark("b"))
+
+	h.HandleMessage(Msg("hello"))
+
+	assert.Equal(t, []string{"a", "b", "handler"}, order)
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	h := Chain(HandlerFunc(func(msg *Message) *Message {
+		panic("boom")
+	}), RecoverMiddleware)
+
+	ret := h.HandleMessage(Msg("hello"))
+
+	assert.Equal(t, cErrorType, ret.Type)
+	assert.Equal(t, "handler panic: boom", string(ret.Body))
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+
+	h := Chain(HandlerFunc(func(msg *Message) *Message {
+		return msg
+	}), LoggingMiddleware(log.New(&buf, "", 0)))
+
+	msg := Msg("hello")
+	msg.Type = "greet"
+
+	ret := h.HandleMessage(msg)
+
+	assert.Equal(t, msg, ret)
+	assert.Contains(t, buf.String(), `type="greet"`)
+}
+
+func TestDedupMiddleware(t *testing.T) {
+	calls := 0
+
+	h := Chain(HandlerFunc(func(msg *Message) *Message {
+		calls++
+
+		if string(msg.Body) == "fail" {
+			return ErrorMsg(errors.New("failed"))
+		}
+
+		return Msg(fmt.Sprintf("reply %d", calls))
+	}), DedupMiddleware(NewMemDedupStore(), time.Minute))
+
+	req := func(key, body string) *Message {
+		msg := Msg(body)
+		if key != "" {
+			msg.AddHeader(IdempotencyKeyHeader, key)
+		}
+
+		return msg
+	}
+
+	ret := h.HandleMessage(req("a", "hello"))
+	assert.Equal(t, "reply 1", string(ret.Body))
+
+	ret = h.HandleMessage(req("a", "hello"))
+	assert.Equal(t, "reply 1", string(ret.Body))
+	assert.Equal(t, 1, calls, "repeat was handled again")
+
+	ret = h.HandleMessage(req("b", "hello"))
+	assert.Equal(t, "reply 2", string(ret.Body))
+
+	// without a key every request is handled
+	h.HandleMessage(req("", "hello"))
+	h.HandleMessage(req("", "hello"))
+	assert.Equal(t, 4, calls)
+
+	// failures can be retried
+	h.HandleMessage(req("c", "fail"))
+	h.HandleMessage(req("c", "fail"))
+	assert.Equal(t, 6, calls)
+}
+
+func TestDedupMiddlewareExpiry(t *testing.T) {
+	calls := 0
+
+	h := Chain(HandlerFunc(func(msg *Message) *Message {
+		calls++
+		return nil
+	}), DedupMiddleware(NewMemDedupStore(), 20*time.Millisecond))
+
+	msg := Msg("hello")
+	msg.AddHeader(IdempotencyKeyHeader, "a")
+
+	assert.Nil(t, h.HandleMessage(msg))
+	assert.Nil(t, h.HandleMessage(msg))
+	assert.Equal(t, 1, calls)
+
+	time.Sleep(30 * time.Millisecond)
+
+	h.HandleMessage(msg)
+	assert.Equal(t, 2, calls, "request wasn't handled again after the ttl")
+}
+
+func TestMemDedupStoreCopiesReplies(t *testing.T) {
+	s := NewMemDedupStore()
+
+	reply := Msg("hello")
+
+	err := s.Set("a", reply, time.Minute)
+	require.NoError(t, err)
+
+	reply.CorrelationId = "changed"
+
+	got, ok, err := s.Get("a")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	assert.Equal(t, "", got.CorrelationId)
+
+	got.CorrelationId = "changed"
+
+	again, _, _ := s.Get("a")
+	assert.Equal(t, "", again.CorrelationId)
+}
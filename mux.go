@@ -0,0 +1,62 @@
+package vega
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var EUnknownType = errors.New("unknown message type")
+
+// Dispatches messages to the Handler registered for their Type. A
+// MessageMux is itself a Handler so it can be passed to HandleRequests.
+type MessageMux struct {
+	// Handles messages with no registered handler. When nil, the reply
+	// is ErrorMsg(EUnknownType).
+	NotFound Handler
+
+	lock     sync.RWMutex
+	handlers map[string]Handler
+}
+
+func NewMessageMux() *MessageMux {
+	return &MessageMux{handlers: make(map[string]Handler)}
+}
+
+// Register h to handle messages of the given type
+func (mm *MessageMux) Handle(msgType string, h Handler) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+
+	if mm.handlers == nil {
+		mm.handlers = make(map[string]Handler)
+	}
+
+	mm.handlers[msgType] = h
+}
+
+// Register f to handle messages of the given type
+func (mm *MessageMux) HandleFunc(msgType string, f func(*Message) *Message) {
+	mm.Handle(msgType, HandlerFunc(f))
+}
+
+func (mm *MessageMux) HandleMessage(m *Message) *Message {
+	return mm.HandleMessageContext(context.Background(), m)
+}
+
+// Dispatch m, passing ctx on to handlers that take a context
+func (mm *MessageMux) HandleMessageContext(ctx context.Context, m *Message) *Message {
+	mm.lock.RLock()
+	h, ok := mm.handlers[m.Type]
+	mm.lock.RUnlock()
+
+	if ok {
+		return handleContext(ctx, h, m)
+	}
+
+	if mm.NotFound != nil {
+		return handleContext(ctx, mm.NotFound, m)
+	}
+
+	return ErrorMsg(EUnknownType)
+}
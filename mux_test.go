@@ -0,0 +1,64 @@
+package vega
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageMuxDispatchesByType(t *testing.T) {
+	mux := NewMessageMux()
+
+	mux.HandleFunc("greet", func(m *Message) *Message {
+		return Msg("hello " + string(m.Body))
+	})
+
+	mux.HandleFunc("part", func(m *Message) *Message {
+		return Msg("bye " + string(m.Body))
+	})
+
+	ret := mux.HandleMessage(&Message{Type: "greet", Body: []byte("evan")})
+	assert.Equal(t, "hello evan", string(ret.Body))
+
+	ret = mux.HandleMessage(&Message{Type: "part", Body: []byte("evan")})
+	assert.Equal(t, "bye evan", string(ret.Body))
+}
+
+func TestMessageMuxUnknownType(t *testing.T) {
+	mux := NewMessageMux()
+
+	ret := mux.HandleMessage(&Message{Type: "nope"})
+	assert.Equal(t, cErrorType, ret.Type)
+	assert.Equal(t, EUnknownType.Error(), string(ret.Body))
+
+	mux.NotFound = HandlerFunc(func(m *Message) *Message {
+		return Msg("fallback")
+	})
+
+	ret = mux.HandleMessage(&Message{Type: "nope"})
+	assert.Equal(t, "fallback", string(ret.Body))
+}
+
+func TestMessageMuxPassesContext(t *testing.T) {
+	type key struct{}
+
+	mux := NewMessageMux()
+
+	mux.Handle("greet", ContextHandlerFunc(func(ctx context.Context, m *Message) *Message {
+		name, _ := ctx.Value(key{}).(string)
+		return Msg("hello " + name)
+	}))
+
+	h := Chain(mux, RecoverMiddleware, LoggingMiddleware(log.New(ioutil.Discard, "", 0)))
+
+	ctx := context.WithValue(context.Background(), key{}, "evan")
+
+	ret := ContextHandler(h).HandleMessageContext(ctx, &Message{Type: "greet"})
+	assert.Equal(t, "hello evan", string(ret.Body))
+
+	ret = h.HandleMessage(&Message{Type: "greet"})
+	assert.Equal(t, "hello ", string(ret.Body))
+}
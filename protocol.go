@@ -18,6 +18,13 @@ const (
 	AckType
 	StatsType
 	StatsResultType
+	PushBatchType
+	PushBatchResultType
+	PublishCountType
+	PublishCountResultType
+	QueueStatsType
+	QueueStatsResultType
+	ExtendType
 )
 
 type Error struct {
@@ -32,17 +39,25 @@ type Abandon struct {
 	Name string
 }
 
+// Lease, when set, is how long the broker waits for the delivered
+// message to be acked, nacked or extended before it takes it back. It's
+// ignored by brokers that predate leases.
 type Poll struct {
-	Name string
+	Name  string
+	Lease string
 }
 
 type LongPoll struct {
 	Name     string
 	Duration string
+	Lease    string
 }
 
 type PollResult struct {
 	Message *Message
+
+	// From Delivery.DeliveryCount, 0 from brokers that predate it
+	DeliveryCount int
 }
 
 type Push struct {
@@ -50,6 +65,29 @@ type Push struct {
 	Message *Message
 }
 
+type PushBatch struct {
+	Name     string
+	Messages []*Message
+}
+
+// Errors has an entry for each message in the batch, empty if it
+// was pushed.
+type PushBatchResult struct {
+	Errors []string
+}
+
+type PublishCount struct {
+	Message *Message
+}
+
+type PublishCountResult struct {
+	Count int
+}
+
+type QueueStats struct {
+	Name string
+}
+
 type NackMessage struct {
 	MessageId MessageId
 }
@@ -58,6 +96,11 @@ type AckMessage struct {
 	MessageId MessageId
 }
 
+type Extend struct {
+	MessageId MessageId
+	Lease     string
+}
+
 type ClientStats struct {
 	InFlight int
 }
@@ -12,6 +12,16 @@ type Registry struct {
 
 	mailboxes map[string]Mailbox
 	creator   func(string) Mailbox
+
+	subscriptions []*topicSubscription
+}
+
+// A mailbox subscribed to the topics a TopicMatcher matches
+type topicSubscription struct {
+	Pattern string
+	Mailbox string
+
+	matcher TopicMatcher
 }
 
 func NewRegistry(create func(string) Mailbox) *Registry {
@@ -27,60 +37,26 @@ func NewMemRegistry() *Registry {
 
 func (r *Registry) Poll(name string) (*Delivery, error) {
 	r.Lock()
-	defer r.Unlock()
-
-	if mailbox, ok := r.mailboxes[name]; ok {
-		msg, err := mailbox.Poll()
-		if err != nil {
-			return nil, err
-		}
-
-		if msg == nil {
-			return nil, nil
-		}
-
-		return NewDelivery(mailbox, msg), nil
-	}
-
-	return nil, nil
-}
-
-func (r *Registry) LongPoll(name string, til time.Duration) (*Delivery, error) {
-	r.Lock()
 
 	mailbox, ok := r.mailboxes[name]
 	if !ok {
-		debugf("missing mailbox %s\n", name)
-		r.Unlock()
-		return nil, errors.Subject(ENoMailbox, name)
-	}
-
-	debugf("long polling %s: %#v\n", name, mailbox)
-	val, err := mailbox.Poll()
-	if err != nil {
-		r.Unlock()
-		return nil, err
-	}
-
-	if val != nil {
 		r.Unlock()
-		return NewDelivery(mailbox, val), nil
+		return nil, nil
 	}
 
-	indicator := mailbox.AddWatcher()
+	msg, err := mailbox.Poll()
 
 	r.Unlock()
 
-	select {
-	case val := <-indicator:
-		if val == nil {
-			return nil, nil
-		}
-
-		return NewDelivery(mailbox, val), nil
-	case <-time.Tick(til):
-		return nil, nil
+	if err != nil || msg == nil {
+		return nil, err
 	}
+
+	return r.newDelivery(mailbox, msg), nil
+}
+
+func (r *Registry) LongPoll(name string, til time.Duration) (*Delivery, error) {
+	return r.LongPollCancelable(name, til, nil)
 }
 
 func (r *Registry) LongPollCancelable(name string, til time.Duration, done chan struct{}) (*Delivery, error) {
@@ -102,27 +78,28 @@ func (r *Registry) LongPollCancelable(name string, til time.Duration, done chan
 
 	if val != nil {
 		r.Unlock()
-		return NewDelivery(mailbox, val), nil
+		return r.newDelivery(mailbox, val), nil
 	}
 
-	indicator := mailbox.AddWatcherCancelable(done)
+	// The watcher gets its own stop channel so that it's removed when
+	// this poll ends for any reason. Otherwise a timed out watcher would
+	// swallow the next message pushed.
+	stop := make(chan struct{})
+
+	indicator := mailbox.AddWatcherCancelable(stop)
 
 	r.Unlock()
 
+	timer := time.NewTimer(til)
+	defer timer.Stop()
+
 	select {
 	case <-done:
 		// It's possible for both done and indicator to have values.
 		// So we need to also check if there a value in indicator and
 		// if so, pull it out and nack it.
 
-		select {
-		case val := <-indicator:
-			if val != nil {
-				mailbox.Nack(val.MessageId)
-			}
-		default:
-		}
-
+		r.stopWatching(mailbox, stop, indicator, true)
 		return nil, nil
 	case val := <-indicator:
 		// It's possible for both done and indicator to have values.
@@ -132,7 +109,9 @@ func (r *Registry) LongPollCancelable(name string, til time.Duration, done chan
 		select {
 		case <-done:
 			if val != nil {
+				r.Lock()
 				mailbox.Nack(val.MessageId)
+				r.Unlock()
 				return nil, nil
 			}
 		default:
@@ -142,18 +121,97 @@ func (r *Registry) LongPollCancelable(name string, til time.Duration, done chan
 			return nil, nil
 		}
 
-		return NewDelivery(mailbox, val), nil
-	case <-time.Tick(til):
-		return nil, nil
+		return r.newDelivery(mailbox, val), nil
+	case <-timer.C:
+		val := r.stopWatching(mailbox, stop, indicator, false)
+		if val == nil {
+			return nil, nil
+		}
+
+		return r.newDelivery(mailbox, val), nil
+	}
+}
+
+// Remove the watcher using stop, returning any message that was handed
+// to it in the meantime. If nack is set, that message is nacked instead.
+func (r *Registry) stopWatching(mailbox Mailbox, stop chan struct{}, indicator <-chan *Message, nack bool) *Message {
+	r.Lock()
+	defer r.Unlock()
+
+	close(stop)
+
+	select {
+	case val := <-indicator:
+		if val != nil && nack {
+			mailbox.Nack(val.MessageId)
+			return nil
+		}
+
+		return val
+	default:
+		return nil
+	}
+}
+
+// Create a Delivery whose Ack and Nack hold the registry lock, since
+// mailboxes aren't safe to use concurrently. Must be called without
+// the lock held.
+func (r *Registry) newDelivery(m Mailbox, msg *Message) *Delivery {
+	count := 0
+
+	if dc, ok := m.(DeliveryCounter); ok {
+		r.Lock()
+		count = dc.DeliveryCount(msg.MessageId)
+		r.Unlock()
+	}
+
+	return &Delivery{
+		Message:       msg,
+		DeliveryCount: count,
+		replier:       r,
+		Ack: func() error {
+			r.Lock()
+			defer r.Unlock()
+
+			return m.Ack(msg.MessageId)
+		},
+		Nack: func() error {
+			r.Lock()
+			defer r.Unlock()
+
+			return m.Nack(msg.MessageId)
+		},
 	}
 }
 
 var ENoMailbox = errors.New("No such mailbox available")
 
+// Return the stats of the mailbox name
+func (r *Registry) Stats(name string) (*MailboxStats, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if mailbox, ok := r.mailboxes[name]; ok {
+		return mailbox.Stats(), nil
+	}
+
+	return nil, errors.Subject(ENoMailbox, name)
+}
+
 func (r *Registry) Push(name string, value *Message) error {
+	value = stamped(name, value)
+
 	r.Lock()
 	defer r.Unlock()
 
+	switch name {
+	case ":subscribe":
+		return r.subscribe(value)
+	case ":publish":
+		_, err := r.publish(value)
+		return err
+	}
+
 	if mailbox, ok := r.mailboxes[name]; ok {
 		return mailbox.Push(value)
 	}
@@ -183,5 +241,92 @@ func (r *Registry) Abandon(name string) error {
 		delete(r.mailboxes, name)
 	}
 
+	r.unsubscribe(name)
+
 	return nil
 }
+
+// Register msg.ReplyTo to receive messages published to topics matching
+// the pattern in msg.CorrelationId, as a TopicMatcher does
+func (r *Registry) subscribe(msg *Message) error {
+	if _, ok := r.mailboxes[msg.ReplyTo]; !ok {
+		return errors.Subject(ENoMailbox, msg.ReplyTo)
+	}
+
+	for _, sub := range r.subscriptions {
+		if sub.Mailbox == msg.ReplyTo && sub.Pattern == msg.CorrelationId {
+			return nil
+		}
+	}
+
+	r.subscriptions = append(r.subscriptions, &topicSubscription{
+		Pattern: msg.CorrelationId,
+		Mailbox: msg.ReplyTo,
+		matcher: NewTopicMatcher(msg.CorrelationId),
+	})
+
+	return nil
+}
+
+// Publish msg like a push to ":publish", returning how many mailboxes
+// it was pushed to
+func (r *Registry) PublishCount(msg *Message) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.publish(msg)
+}
+
+// Push a copy of msg to every mailbox subscribed to the topic in
+// msg.CorrelationId, forgetting subscribers whose mailbox is gone.
+// Returns how many mailboxes it was pushed to.
+func (r *Registry) publish(msg *Message) (int, error) {
+	var (
+		final error
+		count int
+	)
+
+	live := r.subscriptions[:0]
+
+	for _, sub := range r.subscriptions {
+		mailbox, ok := r.mailboxes[sub.Mailbox]
+		if !ok {
+			debugf("pruning subscriber %s\n", sub.Mailbox)
+			continue
+		}
+
+		live = append(live, sub)
+
+		if !sub.matcher.Match(msg.CorrelationId) {
+			continue
+		}
+
+		cp := *msg
+		cp.MessageId = ""
+
+		err := mailbox.Push(&cp)
+		if err != nil {
+			final = err
+			continue
+		}
+
+		count++
+	}
+
+	r.subscriptions = live
+
+	return count, final
+}
+
+// Remove all subscriptions delivering to mailbox name
+func (r *Registry) unsubscribe(name string) {
+	live := r.subscriptions[:0]
+
+	for _, sub := range r.subscriptions {
+		if sub.Mailbox != name {
+			live = append(live, sub)
+		}
+	}
+
+	r.subscriptions = live
+}
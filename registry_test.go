@@ -120,3 +120,142 @@ func TestLongPollRegistryIsCancelable(t *testing.T) {
 	assert.NotNil(t, try)
 	assert.True(t, msg.Equal(try.Message))
 }
+
+func TestRegistryPublish(t *testing.T) {
+	r := NewMemRegistry()
+
+	r.Declare("a")
+	r.Declare("b")
+
+	err := r.Push(":subscribe", &Message{ReplyTo: "a", CorrelationId: "foo/+"})
+	assert.NoError(t, err)
+
+	err = r.Push(":subscribe", &Message{ReplyTo: "b", CorrelationId: "foo/bar"})
+	assert.NoError(t, err)
+
+	err = r.Push(":publish", &Message{CorrelationId: "foo/bar", Body: []byte("hello")})
+	assert.NoError(t, err)
+
+	for _, name := range []string{"a", "b"} {
+		del, _ := r.Poll(name)
+		if assert.NotNil(t, del, name) {
+			assert.Equal(t, []byte("hello"), del.Message.Body)
+		}
+	}
+
+	err = r.Push(":publish", &Message{CorrelationId: "foo/baz"})
+	assert.NoError(t, err)
+
+	del, _ := r.Poll("b")
+	assert.Nil(t, del)
+
+	r.Abandon("a")
+
+	assert.Equal(t, 1, len(r.subscriptions))
+}
+
+func TestRegistryPublishPrunesMissingMailboxes(t *testing.T) {
+	r := NewMemRegistry()
+
+	r.Declare("a")
+
+	err := r.Push(":subscribe", &Message{ReplyTo: "a", CorrelationId: "foo"})
+	assert.NoError(t, err)
+
+	delete(r.mailboxes, "a")
+
+	err = r.Push(":publish", &Message{CorrelationId: "foo"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, len(r.subscriptions))
+}
+
+func TestRegistryPublishCount(t *testing.T) {
+	r := NewMemRegistry()
+
+	r.Declare("a")
+	r.Declare("b")
+
+	r.Push(":subscribe", &Message{ReplyTo: "a", CorrelationId: "foo/+"})
+	r.Push(":subscribe", &Message{ReplyTo: "b", CorrelationId: "foo/bar"})
+
+	n, err := r.PublishCount(&Message{CorrelationId: "foo/bar"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = r.PublishCount(&Message{CorrelationId: "foo/baz"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	delete(r.mailboxes, "a")
+
+	n, err = r.PublishCount(&Message{CorrelationId: "foo/baz"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestLongPollRegistryTimeoutDoesNotLoseMessages(t *testing.T) {
+	r := NewMemRegistry()
+
+	r.Declare("a")
+
+	del, err := r.LongPoll("a", 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Nil(t, del)
+
+	msg := Msg([]byte("hello"))
+
+	r.Push("a", msg)
+
+	del, err = r.Poll("a")
+	assert.NoError(t, err)
+
+	if assert.NotNil(t, del, "message went to a timed out watcher") {
+		assert.True(t, msg.Equal(del.Message))
+	}
+}
+
+func TestRegistryDeliveryReply(t *testing.T) {
+	r := NewMemRegistry()
+
+	r.Declare("a")
+	r.Declare("replies")
+
+	r.Push("a", Msg("no reply wanted"))
+
+	del, _ := r.Poll("a")
+	assert.Equal(t, ENoReplyTo, del.Reply(Msg("hello")))
+	del.Ack()
+
+	req := Msg("hello")
+	req.ReplyTo = "replies"
+	req.CorrelationId = "1"
+
+	r.Push("a", req)
+
+	del, _ = r.Poll("a")
+	assert.NoError(t, del.Reply(Msg("re: hello")))
+
+	stats, _ := r.Stats("a")
+	assert.Equal(t, 0, stats.InFlight)
+
+	reply, _ := r.Poll("replies")
+	assert.Equal(t, "re: hello", string(reply.Message.Body))
+	assert.Equal(t, "1", reply.Message.CorrelationId)
+
+	// A failed ack is reported as such, after the reply was sent
+	del = &Delivery{
+		Message: req,
+		Ack:     func() error { return EUnknownMessage },
+		replier: r,
+	}
+
+	err := del.Reply(Msg("again"))
+
+	rerr, ok := err.(*ReplyError)
+	assert.True(t, ok)
+	assert.True(t, rerr.Replied)
+	assert.Equal(t, EUnknownMessage, rerr.Err)
+
+	assert.Equal(t, ENoReplier, (&Delivery{Message: req}).Reply(Msg("again")))
+}
@@ -1,8 +1,11 @@
 package vega
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -105,6 +108,36 @@ func (s *Service) Accept() error {
 	return nil
 }
 
+// Accept connections secured with TLS using cfg. Client certificate
+// verification is controlled by cfg.ClientAuth and cfg.ClientCAs.
+func (s *Service) AcceptTLS(cfg *tls.Config) error {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.wg.Add(1)
+		go s.acceptTLS(conn, cfg)
+	}
+}
+
+func (s *Service) acceptTLS(c net.Conn, cfg *tls.Config) {
+	tc := tls.Server(c, cfg)
+
+	err := tc.Handshake()
+	if err != nil {
+		debugf("tls handshake with %s failed: %s\n", c.RemoteAddr(), err)
+		c.Close()
+		s.wg.Done()
+		return
+	}
+
+	s.acceptMux(tc)
+}
+
 func eofish(err error) bool {
 	if err == io.EOF {
 		return true
@@ -133,6 +166,7 @@ type clientData struct {
 	parent     net.Conn
 	session    *yamux.Session
 	inflight   map[MessageId]*Delivery
+	leases     map[MessageId]*time.Timer
 	ephemerals map[string]*clientEphemeralInfo
 	closed     bool
 	done       chan struct{}
@@ -170,6 +204,12 @@ func (s *Service) cleanupConn(c net.Conn, data *clientData) {
 		data.inflight = nil
 	}
 
+	for _, t := range data.leases {
+		t.Stop()
+	}
+
+	data.leases = nil
+
 	for name, info := range data.ephemerals {
 		s.Registry.Abandon(name)
 		if info.lwt != nil {
@@ -330,6 +370,58 @@ func (s *Service) handle(parent, c net.Conn, data *clientData) {
 			}
 
 			err = s.handlePush(c, msg, data)
+		case PushBatchType:
+			msg := &PushBatch{}
+			dec := codec.NewDecoder(c, &msgpack)
+
+			err = dec.Decode(msg)
+			if err != nil {
+				if eofish(err) {
+					return
+				}
+
+				panic(err)
+			}
+
+			err = s.handlePushBatch(c, msg, data)
+		case PublishCountType:
+			msg := &PublishCount{}
+			dec := codec.NewDecoder(c, &msgpack)
+
+			err = dec.Decode(msg)
+			if err != nil {
+				if eofish(err) {
+					return
+				}
+
+				panic(err)
+			}
+
+			err = s.handlePublishCount(c, msg)
+		case ExtendType:
+			msg := &Extend{}
+			dec := codec.NewDecoder(c, &msgpack)
+
+			err = dec.Decode(msg)
+			if err != nil {
+				return
+			}
+
+			err = s.handleExtend(c, msg, data)
+		case QueueStatsType:
+			msg := &QueueStats{}
+			dec := codec.NewDecoder(c, &msgpack)
+
+			err = dec.Decode(msg)
+			if err != nil {
+				if eofish(err) {
+					return
+				}
+
+				panic(err)
+			}
+
+			err = s.handleQueueStats(c, msg)
 		case CloseType:
 			err = s.handleClose(c, parent, data)
 		case StatsType:
@@ -414,7 +506,14 @@ func (s *Service) handleAbandon(c net.Conn, msg *Abandon, data *clientData) erro
 		return err
 	}
 
-	if info, ok := data.ephemerals[msg.Name]; ok {
+	s.lock.Lock()
+
+	info, ok := data.ephemerals[msg.Name]
+	delete(data.ephemerals, msg.Name)
+
+	s.lock.Unlock()
+
+	if ok {
 		if info.lwt != nil {
 			debugf("injecting ephemeral lwt 2 to %s\n", info.lwt.ReplyTo)
 			name := info.lwt.ReplyTo
@@ -436,14 +535,20 @@ func (s *Service) handlePoll(c net.Conn, msg *Poll, data *clientData) error {
 	if msg.Name == ":lwt" {
 		ret.Message = data.lwt
 	} else {
+		lease, err := parseLease(msg.Lease)
+		if err != nil {
+			return err
+		}
+
 		val, err := s.Registry.Poll(msg.Name)
 		if err != nil {
 			return err
 		}
 
 		if val != nil {
-			data.inflight[val.Message.MessageId] = val
+			s.addInflight(data, val, lease)
 			ret.Message = val.Message
+			ret.DeliveryCount = val.DeliveryCount
 		}
 	}
 
@@ -465,21 +570,111 @@ func (s *Service) handleLongPoll(c net.Conn, msg *LongPoll, data *clientData) er
 			return err
 		}
 
-		val, err := s.Registry.LongPollCancelable(msg.Name, dur, data.done)
+		lease, err := parseLease(msg.Lease)
+		if err != nil {
+			return err
+		}
+
+		done, stop := watchStream(c, data.done)
+
+		val, err := s.Registry.LongPollCancelable(msg.Name, dur, done)
+
+		ended := stop()
+
 		if err != nil {
 			return err
 		}
 
+		if val != nil && ended {
+			// The client stopped waiting, so nobody would get it
+			debugf("long poll on %s canceled, putting back %s\n", msg.Name, val.Message.MessageId)
+			val.Nack()
+			val = nil
+		}
+
 		if val != nil {
 			debugf("inflight for %s: %#v\n", data.parent.RemoteAddr(), data)
-			data.inflight[val.Message.MessageId] = val
+			s.addInflight(data, val, lease)
 			ret.Message = val.Message
+			ret.DeliveryCount = val.DeliveryCount
 		}
 	}
 
 	c.Write([]byte{uint8(PollResultType)})
 	enc := codec.NewEncoder(c, &msgpack)
-	return enc.Encode(&ret)
+
+	err := enc.Encode(&ret)
+	if err != nil && ret.Message != nil && msg.Name != ":lwt" {
+		s.takeBack(data, ret.Message.MessageId)
+	}
+
+	return err
+}
+
+// Return a channel that's closed once the client ends the stream c, as
+// it does to cancel a long poll, or connDone is closed. The broker isn't
+// reading from c while a poll waits, so anything arriving on it counts
+// as the end. stop must be called once the poll is over, and reports
+// whether the stream ended; if it didn't, c is left as it was for the
+// next request.
+func watchStream(c net.Conn, connDone chan struct{}) (chan struct{}, func() bool) {
+	done := make(chan struct{})
+	read := make(chan bool, 1)
+	finished := make(chan struct{})
+
+	go func() {
+		buf := []byte{0}
+
+		_, err := c.Read(buf)
+
+		ne, ok := err.(net.Error)
+		read <- !(ok && ne.Timeout())
+	}()
+
+	go func() {
+		defer close(done)
+
+		select {
+		case <-connDone:
+		case ended := <-read:
+			read <- ended
+		case <-finished:
+		}
+	}()
+
+	stop := func() bool {
+		close(finished)
+
+		// Wake the reader, which then reports whether it saw the end
+		// first
+		c.SetReadDeadline(time.Now())
+		ended := <-read
+		c.SetReadDeadline(time.Time{})
+
+		<-done
+
+		return ended
+	}
+
+	return done, stop
+}
+
+// Take the message id back from the client and return it to its
+// mailbox, such as when it couldn't be sent
+func (s *Service) takeBack(data *clientData, id MessageId) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	del, ok := data.inflight[id]
+	if !ok {
+		return
+	}
+
+	delete(data.inflight, id)
+	s.endLeaseLocked(data, id)
+
+	debugf("couldn't send %s, taking it back\n", id)
+	del.Nack()
 }
 
 func (s *Service) setupLWT(msg *Message, data *clientData) error {
@@ -538,6 +733,67 @@ func (s *Service) handlePush(c net.Conn, msg *Push, data *clientData) error {
 	return err
 }
 
+func (s *Service) handlePushBatch(c net.Conn, msg *PushBatch, data *clientData) error {
+	var ret PushBatchResult
+
+	for _, m := range msg.Messages {
+		var err error
+
+		if msg.Name[0] == ':' {
+			err = s.handleInternal(c, &Push{Name: msg.Name, Message: m}, data)
+		} else {
+			err = s.Registry.Push(msg.Name, m)
+		}
+
+		if err != nil {
+			ret.Errors = append(ret.Errors, err.Error())
+		} else {
+			ret.Errors = append(ret.Errors, "")
+		}
+	}
+
+	c.Write([]byte{uint8(PushBatchResultType)})
+	enc := codec.NewEncoder(c, &msgpack)
+	return enc.Encode(&ret)
+}
+
+var EPublishCountUnsupported = errors.New("publish counts not supported by this broker")
+
+func (s *Service) handlePublishCount(c net.Conn, msg *PublishCount) error {
+	cp, ok := s.Registry.(CountingPublisher)
+	if !ok {
+		return EPublishCountUnsupported
+	}
+
+	count, err := cp.PublishCount(msg.Message)
+	if err != nil {
+		return err
+	}
+
+	c.Write([]byte{uint8(PublishCountResultType)})
+	enc := codec.NewEncoder(c, &msgpack)
+	return enc.Encode(&PublishCountResult{Count: count})
+}
+
+// Returned when the broker doesn't implement an optional operation
+var ENotSupported = errors.New("not supported by this broker")
+
+func (s *Service) handleQueueStats(c net.Conn, msg *QueueStats) error {
+	sr, ok := s.Registry.(StatsReporter)
+	if !ok {
+		return ENotSupported
+	}
+
+	stats, err := sr.Stats(msg.Name)
+	if err != nil {
+		return err
+	}
+
+	c.Write([]byte{uint8(QueueStatsResultType)})
+	enc := codec.NewEncoder(c, &msgpack)
+	return enc.Encode(stats)
+}
+
 func (s *Service) handleClose(c, parent net.Conn, data *clientData) error {
 	s.cleanupConn(parent, data)
 
@@ -545,10 +801,106 @@ func (s *Service) handleClose(c, parent net.Conn, data *clientData) error {
 	return err
 }
 
+// Track del as delivered to the client until it's acked or nacked, or
+// lease passes if it's set. Streams on a connection are handled
+// concurrently, so inflight and leases are guarded by s.lock.
+func (s *Service) addInflight(data *clientData, del *Delivery, lease time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if data.inflight == nil {
+		// The connection was cleaned up while this was being delivered
+		del.Nack()
+		return
+	}
+
+	data.inflight[del.Message.MessageId] = del
+
+	if lease > 0 {
+		s.leaseLocked(data, del.Message.MessageId, lease)
+	}
+}
+
+// An empty lease is none, for clients that don't ask for one
+func parseLease(lease string) (time.Duration, error) {
+	if lease == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(lease)
+}
+
+// Take the message id back from the client once lease passes, replacing
+// any lease it already had. Must be called with s.lock held.
+func (s *Service) leaseLocked(data *clientData, id MessageId, lease time.Duration) {
+	if t, ok := data.leases[id]; ok {
+		t.Stop()
+	}
+
+	if data.leases == nil {
+		data.leases = make(map[MessageId]*time.Timer)
+	}
+
+	var t *time.Timer
+
+	t = time.AfterFunc(lease, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if data.leases[id] != t {
+			return
+		}
+
+		delete(data.leases, id)
+
+		if del, ok := data.inflight[id]; ok {
+			debugf("lease on %s expired, taking it back\n", id)
+			delete(data.inflight, id)
+			del.Nack()
+		}
+	})
+
+	data.leases[id] = t
+}
+
+// Stop the lease on the message id, if it has one. Must be called with
+// s.lock held.
+func (s *Service) endLeaseLocked(data *clientData, id MessageId) {
+	if t, ok := data.leases[id]; ok {
+		t.Stop()
+		delete(data.leases, id)
+	}
+}
+
+func (s *Service) handleExtend(c net.Conn, msg *Extend, data *clientData) error {
+	lease, err := time.ParseDuration(msg.Lease)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+
+	_, ok := data.inflight[msg.MessageId]
+	if ok {
+		s.leaseLocked(data, msg.MessageId, lease)
+	}
+
+	s.lock.Unlock()
+
+	if !ok {
+		return EUnknownMessage
+	}
+
+	_, err = c.Write([]byte{uint8(SuccessType)})
+	return err
+}
+
 func (s *Service) handleStats(c net.Conn, data *clientData) error {
+	s.lock.Lock()
 	stats := &ClientStats{
 		InFlight: len(data.inflight),
 	}
+	s.lock.Unlock()
 
 	c.Write([]byte{uint8(StatsResultType)})
 	enc := codec.NewEncoder(c, &msgpack)
@@ -556,6 +908,9 @@ func (s *Service) handleStats(c net.Conn, data *clientData) error {
 }
 
 func (s *Service) handleAck(c net.Conn, msg *AckMessage, data *clientData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	if del, ok := data.inflight[msg.MessageId]; ok {
 		err := del.Ack()
 		if err != nil {
@@ -565,6 +920,7 @@ func (s *Service) handleAck(c net.Conn, msg *AckMessage, data *clientData) error
 
 		debugf("removing %s from inflight\n", msg.MessageId)
 		delete(data.inflight, msg.MessageId)
+		s.endLeaseLocked(data, msg.MessageId)
 		debugf("inflight now: %#v\n", data.inflight)
 	} else {
 		return EUnknownMessage
@@ -575,6 +931,9 @@ func (s *Service) handleAck(c net.Conn, msg *AckMessage, data *clientData) error
 }
 
 func (s *Service) handleNack(c net.Conn, msg *NackMessage, data *clientData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	if del, ok := data.inflight[msg.MessageId]; ok {
 		err := del.Nack()
 		if err != nil {
@@ -584,6 +943,7 @@ func (s *Service) handleNack(c net.Conn, msg *NackMessage, data *clientData) err
 
 		debugf("removing %s from inflight\n", msg.MessageId)
 		delete(data.inflight, msg.MessageId)
+		s.endLeaseLocked(data, msg.MessageId)
 		debugf("inflight now: %#v\n", data.inflight)
 	} else {
 		return EUnknownMessage
@@ -594,11 +954,37 @@ func (s *Service) handleNack(c net.Conn, msg *NackMessage, data *clientData) err
 }
 
 type Client struct {
-	conn   net.Conn
-	sess   *yamux.Session
-	addr   string
-	secure bool
-	lwt    *Message
+	conn      net.Conn
+	sess      *yamux.Session
+	addr      string
+	secure    bool
+	tlsConfig *tls.Config
+	lwt       *Message
+
+	dialTimeout time.Duration
+
+	// asked of the broker for each message polled, see WithLease
+	lease time.Duration
+
+	// brokers to fail over between, tried in order from addrs[current]
+	addrs   []string
+	current int
+
+	// guards conn, sess and the fields below
+	lock       sync.Mutex
+	generation int
+	restore    bool
+	ephemerals map[string]bool
+	lwts       map[string]*Message
+	subs       []*Message
+
+	redialLock sync.Mutex
+
+	// requests being handled over the connection, for request/cancel
+	cancels cancelTable
+
+	// as last reported to a StateObserver
+	connState connState
 }
 
 func NewClient(addr string) (*Client, error) {
@@ -620,25 +1006,73 @@ func NewInsecureClient(addr string) (*Client, error) {
 	return cl, nil
 }
 
+// Create a Client that connects to addr over TLS, verifying the server
+// according to cfg. Unlike NewClient, the connection is made immediately
+// so a failed handshake is reported here.
+func NewTLSClient(addr string, cfg *tls.Config) (*Client, error) {
+	cl := &Client{
+		addr:      addr,
+		tlsConfig: cfg,
+	}
+
+	_, err := cl.Session()
+	if err != nil {
+		return nil, err
+	}
+
+	return cl, nil
+}
+
 func (c *Client) checkError(err error) error {
 	debugf("client %s error: %s\n", c.addr, err)
 	if err == io.EOF {
+		c.lock.Lock()
 		c.conn = nil
+		c.lock.Unlock()
 	}
 
 	return err
 }
 
 func (c *Client) Session() (*yamux.Session, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if c.sess == nil {
-		s, err := net.Dial("tcp", c.addr)
+		s, addr, err := c.dial()
 		if err != nil {
 			return nil, err
 		}
 
-		if c.secure {
+		// The dial timeout covers the handshake as well
+		if c.dialTimeout > 0 {
+			s.SetDeadline(time.Now().Add(c.dialTimeout))
+		}
+
+		if c.tlsConfig != nil {
+			tc := tls.Client(s, c.tlsConfigFor(addr))
+
+			err = tc.Handshake()
+			if err != nil {
+				s.Close()
+
+				if isTimeout(err) {
+					return nil, ETimeout
+				}
+
+				return nil, fmt.Errorf("tls handshake with %s failed: %w", addr, err)
+			}
+
+			c.conn = tc
+		} else if c.secure {
 			sec, err := seconn.NewClient(s)
 			if err != nil {
+				s.Close()
+
+				if isTimeout(err) {
+					return nil, ETimeout
+				}
+
 				return nil, err
 			}
 
@@ -647,41 +1081,256 @@ func (c *Client) Session() (*yamux.Session, error) {
 			c.conn = s
 		}
 
+		if c.dialTimeout > 0 {
+			s.SetDeadline(time.Time{})
+		}
+
 		sess, err := yamux.Client(c.conn, muxConfig)
 		if err != nil {
 			return nil, err
 		}
 
 		c.sess = sess
+		c.generation++
 	}
 
 	return c.sess, nil
 }
 
-func (c *Client) Close() (err error) {
-	if c.conn == nil {
-		return nil
-	}
+// Return a number identifying the current connection, for use with redial
+func (c *Client) currentGeneration() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	sess, err := c.Session()
-	if err != nil {
-		return err
-	}
+	return c.generation
+}
 
-	s, err := sess.Open()
-	if err != nil {
-		return err
-	}
+// Replace the connection identified by gen with a new one, then restore
+// the ephemeral mailboxes and LWTs that were set up on it. If the
+// connection was already replaced, just wait for that to finish.
+func (c *Client) redial(gen int) error {
+	c.redialLock.Lock()
+	defer c.redialLock.Unlock()
 
-	_, err = s.Write([]byte{uint8(CloseType)})
+	c.lock.Lock()
 
-	defer func() {
-		s.Close()
+	if c.generation == gen {
+		if c.sess != nil {
+			c.sess.Close()
+		}
 
-		err = c.sess.Close()
 		c.sess = nil
 		c.conn = nil
-	}()
+		c.restore = true
+	}
+
+	restore := c.restore
+
+	var (
+		ephemerals []string
+		lwts       []*Message
+	)
+
+	for name := range c.ephemerals {
+		ephemerals = append(ephemerals, name)
+	}
+
+	for _, lwt := range c.lwts {
+		lwts = append(lwts, lwt)
+	}
+
+	subs := append([]*Message(nil), c.subs...)
+
+	c.lock.Unlock()
+
+	if !restore {
+		return nil
+	}
+
+	_, err := c.Session()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range ephemerals {
+		err = c.EphemeralDeclare(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, lwt := range lwts {
+		err = c.Push(":lwt", lwt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sub := range subs {
+		err = c.Push(":subscribe", sub)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	c.restore = false
+	c.lock.Unlock()
+
+	return nil
+}
+
+// Remember an ephemeral mailbox, LWT or subscription so redial can
+// restore it
+func (c *Client) track(name string, msg *Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch name {
+	case ":lwt":
+		if c.lwts == nil {
+			c.lwts = make(map[string]*Message)
+		}
+
+		c.lwts[msg.CorrelationId] = msg
+	case ":subscribe":
+		for _, sub := range c.subs {
+			if sub.ReplyTo == msg.ReplyTo && sub.CorrelationId == msg.CorrelationId {
+				return
+			}
+		}
+
+		c.subs = append(c.subs, msg)
+	default:
+		if c.ephemerals == nil {
+			c.ephemerals = make(map[string]bool)
+		}
+
+		c.ephemerals[name] = true
+	}
+}
+
+func (c *Client) untrack(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.ephemerals, name)
+	delete(c.lwts, name)
+
+	subs := c.subs[:0]
+
+	for _, sub := range c.subs {
+		if sub.ReplyTo != name {
+			subs = append(subs, sub)
+		}
+	}
+
+	c.subs = subs
+}
+
+// Connect to the broker, returning the address used. With several
+// addresses, a reconnect starts from the one after the broker that was
+// lost, so a dead broker is tried last rather than first. Must be
+// called with lock held.
+func (c *Client) dial() (net.Conn, string, error) {
+	if len(c.addrs) == 0 {
+		s, err := c.dialAddr(c.addr)
+		return s, c.addr, err
+	}
+
+	start := 0
+
+	if c.generation > 0 {
+		start = (c.current + 1) % len(c.addrs)
+	}
+
+	var err error
+
+	for i := range c.addrs {
+		idx := (start + i) % len(c.addrs)
+		addr := c.addrs[idx]
+
+		var s net.Conn
+
+		s, err = c.dialAddr(addr)
+		if err == nil {
+			c.current = idx
+			return s, addr, nil
+		}
+
+		debugf("client %s unreachable: %s\n", addr, err)
+	}
+
+	return nil, "", err
+}
+
+func (c *Client) dialAddr(addr string) (net.Conn, error) {
+	if c.dialTimeout == 0 {
+		return net.Dial("tcp", addr)
+	}
+
+	s, err := net.DialTimeout("tcp", addr, c.dialTimeout)
+	if err != nil && isTimeout(err) {
+		return nil, ETimeout
+	}
+
+	return s, err
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Return the TLS config to use, defaulting ServerName to the host
+// being dialed like tls.Dial does.
+func (c *Client) tlsConfigFor(addr string) *tls.Config {
+	if c.tlsConfig.ServerName != "" {
+		return c.tlsConfig
+	}
+
+	cfg := c.tlsConfig.Clone()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	cfg.ServerName = host
+
+	return cfg
+}
+
+func (c *Client) Close() (err error) {
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	sess, err := c.Session()
+	if err != nil {
+		return err
+	}
+
+	s, err := sess.Open()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Write([]byte{uint8(CloseType)})
+
+	defer func() {
+		s.Close()
+
+		c.lock.Lock()
+		err = c.sess.Close()
+		c.sess = nil
+		c.conn = nil
+		c.lock.Unlock()
+	}()
 
 	buf := []byte{0}
 
@@ -858,6 +1507,7 @@ func (c *Client) EphemeralDeclare(name string) error {
 
 		return errors.New(msgerr.Error)
 	case SuccessType:
+		c.track(name, nil)
 		return nil
 	default:
 		return c.checkError(EProtocolError)
@@ -909,6 +1559,82 @@ func (c *Client) Abandon(name string) error {
 			return c.checkError(err)
 		}
 
+		// The broker adds the mailbox's name to the error
+		if strings.HasPrefix(msgerr.Error, ENoMailbox.Error()) {
+			return ENoMailbox
+		}
+
+		return errors.New(msgerr.Error)
+	case SuccessType:
+		c.untrack(name)
+		return nil
+	default:
+		return c.checkError(EProtocolError)
+	}
+}
+
+func (c *Client) leaseString() string {
+	if c.lease <= 0 {
+		return ""
+	}
+
+	return c.lease.String()
+}
+
+// Renew the lease on the message id for d from now. ENotSupported is
+// returned if the broker predates leases.
+func (c *Client) extend(id MessageId, d time.Duration) error {
+	sess, err := c.Session()
+	if err != nil {
+		return err
+	}
+
+	s, err := sess.Open()
+	if err != nil {
+		return err
+	}
+
+	defer s.Close()
+
+	_, err = s.Write([]byte{uint8(ExtendType)})
+	if err != nil {
+		return c.checkError(err)
+	}
+
+	enc := codec.NewEncoder(s, &msgpack)
+
+	msg := Extend{
+		MessageId: id,
+		Lease:     d.String(),
+	}
+
+	if err := enc.Encode(&msg); err != nil {
+		return c.checkError(err)
+	}
+
+	buf := []byte{0}
+
+	_, err = io.ReadFull(s, buf)
+	if err != nil {
+		return c.checkError(err)
+	}
+
+	switch MessageType(buf[0]) {
+	case ErrorType:
+		var msgerr Error
+
+		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
+		if err != nil {
+			return c.checkError(err)
+		}
+
+		switch msgerr.Error {
+		case EProtocolError.Error():
+			return ENotSupported
+		case EUnknownMessage.Error():
+			return EUnknownMessage
+		}
+
 		return errors.New(msgerr.Error)
 	case SuccessType:
 		return nil
@@ -1043,7 +1769,8 @@ func (c *Client) Poll(name string) (*Delivery, error) {
 	enc := codec.NewEncoder(s, &msgpack)
 
 	msg := Poll{
-		Name: name,
+		Name:  name,
+		Lease: c.leaseString(),
 	}
 
 	if err := enc.Encode(&msg); err != nil {
@@ -1081,9 +1808,14 @@ func (c *Client) Poll(name string) (*Delivery, error) {
 		}
 
 		del := &Delivery{
-			Message: res.Message,
-			Ack:     func() error { return c.ack(res.Message.MessageId) },
-			Nack:    func() error { return c.nack(res.Message.MessageId) },
+			Message:       res.Message,
+			Ack:           func() error { return c.ack(res.Message.MessageId) },
+			Nack:          func() error { return c.nack(res.Message.MessageId) },
+			DeliveryCount: res.DeliveryCount,
+			lease:         c.lease,
+			extend: func(d time.Duration) error {
+				return c.extend(res.Message.MessageId, d)
+			},
 		}
 
 		return del, nil
@@ -1115,6 +1847,7 @@ func (c *Client) LongPoll(name string, til time.Duration) (*Delivery, error) {
 	msg := LongPoll{
 		Name:     name,
 		Duration: til.String(),
+		Lease:    c.leaseString(),
 	}
 
 	if err := enc.Encode(&msg); err != nil {
@@ -1152,9 +1885,14 @@ func (c *Client) LongPoll(name string, til time.Duration) (*Delivery, error) {
 		}
 
 		del := &Delivery{
-			Message: res.Message,
-			Ack:     func() error { return c.ack(res.Message.MessageId) },
-			Nack:    func() error { return c.nack(res.Message.MessageId) },
+			Message:       res.Message,
+			Ack:           func() error { return c.ack(res.Message.MessageId) },
+			Nack:          func() error { return c.nack(res.Message.MessageId) },
+			DeliveryCount: res.DeliveryCount,
+			lease:         c.lease,
+			extend: func(d time.Duration) error {
+				return c.extend(res.Message.MessageId, d)
+			},
 		}
 
 		return del, nil
@@ -1186,6 +1924,7 @@ func (c *Client) LongPollCancelable(name string, til time.Duration, done chan st
 	msg := LongPoll{
 		Name:     name,
 		Duration: til.String(),
+		Lease:    c.leaseString(),
 	}
 
 	if err := enc.Encode(&msg); err != nil {
@@ -1201,18 +1940,58 @@ func (c *Client) LongPollCancelable(name string, til time.Duration, done chan st
 		close(delivered)
 	}()
 
+	canceled := false
+
 	select {
 	case <-done:
-		return nil, nil
+		// Ending the stream tells the broker to stop polling. It then
+		// answers with any message it took just before, which is put
+		// back rather than lost.
+		canceled = true
+		s.Close()
+
+		select {
+		case <-delivered:
+		case <-time.After(cCancelWait):
+			return nil, nil
+		}
 	case <-delivered:
 		// do the rest
 	}
 
-	switch MessageType(buf[0]) {
+	if err != nil {
+		if canceled {
+			return nil, nil
+		}
+
+		return nil, c.checkError(err)
+	}
+
+	del, err := c.readPollResult(s, buf[0])
+
+	if canceled {
+		if del != nil {
+			debugf("putting back %s, its poll was canceled\n", del.Message.MessageId)
+			del.Nack()
+		}
+
+		return nil, nil
+	}
+
+	return del, err
+}
+
+// How long a canceled long poll waits for the broker to answer, after
+// which a message it took is left until the connection goes
+const cCancelWait = time.Second
+
+// Read the rest of the answer to a long poll, whose first byte was typ
+func (c *Client) readPollResult(s io.Reader, typ byte) (*Delivery, error) {
+	switch MessageType(typ) {
 	case ErrorType:
 		var msgerr Error
 
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
+		err := codec.NewDecoder(s, &msgpack).Decode(&msgerr)
 		if err != nil {
 			return nil, c.checkError(err)
 		}
@@ -1232,9 +2011,14 @@ func (c *Client) LongPollCancelable(name string, til time.Duration, done chan st
 		}
 
 		del := &Delivery{
-			Message: res.Message,
-			Ack:     func() error { return c.ack(res.Message.MessageId) },
-			Nack:    func() error { return c.nack(res.Message.MessageId) },
+			Message:       res.Message,
+			Ack:           func() error { return c.ack(res.Message.MessageId) },
+			Nack:          func() error { return c.nack(res.Message.MessageId) },
+			DeliveryCount: res.DeliveryCount,
+			lease:         c.lease,
+			extend: func(d time.Duration) error {
+				return c.extend(res.Message.MessageId, d)
+			},
 		}
 
 		return del, nil
@@ -1244,6 +2028,13 @@ func (c *Client) LongPollCancelable(name string, til time.Duration, done chan st
 }
 
 func (c *Client) Push(name string, body *Message) error {
+	return c.pushDeadline(name, body, time.Time{})
+}
+
+// Push body, giving up with ETimeout if the broker hasn't accepted it
+// by deadline. A zero deadline waits as long as it takes. The broker
+// may still accept a push that timed out.
+func (c *Client) pushDeadline(name string, body *Message, deadline time.Time) error {
 	sess, err := c.Session()
 	if err != nil {
 		return err
@@ -1256,8 +2047,16 @@ func (c *Client) Push(name string, body *Message) error {
 
 	defer s.Close()
 
+	if !deadline.IsZero() {
+		s.SetDeadline(deadline)
+	}
+
 	_, err = s.Write([]byte{uint8(PushType)})
 	if err != nil {
+		if isTimeout(err) {
+			return ETimeout
+		}
+
 		return c.checkError(err)
 	}
 
@@ -1265,12 +2064,16 @@ func (c *Client) Push(name string, body *Message) error {
 
 	msg := Push{
 		Name:    name,
-		Message: body,
+		Message: stamped(name, body),
 	}
 
 	debugf("client %s: sending push request\n", c.addr)
 
 	if err := enc.Encode(&msg); err != nil {
+		if isTimeout(err) {
+			return ETimeout
+		}
+
 		return c.checkError(err)
 	}
 
@@ -1280,6 +2083,10 @@ func (c *Client) Push(name string, body *Message) error {
 
 	_, err = io.ReadFull(s, buf)
 	if err != nil {
+		if isTimeout(err) {
+			return ETimeout
+		}
+
 		return c.checkError(err)
 	}
 
@@ -1298,6 +2105,11 @@ func (c *Client) Push(name string, body *Message) error {
 	case SuccessType:
 		debugf("client %s: got success\n", c.addr)
 
+		switch name {
+		case ":lwt", ":subscribe":
+			c.track(name, body)
+		}
+
 		return nil
 	default:
 		debugf("client %s: got protocol error\n", c.addr)
@@ -1305,3 +2117,266 @@ func (c *Client) Push(name string, body *Message) error {
 		return c.checkError(EProtocolError)
 	}
 }
+
+// Returned by PushBatch when some of the messages couldn't be pushed.
+type BatchError struct {
+	// Why each message failed, by its index in the batch
+	Errors map[int]error
+}
+
+func (b *BatchError) Error() string {
+	var idx []int
+
+	for i := range b.Errors {
+		idx = append(idx, i)
+	}
+
+	sort.Ints(idx)
+
+	var parts []string
+
+	for _, i := range idx {
+		parts = append(parts, fmt.Sprintf("%d: %s", i, b.Errors[i]))
+	}
+
+	return fmt.Sprintf("unable to push %d messages (%s)", len(idx), strings.Join(parts, ", "))
+}
+
+// Push all of msgs to the mailbox name in a single round trip. If any
+// of them couldn't be pushed, a *BatchError saying which is returned.
+// Brokers that don't support batches get each message pushed in turn.
+func (c *Client) PushBatch(name string, msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	// Push tracks LWTs and subscriptions so they survive a reconnect
+	if name[0] == ':' {
+		return c.pushEach(name, msgs)
+	}
+
+	sess, err := c.Session()
+	if err != nil {
+		return err
+	}
+
+	s, err := sess.Open()
+	if err != nil {
+		return err
+	}
+
+	defer s.Close()
+
+	_, err = s.Write([]byte{uint8(PushBatchType)})
+	if err != nil {
+		return c.checkError(err)
+	}
+
+	enc := codec.NewEncoder(s, &msgpack)
+
+	stampedMsgs := make([]*Message, len(msgs))
+	for i, m := range msgs {
+		stampedMsgs[i] = stamped(name, m)
+	}
+
+	msg := PushBatch{
+		Name:     name,
+		Messages: stampedMsgs,
+	}
+
+	debugf("client %s: sending push batch request\n", c.addr)
+
+	if err := enc.Encode(&msg); err != nil {
+		return c.checkError(err)
+	}
+
+	buf := []byte{0}
+
+	_, err = io.ReadFull(s, buf)
+	if err != nil {
+		return c.checkError(err)
+	}
+
+	switch MessageType(buf[0]) {
+	case ErrorType:
+		var msgerr Error
+
+		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
+		if err != nil {
+			return c.checkError(err)
+		}
+
+		if msgerr.Error == EProtocolError.Error() {
+			debugf("client %s: no batch support, pushing one at a time\n", c.addr)
+			return c.pushEach(name, msgs)
+		}
+
+		return errors.New(msgerr.Error)
+	case PushBatchResultType:
+		var res PushBatchResult
+
+		err = codec.NewDecoder(s, &msgpack).Decode(&res)
+		if err != nil {
+			return c.checkError(err)
+		}
+
+		if len(res.Errors) != len(msgs) {
+			return c.checkError(EProtocolError)
+		}
+
+		errs := map[int]error{}
+
+		for i, str := range res.Errors {
+			if str != "" {
+				errs[i] = errors.New(str)
+			}
+		}
+
+		if len(errs) > 0 {
+			return &BatchError{Errors: errs}
+		}
+
+		return nil
+	default:
+		return c.checkError(EProtocolError)
+	}
+}
+
+// Publish msg, with the topic in its CorrelationId, returning how many
+// subscriber mailboxes it was delivered to
+func (c *Client) PublishCount(msg *Message) (int, error) {
+	sess, err := c.Session()
+	if err != nil {
+		return 0, err
+	}
+
+	s, err := sess.Open()
+	if err != nil {
+		return 0, err
+	}
+
+	defer s.Close()
+
+	_, err = s.Write([]byte{uint8(PublishCountType)})
+	if err != nil {
+		return 0, c.checkError(err)
+	}
+
+	enc := codec.NewEncoder(s, &msgpack)
+
+	if err := enc.Encode(&PublishCount{Message: msg}); err != nil {
+		return 0, c.checkError(err)
+	}
+
+	buf := []byte{0}
+
+	_, err = io.ReadFull(s, buf)
+	if err != nil {
+		return 0, c.checkError(err)
+	}
+
+	switch MessageType(buf[0]) {
+	case ErrorType:
+		var msgerr Error
+
+		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
+		if err != nil {
+			return 0, c.checkError(err)
+		}
+
+		return 0, errors.New(msgerr.Error)
+	case PublishCountResultType:
+		var res PublishCountResult
+
+		err = codec.NewDecoder(s, &msgpack).Decode(&res)
+		if err != nil {
+			return 0, c.checkError(err)
+		}
+
+		return res.Count, nil
+	default:
+		return 0, c.checkError(EProtocolError)
+	}
+}
+
+// Return the stats of the mailbox name. ENotSupported is returned if
+// the broker can't report them, including brokers that predate it.
+func (c *Client) QueueStats(name string) (*MailboxStats, error) {
+	sess, err := c.Session()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := sess.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.Close()
+
+	_, err = s.Write([]byte{uint8(QueueStatsType)})
+	if err != nil {
+		return nil, c.checkError(err)
+	}
+
+	enc := codec.NewEncoder(s, &msgpack)
+
+	if err := enc.Encode(&QueueStats{Name: name}); err != nil {
+		return nil, c.checkError(err)
+	}
+
+	buf := []byte{0}
+
+	_, err = io.ReadFull(s, buf)
+	if err != nil {
+		return nil, c.checkError(err)
+	}
+
+	switch MessageType(buf[0]) {
+	case ErrorType:
+		var msgerr Error
+
+		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
+		if err != nil {
+			return nil, c.checkError(err)
+		}
+
+		switch msgerr.Error {
+		case ENotSupported.Error(), EProtocolError.Error():
+			return nil, ENotSupported
+		}
+
+		return nil, errors.New(msgerr.Error)
+	case QueueStatsResultType:
+		var res MailboxStats
+
+		err = codec.NewDecoder(s, &msgpack).Decode(&res)
+		if err != nil {
+			return nil, c.checkError(err)
+		}
+
+		return &res, nil
+	default:
+		return nil, c.checkError(EProtocolError)
+	}
+}
+
+func (c *Client) pushEach(name string, msgs []*Message) error {
+	errs := map[int]error{}
+
+	for i, msg := range msgs {
+		if err := c.Push(name, msg); err != nil {
+			errs[i] = err
+		}
+	}
+
+	if len(errs) > 0 {
+		return &BatchError{Errors: errs}
+	}
+
+	return nil
+}
@@ -1,7 +1,15 @@
 package vega
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -558,3 +566,128 @@ func TestServiceDeclareLWTOnEphemeral(t *testing.T) {
 
 	assert.Equal(t, "death", got.Message.Type)
 }
+
+// Generate a self-signed certificate for 127.0.0.1, returning a server
+// config using it and a client config that trusts it.
+func testTLSConfigs() (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vega test"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+
+	return server, &tls.Config{RootCAs: pool}
+}
+
+func TestServiceAcceptTLS(t *testing.T) {
+	serverCfg, clientCfg := testTLSConfigs()
+
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.AcceptTLS(serverCfg)
+
+	c1, err := NewTLSClient(cPort, clientCfg)
+	require.NoError(t, err)
+
+	defer c1.Close()
+
+	c1.Declare("a")
+
+	payload := Msg("hello")
+
+	err = c1.Push("a", payload)
+	require.NoError(t, err)
+
+	msg, err := c1.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+
+	assert.True(t, payload.Equal(msg.Message))
+}
+
+func TestServiceTLSHandshakeFailure(t *testing.T) {
+	serverCfg, _ := testTLSConfigs()
+
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.AcceptTLS(serverCfg)
+
+	_, err = NewTLSClient(cPort, &tls.Config{})
+	require.Error(t, err)
+
+	assert.Contains(t, err.Error(), "tls handshake")
+}
+
+func TestClientPreservesHeaders(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	client, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer client.Close()
+
+	err = client.Declare("a")
+	require.NoError(t, err)
+
+	msg := Msg([]byte("hello"))
+	msg.AddHeader("trace-id", "abc123")
+	msg.AddHeader("attempt", 2)
+
+	err = client.Push("a", msg)
+	require.NoError(t, err)
+
+	del, err := client.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	trace, ok := del.Message.HeaderString("trace-id")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", trace)
+
+	_, ok = del.Message.GetHeader("attempt")
+	assert.True(t, ok)
+}
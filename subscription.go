@@ -24,21 +24,68 @@ func ParseSubscription(pattern string) *Subscription {
 }
 
 func (s *Subscription) Match(lit string) bool {
-	parts := strings.Split(lit, "/")
+	return matchParts(s.Parts, s.Strict, strings.Split(lit, "/"))
+}
+
+// Matches hierarchical topics against a pattern, as Publish does.
+// Topics are split into segments on "." or "/", so "orders.us.created"
+// and "orders/us/created" are the same topic. In a pattern, "*" (or
+// "+") matches any one segment and a trailing "#" matches one or more
+// remaining segments. Empty segments are segments like any other, so
+// "a..b" has three and "*" matches the empty one in the middle.
+//
+// Unlike a Subscription, which only splits on "/", a "+" doesn't match
+// "a.b" and "a/+" does match "a.b".
+type TopicMatcher struct {
+	parts  []string
+	strict bool
+}
+
+func NewTopicMatcher(pattern string) TopicMatcher {
+	parts := splitTopic(pattern)
+
+	for i, part := range parts {
+		if part == "*" {
+			parts[i] = "+"
+		}
+	}
+
+	strict := true
+
+	if parts[len(parts)-1] == "#" {
+		parts[len(parts)-1] = "+"
+		strict = false
+	}
+
+	return TopicMatcher{parts, strict}
+}
+
+func splitTopic(topic string) []string {
+	return strings.Split(strings.Replace(topic, "/", ".", -1), ".")
+}
+
+// Report whether topic matches the pattern
+func (m TopicMatcher) Match(topic string) bool {
+	return matchParts(m.parts, m.strict, splitTopic(topic))
+}
 
-	if len(parts) != len(s.Parts) {
-		if s.Strict {
+// Match the segments of a topic against those of a pattern, where "+"
+// matches any segment. Unless strict, the last one also matches any
+// segments after it.
+func matchParts(pattern []string, strict bool, parts []string) bool {
+	if len(parts) != len(pattern) {
+		if strict {
 			return false
 		}
 
-		if len(parts) < len(s.Parts) {
+		if len(parts) < len(pattern) {
 			return false
 		}
 
-		parts = parts[:len(s.Parts)]
+		parts = parts[:len(pattern)]
 	}
 
-	for i, against := range s.Parts {
+	for i, against := range pattern {
 		concrete := parts[i]
 
 		if against == "+" || against == concrete {
@@ -42,5 +42,56 @@ func TestSubscription(t *testing.T) {
 		assert.False(t, sub.Match("bar/qux"))
 	})
 
+	n.It("only splits on /", func() {
+		sub := ParseSubscription("+")
+		assert.True(t, sub.Match("a.b"))
+
+		sub = ParseSubscription("foo/+")
+		assert.False(t, sub.Match("foo.bar"))
+
+		sub = ParseSubscription("foo.+")
+		assert.True(t, sub.Match("foo.+"))
+		assert.False(t, sub.Match("foo.bar"))
+	})
+
 	n.Meow()
 }
+
+func TestTopicMatcher(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"orders.us.created", "orders.us.created", true},
+		{"orders.us.created", "orders.eu.created", false},
+		{"orders.*.created", "orders.us.created", true},
+		{"orders.*.created", "orders.us.deleted", false},
+		{"orders.*.created", "orders.created", false},
+		{"orders.*.created", "orders.us.east.created", false},
+		{"orders.#", "orders.us", true},
+		{"orders.#", "orders.us.created", true},
+		{"orders.#", "orders", false},
+		{"orders.#", "invoices.us", false},
+		{"#", "orders", true},
+		{"#", "orders.us.created", true},
+		{"*", "orders", true},
+		{"*", "orders.us", false},
+		{"*.*", "orders.us", true},
+		{"orders.*", "orders.", true},
+		{"orders..created", "orders..created", true},
+		{"orders.*.created", "orders..created", true},
+		{"orders.#.created", "orders.#.created", true},
+		{"orders.#.created", "orders.us.created", false},
+		{"orders/+/created", "orders.us.created", true},
+		{"orders.*.created", "orders/us/created", true},
+		{"", "", true},
+		{"", "orders", false},
+	}
+
+	for _, test := range tests {
+		m := NewTopicMatcher(test.pattern)
+
+		assert.Equal(t, test.match, m.Match(test.topic),
+			"pattern %q against topic %q", test.pattern, test.topic)
+	}
+}
@@ -1,12 +1,15 @@
 package vega
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"runtime"
 	"strconv"
+	"sync"
 
 	crand "crypto/rand"
 )
@@ -24,6 +27,35 @@ var privateBlocks []*net.IPNet
 var randSrc rand.Source
 var randGen *rand.Rand
 
+// rand.Rand isn't safe for concurrent use, so randGen is guarded
+var randLock sync.Mutex
+
+// Where generateUUID gets its bytes, guarded by uuidLock
+var (
+	uuidLock   sync.Mutex
+	uuidSource io.Reader = defaultUUIDSource()
+)
+
+func defaultUUIDSource() io.Reader {
+	return bufio.NewReaderSize(crand.Reader, 4096)
+}
+
+// Replace the source of the random bytes in mailbox names and ids made
+// by RandomMailbox and RandomID. Meant for tests, where a seeded source
+// such as rand.New(rand.NewSource(1)) makes the names repeatable. A nil
+// r restores the default, which reads from crypto/rand so names can't
+// be predicted by other clients of the broker.
+func SetRandomSource(r io.Reader) {
+	uuidLock.Lock()
+	defer uuidLock.Unlock()
+
+	if r == nil {
+		r = defaultUUIDSource()
+	}
+
+	uuidSource = r
+}
+
 func init() {
 	// Add each private block
 	privateBlocks = make([]*net.IPNet, 3)
@@ -109,17 +141,17 @@ func runtimeStats() map[string]string {
 	}
 }
 
-// generateUUID is used to generate a random UUID
+// generateUUID is used to generate a random UUID from uuidSource
 func generateUUID() string {
 	uuid := make([]byte, 16)
 
-	for i := 0; i < 16; i += 8 {
-		binary.BigEndian.PutUint64(uuid[i:i+8], uint64(randGen.Int63()))
-	}
+	uuidLock.Lock()
+	_, err := io.ReadFull(uuidSource, uuid)
+	uuidLock.Unlock()
 
-	// if _, err := rand.Read(uuid); err != nil {
-	// panic(fmt.Errorf("failed to read random bytes: %v", err))
-	// }
+	if err != nil {
+		panic(fmt.Errorf("failed to read random bytes: %v", err))
+	}
 
 	uuid[6] = (uuid[6] & 0x0f) | 0x40 // Version 4
 	uuid[8] = (uuid[8] & 0x3f) | 0x80 // Variant is 10
@@ -151,8 +183,18 @@ func generateUUIDSecure() string {
 		uuid[10:16])
 }
 
+// Return a new mailbox name. Names carry 122 random bits as a version 4
+// UUID, so the chance of any two of n names colliding is below
+// n*n / 2^123: about 1 in 10^19 for a billion names.
 func RandomMailbox() string {
-	return "gen-" + generateUUID()
+	return RandomMailboxPrefixed("gen-")
+}
+
+// Return a new mailbox name starting with prefix, as random as the
+// ones made by RandomMailbox. A prefix lets mailboxes be told apart by
+// what made them, such as in broker stats or logs.
+func RandomMailboxPrefixed(prefix string) string {
+	return prefix + generateUUID()
 }
 
 func RandomID() string {
@@ -181,10 +223,14 @@ func RandomIV(size int) []byte {
 
 	iv := make([]byte, size)
 
+	randLock.Lock()
+
 	for i := 0; i < size; i += 8 {
 		binary.BigEndian.PutUint64(iv[i:i+8], uint64(randGen.Int63()))
 	}
 
+	randLock.Unlock()
+
 	return iv
 }
 
@@ -1,6 +1,12 @@
 package vega
 
-import "testing"
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func BenchmarkGenerateUUIDFast(b *testing.B) {
 	for i := 0; i < b.N; i++ {
@@ -19,3 +25,27 @@ func BenchmarkNextMessageID(b *testing.B) {
 		NextMessageID()
 	}
 }
+
+func TestRandomMailboxSeededSource(t *testing.T) {
+	defer SetRandomSource(nil)
+
+	SetRandomSource(rand.New(rand.NewSource(1)))
+
+	first := []string{RandomMailbox(), RandomID()}
+
+	SetRandomSource(rand.New(rand.NewSource(1)))
+
+	second := []string{RandomMailbox(), RandomID()}
+
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first[0][len("gen-"):], first[1][len("m"):])
+}
+
+func TestRandomMailboxPrefixed(t *testing.T) {
+	name := RandomMailboxPrefixed("worker.")
+
+	assert.True(t, strings.HasPrefix(name, "worker."))
+	assert.Equal(t, len("worker.")+36, len(name))
+
+	assert.NotEqual(t, name, RandomMailboxPrefixed("worker."))
+}